@@ -2,7 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/nekrassov01/lem"
@@ -16,17 +24,203 @@ func newCmd(w, ew io.Writer) *cli.Command {
 	config := &cli.StringFlag{
 		Name:    "config",
 		Aliases: []string{"c"},
-		Usage:   "set configuration file path",
+		Usage:   "set configuration file path, or - to read it from stdin",
+		Sources: cli.EnvVars("LEM_CONFIG"),
+	}
+	allowExternal := &cli.BoolFlag{
+		Name:  "allow-external",
+		Usage: "allow stage paths outside of the project root",
+	}
+	timeout := &cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "set the timeout for the distribution (e.g. 30s)",
+	}
+	httpTimeout := &cli.DurationFlag{
+		Name:  "http-timeout",
+		Usage: "set the timeout for fetching the central env of a URL stage (e.g. 10s)",
+		Value: 30 * time.Second,
+	}
+	duplicateKeyPolicy := &cli.StringFlag{
+		Name:  "duplicate-key-policy",
+		Usage: "set the policy for keys delivered to more than one group: allow, warn, error",
+		Value: lem.DuplicateKeyAllow,
+	}
+	format := &cli.StringFlag{
+		Name:  "format",
+		Usage: "set the dotenv format for reading and writing env files: raw, strict",
+		Value: lem.FormatRaw,
+	}
+	strict := &cli.BoolFlag{
+		Name:  "strict",
+		Usage: "treat the warnings of validate as errors, such as a group dir holding the central env or a duplicate key",
+	}
+	envFile := &cli.StringFlag{
+		Name:  "env",
+		Usage: "use the env file instead of the central env of the current stage",
+	}
+	includes := &cli.BoolFlag{
+		Name:  "include",
+		Usage: "read the env files referenced by #include <path> lines in the central env",
+	}
+	directives := &cli.BoolFlag{
+		Name:  "directives",
+		Usage: "read the # lem:group=<id>,secret comments declaring the metadata of the following key",
+	}
+	envOverrides := &cli.BoolFlag{
+		Name:  "env-overrides",
+		Usage: "override the keys of the central env with the LEM_OVERRIDE_<KEY> environment variables",
+	}
+	outputSeparator := &cli.StringFlag{
+		Name:  "output-separator",
+		Usage: "separator between the key and the value in the written env files, such as \": \"",
+		Value: "=",
+	}
+	lineEnding := &cli.StringFlag{
+		Name:  "line-ending",
+		Usage: "set the line ending of the env files: lf, crlf",
+		Value: lem.LineEndingLF,
+	}
+	sourceOrder := &cli.BoolFlag{
+		Name:  "source-order",
+		Usage: "order the keys of the env files by their position in the central env",
+	}
+	storeHash := &cli.BoolFlag{
+		Name:  "store-hash",
+		Usage: "store the hashes of the central env and the env files in the state file for freshness",
+	}
+	dryRun := &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the stage to switch to without storing it",
+	}
+	backup := &cli.BoolFlag{
+		Name:  "backup",
+		Usage: "copy each env file to a <file>.<timestamp>.bak backup before overwriting it with different content",
+	}
+	checksums := &cli.BoolFlag{
+		Name:  "checksums",
+		Usage: "write a <file>.sha256 sidecar with the digest of each env file for integrity checks",
+	}
+	stageFile := &cli.BoolFlag{
+		Name:    "stage-file",
+		Usage:   "read the stage from the .lem-stage file in the project root before the state file",
+		Sources: cli.EnvVars("LEM_STAGE_FILE"),
+	}
+	timing := &cli.BoolFlag{
+		Name:  "timing",
+		Usage: "print the duration of reading the central env and writing the env files",
+	}
+	allStages := &cli.BoolFlag{
+		Name:  "all-stages",
+		Usage: "check the empty values of the groups for the central env of every stage",
+	}
+	namingPattern := &cli.StringFlag{
+		Name:  "naming-pattern",
+		Usage: "set the pattern that the group prefixes and the plain and replace entries must match",
+		Value: "[A-Z][A-Z0-9_]*",
+	}
+	direnvCycles := &cli.BoolFlag{
+		Name:  "direnv-cycles",
+		Usage: "warn about the cycles in the direnv references between groups",
+	}
+	onlyChanged := &cli.BoolFlag{
+		Name:  "only-changed",
+		Usage: "write only the groups whose env differs from the hashes stored by the previous run",
+	}
+	incremental := &cli.BoolFlag{
+		Name:  "incremental",
+		Usage: "rewrite only the groups whose env changed since the previous run",
+	}
+	outputRoot := &cli.StringFlag{
+		Name:  "output-root",
+		Usage: "write env files under the directory mirroring the group dirs instead of in place, relative to the configuration directory",
+	}
+	continueOnError := &cli.BoolFlag{
+		Name:  "continue-on-error",
+		Usage: "attempt every group and report all failures instead of stopping at the first one",
+	}
+	runOutput := &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Usage:   "set the output format of the messages: text, json",
+		Value:   lem.OutputText,
+	}
+	group := &cli.StringSliceFlag{
+		Name:    "group",
+		Aliases: []string{"g"},
+		Usage:   "restrict the distribution or the listing to the specified groups",
 	}
 	before := func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
 		path := cmd.String(config.Name)
-		cfg, err := lem.Load(path)
+		envPath := cmd.String(envFile.Name)
+		if envPath != "" {
+			abs, err := filepath.Abs(envPath)
+			if err != nil {
+				return nil, err
+			}
+			envPath = abs
+		}
+		opts := []lem.Option{
+			lem.WithAllowExternal(cmd.Bool(allowExternal.Name)),
+			lem.WithTimeout(cmd.Duration(timeout.Name)),
+			lem.WithHTTPTimeout(cmd.Duration(httpTimeout.Name)),
+			lem.WithDuplicateKeyPolicy(cmd.String(duplicateKeyPolicy.Name)),
+			lem.WithGroups(cmd.StringSlice(group.Name)...),
+			lem.WithFormat(cmd.String(format.Name)),
+			lem.WithStrict(cmd.Bool(strict.Name)),
+			lem.WithAllStages(cmd.Bool(allStages.Name)),
+			lem.WithNamingPattern(cmd.String(namingPattern.Name)),
+			lem.WithDirenvCycles(cmd.Bool(direnvCycles.Name)),
+			lem.WithEnvPath(envPath),
+			lem.WithIncludes(cmd.Bool(includes.Name)),
+			lem.WithDirectives(cmd.Bool(directives.Name)),
+			lem.WithSourceOrder(cmd.Bool(sourceOrder.Name)),
+			lem.WithStoreHash(cmd.Bool(storeHash.Name)),
+			lem.WithChecksums(cmd.Bool(checksums.Name)),
+			lem.WithBackup(cmd.Bool(backup.Name)),
+			lem.WithDryRun(cmd.Bool(dryRun.Name)),
+			lem.WithTiming(cmd.Bool(timing.Name)),
+			lem.WithIncremental(cmd.Bool(incremental.Name)),
+			lem.WithOnlyChanged(cmd.Bool(onlyChanged.Name)),
+			lem.WithStageFile(cmd.Bool(stageFile.Name)),
+			lem.WithLineEnding(cmd.String(lineEnding.Name)),
+			lem.WithOutputSeparator(cmd.String(outputSeparator.Name)),
+			lem.WithEnvOverrides(cmd.Bool(envOverrides.Name)),
+			lem.WithOutputRoot(cmd.String(outputRoot.Name)),
+			lem.WithContinueOnError(cmd.Bool(continueOnError.Name)),
+			lem.WithOutputFormat(cmd.String(runOutput.Name)),
+		}
+		var cfg *lem.Config
+		var err error
+		if path == "-" {
+			cfg, err = lem.LoadReader(cmd.Root().Reader, "", opts...)
+		} else {
+			cfg, err = lem.Load(path, opts...)
+		}
 		if err != nil {
 			return nil, err
 		}
 		cmd.Metadata["config"] = cfg
 		return ctx, nil
 	}
+	// complete returns a completion function that prints the names taken from the configuration.
+	// Before is not run while completing, so the configuration is loaded here and errors are ignored.
+	complete := func(names func(*lem.Config) []string) cli.ShellCompleteFunc {
+		return func(_ context.Context, cmd *cli.Command) {
+			cfg, err := lem.Load(cmd.String(config.Name), lem.WithAllowExternal(cmd.Bool(allowExternal.Name)))
+			if err != nil {
+				return
+			}
+			for _, name := range names(cfg) {
+				_, _ = fmt.Fprintln(cmd.Root().Writer, name)
+			}
+		}
+	}
+	stageNames := func(cfg *lem.Config) []string {
+		return slices.Sorted(maps.Keys(cfg.Stage))
+	}
+	groupIDs := func(cfg *lem.Config) []string {
+		return slices.Sorted(maps.Keys(cfg.Group))
+	}
 	return &cli.Command{
 		Name:                  "lem",
 		Version:               lem.Version(),
@@ -36,13 +230,44 @@ func newCmd(w, ew io.Writer) *cli.Command {
 		Writer:                w,
 		ErrWriter:             ew,
 		Metadata:              map[string]any{},
+		// Show the completion command provided by cli, which is hidden by default
+		ConfigureShellCompletionCommand: func(cmd *cli.Command) {
+			cmd.Hidden = false
+			cmd.Usage = "Print the shell completion script for bash, zsh, fish or pwsh"
+			cmd.ArgsUsage = "<shell>"
+		},
 		Commands: []*cli.Command{
 			{
 				Name:        "init",
 				Usage:       "Initialize the configuration file to current directory",
 				Description: "Init generates a sample lem.toml in the current directory.\nYou can customize this file for your use.",
-				Action: func(_ context.Context, _ *cli.Command) error {
-					return lem.Init()
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "set the prefix of the first group",
+						Value: "API",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "set the directory of the first group",
+						Value: "./backend",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					return lem.InitWith(cmd.String("prefix"), cmd.String("dir"))
+				},
+			},
+			{
+				Name:        "scaffold",
+				Usage:       "Suggest group tables from the existing directory structure",
+				Description: "Scaffold walks the specified directory and prints suggested group tables for each subdirectory\ncontaining a .env file or a .lemgroup marker file. Paste the output into lem.toml and adjust it.",
+				ArgsUsage:   "[dir]",
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					dir := cmd.Args().Get(0)
+					if dir == "" {
+						dir = "."
+					}
+					return lem.Scaffold(cmd.Writer, dir)
 				},
 			},
 			{
@@ -50,10 +275,33 @@ func newCmd(w, ew io.Writer) *cli.Command {
 				Usage:       "Validate that the configuration file is executable",
 				Description: "Validate validates whether the configuration file in the current directory is executable.\nIn addition to syntax checks, it also checks whether the path exists.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					duplicateKeyPolicy,
+					format,
+					envFile,
+					httpTimeout,
+					includes,
+					directives,
+					strict,
+					allStages,
+					namingPattern,
+					direnvCycles,
+					&cli.BoolFlag{
+						Name:  "explain",
+						Usage: "print a suggested fix referencing the configuration key when validation fails",
+					},
+				},
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
-					return cfg.Validate()
+					err := cfg.Validate()
+					if err != nil && cmd.Bool("explain") {
+						if hint := lem.Hint(err); hint != "" {
+							_, _ = fmt.Fprintf(cmd.Root().ErrWriter, "hint: %s\n", hint)
+						}
+					}
+					return err
 				},
 			},
 			{
@@ -61,18 +309,46 @@ func newCmd(w, ew io.Writer) *cli.Command {
 				Usage:       "Show the current stage context",
 				Description: "Stage displays the current stage context based on the configuration.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags:       []cli.Flag{config, allowExternal, stageFile},
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
 					return cfg.Current()
 				},
 			},
 			{
-				Name:        "switch",
-				Usage:       "Toggles the current stage to the specified stage",
-				Description: "Switch changes the current stage to the specified stage based on the state file.\nIf there is no state file, it will be created.",
+				Name:        "root",
+				Usage:       "Show the project root detected for the configuration",
+				Description: "Root displays the project root used to confine the paths in the configuration,\nand whether a .git directory was found there. Without .git, the configuration directory is used.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags:       []cli.Flag{config, allowExternal},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					root, found := cfg.Root()
+					_, _ = fmt.Fprintln(cmd.Writer, root)
+					if !found {
+						_, _ = fmt.Fprintln(cmd.ErrWriter, "warning: .git not found, falling back to the configuration directory")
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "stages",
+				Usage:       "Show all stages with their descriptions",
+				Description: "Stages displays all stages defined in the configuration along with their descriptions.",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					return cfg.Stages()
+				},
+			},
+			{
+				Name:          "switch",
+				Usage:         "Toggles the current stage to the specified stage",
+				Description:   "Switch changes the current stage to the specified stage based on the state file.\nIf there is no state file, it will be created.\nWith --dry-run, it validates the stage and prints the switch without touching the state file.",
+				Before:        before,
+				Flags:         []cli.Flag{config, allowExternal, dryRun},
+				ShellComplete: complete(stageNames),
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
 					if err := cfg.Switch(cmd.Args().Get(0)); err != nil {
@@ -81,42 +357,317 @@ func newCmd(w, ew io.Writer) *cli.Command {
 					return nil
 				},
 			},
+			{
+				Name:        "state",
+				Usage:       "Show the contents of the state file",
+				Description: "State prints the state file that holds the stage stored by switch for each configuration file.\nIf there is no state file, it prints \"no state\".\nWith --reset, it backs up the state file, such as a corrupt one, and starts with an empty state.",
+				Before:      before,
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					&cli.BoolFlag{
+						Name:  "reset",
+						Usage: "back up the state file to <path>.bak and replace it with an empty state",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					if cmd.Bool("reset") {
+						return cfg.ResetState()
+					}
+					b, err := cfg.StateDump()
+					if err != nil {
+						return err
+					}
+					if b == nil {
+						_, _ = fmt.Fprintln(cmd.Writer, "no state")
+						return nil
+					}
+					_, _ = fmt.Fprintln(cmd.Writer, string(b))
+					return nil
+				},
+			},
+			{
+				Name:        "states",
+				Usage:       "Show the stage stored for each configuration file in the state file",
+				Description: "States displays every configuration file tracked in the state file with its stored stage,\nsuch as to see which stage is selected in each repository. It does not need a configuration file.",
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					stages, err := lem.ListStates()
+					if err != nil {
+						return err
+					}
+					if len(stages) == 0 {
+						_, _ = fmt.Fprintln(cmd.Writer, "no state")
+						return nil
+					}
+					type row struct {
+						Config string
+						Stage  string
+					}
+					rows := make([]row, 0, len(stages))
+					for _, path := range slices.Sorted(maps.Keys(stages)) {
+						rows = append(rows, row{Config: path, Stage: stages[path]})
+					}
+					table := mintab.New(cmd.Writer, mintab.WithFormat(mintab.CompressedTextFormat))
+					if err := table.Load(rows); err != nil {
+						return err
+					}
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:          "rename-stage",
+				Usage:         "Rename the stage stored in the state file",
+				Description:   "RenameStage updates the stage stored in the state file from <old> to <new>,\nsuch as after renaming the stage in the configuration file. It does nothing if the stored stage is not <old>.",
+				ArgsUsage:     "<old> <new>",
+				Before:        before,
+				Flags:         []cli.Flag{config, allowExternal},
+				ShellComplete: complete(stageNames),
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					return cfg.RenameStageInState(cmd.Args().Get(0), cmd.Args().Get(1))
+				},
+			},
 			{
 				Name:        "list",
 				Usage:       "Show the env file entries in the current stage",
-				Description: "List resolves and displays a list of env file entries for the current stage based on the configuration.",
+				Description: "List resolves and displays a list of env file entries for the current stage based on the configuration.\nWith --group, only the entries of the specified groups are displayed.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					format,
+					envFile,
+					httpTimeout,
+					includes,
+					directives,
+					envOverrides,
+					stageFile,
+					group,
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "set the output format: text, json, jsonl, csv",
+						Value:   "text",
+					},
+				},
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
+					if cmd.String("output") == "csv" {
+						return cfg.ListCSV(cmd.Writer)
+					}
 					entries, err := cfg.List()
 					if err != nil {
 						return err
 					}
-					table := mintab.New(cmd.Writer,
-						mintab.WithFormat(mintab.CompressedTextFormat),
-						mintab.WithMergeFields([]int{0, 1}),
-					)
-					if err := table.Load(entries); err != nil {
+					switch output := cmd.String("output"); output {
+					case "text":
+						table := mintab.New(cmd.Writer,
+							mintab.WithFormat(mintab.CompressedTextFormat),
+							mintab.WithMergeFields([]int{0, 1}),
+						)
+						if err := table.Load(entries); err != nil {
+							return err
+						}
+						table.Render()
+					case "json":
+						enc := json.NewEncoder(cmd.Writer)
+						enc.SetIndent("", "  ")
+						return enc.Encode(entries)
+					case "jsonl":
+						enc := json.NewEncoder(cmd.Writer)
+						for _, entry := range entries {
+							if err := enc.Encode(entry); err != nil {
+								return err
+							}
+						}
+					default:
+						return fmt.Errorf("invalid output format: %s", output)
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "resolved",
+				Usage:       "Show the central env in the current stage before grouping",
+				Description: "Resolved displays the central env of the current stage as read by lem, sorted by key.",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal, format, envFile, httpTimeout, includes, directives, stageFile},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					env, err := cfg.Resolved()
+					if err != nil {
 						return err
 					}
-					table.Render()
+					for _, k := range slices.Sorted(maps.Keys(env)) {
+						_, _ = fmt.Fprintf(cmd.Writer, "%s=%s\n", k, env[k])
+					}
 					return nil
 				},
 			},
 			{
-				Name:        "run",
-				Usage:       "Switch env and deliver env files to the specified directory",
-				Description: "Run splits the central env based on configuration and distributes it to each directory.\nIf a stage is specified as an argument, it switches to that stage before delivery.\nIt also checks for empty values based on configuration.",
+				Name:        "orphans",
+				Usage:       "Show the central env keys not delivered to any group",
+				Description: "Orphans displays the keys of the central env in the current stage that are not claimed by\nthe prefix, replace or plain of any group, sorted by key. Use it to prune dead variables.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags:       []cli.Flag{config, allowExternal, format, envFile, httpTimeout, includes, directives, stageFile},
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
+					keys, err := cfg.Orphans()
+					if err != nil {
+						return err
+					}
+					for _, k := range keys {
+						_, _ = fmt.Fprintln(cmd.Writer, k)
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "graph",
+				Usage:       "Show the direnv references between groups",
+				Description: "Graph displays the groups whose env files the .envrc of each group loads, based on direnv of each group,\nfollowed by the cycles in those references, which may indicate a modeling mistake.\nWith --output dot, it prints the graph in the DOT language for Graphviz, such as lem graph -o dot | dot -Tsvg,\nwith the edges in cycles colored red.",
+				Before:      before,
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "set the output format: text, dot",
+						Value:   "text",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					graph, err := cfg.DirenvGraph()
+					if err != nil {
+						return err
+					}
+					cycles, err := cfg.DirenvCycles()
+					if err != nil {
+						return err
+					}
+					ids := slices.Sorted(maps.Keys(graph))
+					w := cmd.Root().Writer
+					switch output := cmd.String("output"); output {
+					case "text":
+						type row struct {
+							Group  string
+							Direnv string
+						}
+						rows := make([]row, 0, len(ids))
+						for _, id := range ids {
+							rows = append(rows, row{Group: id, Direnv: strings.Join(graph[id], ", ")})
+						}
+						table := mintab.New(w, mintab.WithFormat(mintab.CompressedTextFormat))
+						if err := table.Load(rows); err != nil {
+							return err
+						}
+						table.Render()
+						for _, cycle := range cycles {
+							_, _ = fmt.Fprintf(w, "cycle: %s\n", strings.Join(cycle, " -> "))
+						}
+					case "dot":
+						inCycle := map[[2]string]bool{}
+						for _, cycle := range cycles {
+							for k := range len(cycle) - 1 {
+								inCycle[[2]string{cycle[k], cycle[k+1]}] = true
+							}
+						}
+						_, _ = fmt.Fprintln(w, "digraph lem {")
+						for _, id := range ids {
+							_, _ = fmt.Fprintf(w, "  %q;\n", id)
+							for _, target := range graph[id] {
+								attr := ""
+								if inCycle[[2]string{id, target}] {
+									attr = " [color=red]"
+								}
+								_, _ = fmt.Fprintf(w, "  %q -> %q%s;\n", id, target, attr)
+							}
+						}
+						_, _ = fmt.Fprintln(w, "}")
+					default:
+						return fmt.Errorf("invalid output format: %s", output)
+					}
+					return nil
+				},
+			},
+			{
+				Name:          "run",
+				Usage:         "Switch env and deliver env files to the specified directory",
+				Description:   "Run splits the central env based on configuration and distributes it to each directory.\nIf a stage is specified as an argument, it switches to that stage before delivery.\nIt also checks for empty values based on configuration.\nWith --output json, it prints the stage, the central env and the delivered groups as a single JSON object,\nand the events and warnings as JSON lines to the standard error.",
+				Before:        before,
+				ShellComplete: complete(stageNames),
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					timeout,
+					duplicateKeyPolicy,
+					format,
+					envFile,
+					httpTimeout,
+					includes,
+					directives,
+					envOverrides,
+					stageFile,
+					sourceOrder,
+					lineEnding,
+					outputSeparator,
+					outputRoot,
+					continueOnError,
+					runOutput,
+					group,
+					storeHash,
+					checksums,
+					backup,
+					onlyChanged,
+					timing,
+					&cli.BoolFlag{
+						Name:    "print",
+						Aliases: []string{"p"},
+						Usage:   "print the env file content of the group instead of writing it",
+					},
+					&cli.BoolFlag{
+						Name:  "combined",
+						Usage: "print the env file content of all groups with a # group.<id> header each instead of writing them",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					// The messages, such as the JSON events and warnings, go to the error writer,
+					// so that the standard output is a single JSON object
+					report := cmd.String(runOutput.Name) == lem.OutputJSON && !cmd.Bool("print") && !cmd.Bool("combined")
+					if report {
+						lem.WithWriter(cmd.Root().ErrWriter)(cfg)
+					}
 					stage := cmd.Args().Get(0)
 					if stage != "" {
 						if err := cfg.Switch(stage); err != nil {
 							return err
 						}
+						// The stage given explicitly wins over the stage file for this invocation
+						lem.WithStageFile(false)(cfg)
+					}
+					if cmd.Bool("print") {
+						groups := cmd.StringSlice(group.Name)
+						if len(groups) != 1 {
+							return errors.New("failed to print: exactly one --group is required")
+						}
+						return cfg.Print(groups[0])
+					}
+					if cmd.Bool("combined") {
+						return cfg.RunCombined(cmd.Writer)
+					}
+					if report {
+						r, err := cfg.RunWithReport()
+						if err != nil {
+							return err
+						}
+						enc := json.NewEncoder(cmd.Root().Writer)
+						enc.SetIndent("", "  ")
+						return enc.Encode(r)
 					}
 					if _, err := cfg.Run(); err != nil {
 						return err
@@ -125,11 +676,241 @@ func newCmd(w, ew io.Writer) *cli.Command {
 				},
 			},
 			{
-				Name:        "watch",
-				Usage:       "Watch changes in the central env and run continuously",
-				Description: "Watch continuously monitors changes in the central env and synchronizes changes to each directory.",
+				Name:          "promote",
+				Usage:         "Deliver the central env of a stage with the group settings of another",
+				Description:   "Promote reads the central env of <from> and distributes it to each directory with the dirs and overrides of <to>,\nsuch as to stage the prod distribution from the dev values. The stored current stage is not changed,\nso the next run delivers the central env of the current stage again.",
+				ArgsUsage:     "<from> <to>",
+				Before:        before,
+				ShellComplete: complete(stageNames),
+				Flags:         []cli.Flag{config, allowExternal, duplicateKeyPolicy, format, httpTimeout, includes, directives, sourceOrder, lineEnding, outputSeparator, outputRoot, group},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					return cfg.Promote(cmd.Args().Get(0), cmd.Args().Get(1))
+				},
+			},
+			{
+				Name:        "check",
+				Usage:       "Check that the delivered env files are up to date",
+				Description: "Check compares the env file of each group with the content expected from the central env,\nand the .envrc file of each group with direnv support with the content run would generate,\nand exits with an error listing the drifted groups. It does not modify any files.",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal, format, envFile, httpTimeout, includes, directives, sourceOrder, lineEnding, outputSeparator, outputRoot, stageFile},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					return cfg.Check()
+				},
+			},
+			{
+				Name:        "freshness",
+				Usage:       "Show whether the delivered env files are older than the central env",
+				Description: "Freshness compares the modification time of each group's env file with the central env\nand displays the groups whose env file is stale.\nIf the hashes were stored by run with --store-hash, they are compared instead.",
 				Before:      before,
-				Flags:       []cli.Flag{config},
+				Flags:       []cli.Flag{config, allowExternal, envFile, httpTimeout, outputRoot, stageFile},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					stale, err := cfg.Freshness()
+					if err != nil {
+						return err
+					}
+					type row struct {
+						Group string
+						Stale bool
+					}
+					rows := make([]row, 0, len(stale))
+					for _, id := range slices.Sorted(maps.Keys(stale)) {
+						rows = append(rows, row{Group: id, Stale: stale[id]})
+					}
+					table := mintab.New(cmd.Writer, mintab.WithFormat(mintab.CompressedTextFormat))
+					if err := table.Load(rows); err != nil {
+						return err
+					}
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:        "reconcile",
+				Usage:       "Show the keys missing or differing in the delivered env files",
+				Description: "Reconcile compares the env files on disk in each group directory with the central env of the current stage\nand displays the keys to be delivered that are missing from them or have a different value.",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal, format, envFile, httpTimeout, includes, directives, outputRoot, stageFile},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					recs, err := cfg.Reconcile()
+					if err != nil {
+						return err
+					}
+					type row struct {
+						Group  string
+						Key    string
+						Status string
+					}
+					var rows []row
+					for _, id := range slices.Sorted(maps.Keys(recs)) {
+						for _, k := range recs[id].Missing {
+							rows = append(rows, row{Group: id, Key: k, Status: "missing"})
+						}
+						for _, k := range recs[id].Stale {
+							rows = append(rows, row{Group: id, Key: k, Status: "stale"})
+						}
+					}
+					if len(rows) == 0 {
+						_, _ = fmt.Fprintln(cmd.Writer, "no discrepancy")
+						return nil
+					}
+					table := mintab.New(cmd.Writer, mintab.WithFormat(mintab.CompressedTextFormat), mintab.WithMergeFields([]int{0}))
+					if err := table.Load(rows); err != nil {
+						return err
+					}
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:        "audit",
+				Usage:       "Show the permissions of the delivered env files",
+				Description: "Audit displays the mode of the env file of each group for the current stage,\nsuch as to verify the permissions of the delivered secrets. Env files that do not exist are not shown.",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal, outputRoot, stageFile},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					audits, err := cfg.Audit()
+					if err != nil {
+						return err
+					}
+					type row struct {
+						Group string
+						Path  string
+						Mode  string
+					}
+					rows := make([]row, 0, len(audits))
+					for _, a := range audits {
+						rows = append(rows, row{Group: a.Group, Path: a.Path, Mode: a.Mode.String()})
+					}
+					table := mintab.New(cmd.Writer, mintab.WithFormat(mintab.CompressedTextFormat), mintab.WithMergeFields([]int{0}))
+					if err := table.Load(rows); err != nil {
+						return err
+					}
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:        "prune",
+				Usage:       "Remove the old backups of the env files",
+				Description: "Prune removes the backups of the env file of each group for the current stage written by run --backup,\nsuch as .env.20240101T000000.000000000Z.bak, keeping the newest of them for each env file.\nOther files, such as .env.bak, are never removed. With --dry-run, it lists the backups to remove without removing them.",
+				Before:      before,
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					outputRoot,
+					stageFile,
+					&cli.IntFlag{
+						Name:  "keep",
+						Usage: "number of the newest backups to keep for each env file",
+						Value: 1,
+					},
+					&cli.BoolFlag{
+						Name:  dryRun.Name,
+						Usage: "list the backups to remove without removing them",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					removed, err := cfg.PruneBackups(cmd.Int("keep"))
+					if err != nil {
+						return err
+					}
+					if len(removed) == 0 {
+						_, _ = fmt.Fprintln(cmd.Writer, "no backup to prune")
+						return nil
+					}
+					label := "removed:"
+					if cmd.Bool(dryRun.Name) {
+						label = "would remove:"
+					}
+					for _, path := range removed {
+						_, _ = fmt.Fprintf(cmd.Writer, "%s %s\n", label, path)
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "import",
+				Usage:       "Propose a central env merged from the existing env files of the groups",
+				Description: "Import reads the existing env file of each group and prints a central env merged from them,\nsuch as to adopt lem in a repository that already has group env files.\nKeys with different values in more than one group are reported as warnings, keeping the value of the first group,\nand so are the keys of a group mapped to the same key by --prefix-from-group, keeping the first in key order.",
+				Before:      before,
+				Flags: []cli.Flag{
+					config,
+					allowExternal,
+					format,
+					&cli.BoolFlag{
+						Name:  "prefix-from-group",
+						Usage: "prefix the keys with the prefix of their group unless they have it or are plain",
+					},
+				},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					conflicts, err := cfg.Import(cmd.Writer, cmd.Bool("prefix-from-group"))
+					if err != nil {
+						return err
+					}
+					for _, c := range conflicts {
+						if len(c.Keys) != 0 {
+							_, _ = fmt.Fprintf(cmd.ErrWriter, "warning: %s: different values of %s in group.%s\n", c.Key, strings.Join(c.Keys, ", "), c.Groups[0])
+							continue
+						}
+						_, _ = fmt.Fprintf(cmd.ErrWriter, "warning: %s: different values in group.%s\n", c.Key, strings.Join(c.Groups, ", group."))
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "diff-config",
+				Usage:       "Show the differences in the stage and group tables from another configuration file",
+				Description: "DiffConfig compares the stage and group tables of the configuration file with the specified one,\nsuch as a canonical configuration in a shared repository, and exits with an error if they differ.",
+				ArgsUsage:   "<other.toml>",
+				Before:      before,
+				Flags:       []cli.Flag{config, allowExternal},
+				Action: func(_ context.Context, cmd *cli.Command) error {
+					cfg := cmd.Metadata["config"].(*lem.Config)
+					path := cmd.Args().Get(0)
+					if path == "" {
+						return errors.New("failed to diff config: other configuration file path is required")
+					}
+					other, err := lem.Load(path)
+					if err != nil {
+						return err
+					}
+					diffs := cfg.Diff(other)
+					if len(diffs) == 0 {
+						_, _ = fmt.Fprintln(cmd.Writer, "no difference")
+						return nil
+					}
+					type row struct {
+						Table  string
+						ID     string
+						Change string
+						Fields string
+					}
+					rows := make([]row, 0, len(diffs))
+					for _, d := range diffs {
+						rows = append(rows, row{Table: d.Table, ID: d.ID, Change: d.Change, Fields: strings.Join(d.Fields, ", ")})
+					}
+					table := mintab.New(cmd.Writer, mintab.WithFormat(mintab.CompressedTextFormat))
+					if err := table.Load(rows); err != nil {
+						return err
+					}
+					table.Render()
+					return fmt.Errorf("failed to diff config: %d differences found", len(diffs))
+				},
+			},
+			{
+				Name:          "watch",
+				Usage:         "Watch changes in the central env and run continuously",
+				Description:   "Watch continuously monitors changes in the central env and synchronizes changes to each directory.",
+				Before:        before,
+				ShellComplete: complete(stageNames),
+				Flags:         []cli.Flag{config, allowExternal, timeout, duplicateKeyPolicy, format, envFile, includes, directives, envOverrides, sourceOrder, lineEnding, outputSeparator, outputRoot, continueOnError, runOutput, group, storeHash, checksums, backup, timing, incremental, stageFile},
 				Action: func(_ context.Context, cmd *cli.Command) error {
 					cfg := cmd.Metadata["config"].(*lem.Config)
 					stage := cmd.Args().Get(0)
@@ -137,6 +918,8 @@ func newCmd(w, ew io.Writer) *cli.Command {
 						if err := cfg.Switch(stage); err != nil {
 							return err
 						}
+						// The stage given explicitly wins over the stage file for this invocation
+						lem.WithStageFile(false)(cfg)
 					}
 					if _, err := cfg.Watch(); err != nil {
 						return err
@@ -144,6 +927,39 @@ func newCmd(w, ew io.Writer) *cli.Command {
 					return nil
 				},
 			},
+			{
+				Name:   "__complete",
+				Usage:  "Print the names for shell completion one per line",
+				Hidden: true,
+				Commands: []*cli.Command{
+					{
+						Name:   "stages",
+						Usage:  "Print the stage names",
+						Before: before,
+						Flags:  []cli.Flag{config, allowExternal},
+						Action: func(_ context.Context, cmd *cli.Command) error {
+							cfg := cmd.Metadata["config"].(*lem.Config)
+							for _, name := range stageNames(cfg) {
+								_, _ = fmt.Fprintln(cmd.Root().Writer, name)
+							}
+							return nil
+						},
+					},
+					{
+						Name:   "groups",
+						Usage:  "Print the group ids",
+						Before: before,
+						Flags:  []cli.Flag{config, allowExternal},
+						Action: func(_ context.Context, cmd *cli.Command) error {
+							cfg := cmd.Metadata["config"].(*lem.Config)
+							for _, id := range groupIDs(cfg) {
+								_, _ = fmt.Fprintln(cmd.Root().Writer, id)
+							}
+							return nil
+						},
+					},
+				},
+			},
 		},
 	}
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/nekrassov01/lem"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,11 +20,41 @@ func Test_cli(t *testing.T) {
 		args    []string
 		isError bool
 	}{
+		{
+			name:    "scaffold",
+			args:    []string{"lem", "scaffold", "testdata/dummy"},
+			isError: true,
+		},
+		{
+			name:    "completion",
+			args:    []string{"lem", "completion", "zsh"},
+			isError: false,
+		},
+		{
+			name:    "completion unknown shell",
+			args:    []string{"lem", "completion", "tcsh"},
+			isError: true,
+		},
 		{
 			name:    "validate",
 			args:    []string{"lem", "validate", "--config", "testdata/1/lem.toml"},
 			isError: false,
 		},
+		{
+			name:    "validate all stages",
+			args:    []string{"lem", "validate", "--all-stages", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "validate strict",
+			args:    []string{"lem", "validate", "--strict", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "validate naming pattern is invalid",
+			args:    []string{"lem", "validate", "--naming-pattern", "[A-Z", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
 		{
 			name:    "validate config is empty",
 			args:    []string{"lem", "validate", "--config", "testdata/1/lem.empty.toml"},
@@ -34,6 +70,11 @@ func Test_cli(t *testing.T) {
 			args:    []string{"lem", "stage", "--config", "testdata/1/lem.toml"},
 			isError: false,
 		},
+		{
+			name:    "stages",
+			args:    []string{"lem", "stages", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
 		{
 			name:    "switch",
 			args:    []string{"lem", "switch", "default", "--config", "testdata/1/lem.toml"},
@@ -44,11 +85,181 @@ func Test_cli(t *testing.T) {
 			args:    []string{"lem", "list", "--config", "testdata/1/lem.toml"},
 			isError: false,
 		},
+		{
+			name:    "orphans",
+			args:    []string{"lem", "orphans", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "root config is empty",
+			args:    []string{"lem", "root", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "resolved",
+			args:    []string{"lem", "resolved", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "resolved with env not found",
+			args:    []string{"lem", "resolved", "--env", "candidate.env", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "resolved with include",
+			args:    []string{"lem", "resolved", "--include", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "states",
+			args:    []string{"lem", "states"},
+			isError: false,
+		},
+		{
+			name:    "switch dry run config is empty",
+			args:    []string{"lem", "switch", "default", "--dry-run", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "state config is empty",
+			args:    []string{"lem", "state", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "state reset config is empty",
+			args:    []string{"lem", "state", "--reset", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "rename-stage",
+			args:    []string{"lem", "rename-stage", "staging", "default", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "rename-stage without args",
+			args:    []string{"lem", "rename-stage", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "list jsonl",
+			args:    []string{"lem", "list", "--output", "jsonl", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "graph",
+			args:    []string{"lem", "graph", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "list with group",
+			args:    []string{"lem", "list", "--group", "api", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "run with checksums",
+			args:    []string{"lem", "run", "--checksums", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with store hash",
+			args:    []string{"lem", "run", "--store-hash", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "promote",
+			args:    []string{"lem", "promote", "development", "production", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "run with timing",
+			args:    []string{"lem", "run", "--timing", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with env overrides",
+			args:    []string{"lem", "run", "--env-overrides", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with output separator",
+			args:    []string{"lem", "run", "--output-separator", ": ", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with combined",
+			args:    []string{"lem", "run", "--combined", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with only changed",
+			args:    []string{"lem", "run", "--only-changed", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "list csv",
+			args:    []string{"lem", "list", "--output", "csv", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
 		{
 			name:    "run",
 			args:    []string{"lem", "run", "--config", "testdata/1/lem.toml"},
 			isError: false,
 		},
+		{
+			name:    "run print",
+			args:    []string{"lem", "run", "--print", "--group", "api", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run print without group",
+			args:    []string{"lem", "run", "--print", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "run print with multiple groups",
+			args:    []string{"lem", "run", "--print", "--group", "api", "--group", "ui", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "run with groups",
+			args:    []string{"lem", "run", "--group", "api", "--group", "ui", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with strict format",
+			args:    []string{"lem", "run", "--format", "strict", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with output root",
+			args:    []string{"lem", "run", "--output-root", "testdata/1/out", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with continue on error",
+			args:    []string{"lem", "run", "--continue-on-error", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with invalid line ending",
+			args:    []string{"lem", "run", "--line-ending", "cr", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "run with source order",
+			args:    []string{"lem", "run", "--source-order", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with json output",
+			args:    []string{"lem", "run", "--output", "json", "--config", "testdata/1/lem.toml"},
+			isError: false,
+		},
+		{
+			name:    "run with timeout",
+			args:    []string{"lem", "run", "--timeout", "1ns", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
 		{
 			name:    "run config is empty",
 			args:    []string{"lem", "run", "--config", "testdata/1/lem.empty.toml"},
@@ -64,6 +275,46 @@ func Test_cli(t *testing.T) {
 			args:    []string{"lem", "run", "--config", "testdata/1/lem.toml"},
 			isError: true,
 		},
+		{
+			name:    "check config is empty",
+			args:    []string{"lem", "check", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "freshness config is empty",
+			args:    []string{"lem", "freshness", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "reconcile config is empty",
+			args:    []string{"lem", "reconcile", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "audit config is empty",
+			args:    []string{"lem", "audit", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "prune config is empty",
+			args:    []string{"lem", "prune", "--keep", "2", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
+		{
+			name:    "import",
+			args:    []string{"lem", "import", "--prefix-from-group", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "diff-config without args",
+			args:    []string{"lem", "diff-config", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
+		{
+			name:    "diff-config other not found",
+			args:    []string{"lem", "diff-config", "testdata/1/lem.dummy.toml", "--config", "testdata/1/lem.toml"},
+			isError: true,
+		},
 		{
 			name:    "watch config is empty",
 			args:    []string{"lem", "watch", "--config", "testdata/1/lem.empty.toml"},
@@ -74,6 +325,11 @@ func Test_cli(t *testing.T) {
 			args:    []string{"lem", "watch", "--config", "testdata/1/lem.invalid.toml"},
 			isError: true,
 		},
+		{
+			name:    "watch with groups",
+			args:    []string{"lem", "watch", "--group", "api", "--config", "testdata/1/lem.empty.toml"},
+			isError: true,
+		},
 		{
 			name:    "watch stage not found",
 			args:    []string{"lem", "watch", "--config", "testdata/1/lem.toml"},
@@ -89,3 +345,247 @@ func Test_cli(t *testing.T) {
 		})
 	}
 }
+
+func Test_cli_stdin(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		stdin   string
+		isError bool
+	}{
+		{
+			name:    "validate config from stdin",
+			args:    []string{"lem", "validate", "--config", "-"},
+			stdin:   "[stage]\ndefault = \"testdata/1/.env\"\n[group.api]\nprefix = \"API\"\ndir = \"testdata/1/api\"\n",
+			isError: true,
+		},
+		{
+			name:    "validate config from stdin is empty",
+			args:    []string{"lem", "validate", "--config", "-"},
+			stdin:   "",
+			isError: true,
+		},
+		{
+			name:    "validate config from stdin is invalid",
+			args:    []string{"lem", "validate", "--config", "-"},
+			stdin:   "[stage\n",
+			isError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newCmd(io.Discard, io.Discard)
+			cmd.Reader = strings.NewReader(tt.stdin)
+			err := cmd.Run(context.Background(), tt.args)
+			if tt.isError {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func Test_cli_env(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      string
+		contains string
+	}{
+		{
+			name:     "config from env",
+			args:     []string{"lem", "resolved"},
+			env:      "testdata/env/lem.toml",
+			contains: "testdata/env/lem.toml",
+		},
+		{
+			name:     "config flag wins over env",
+			args:     []string{"lem", "resolved", "--config", "testdata/flag/lem.toml"},
+			env:      "testdata/env/lem.toml",
+			contains: "testdata/flag/lem.toml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LEM_CONFIG", tt.env)
+			err := newCmd(io.Discard, io.Discard).Run(context.Background(), tt.args)
+			assert.ErrorContains(t, err, tt.contains)
+		})
+	}
+}
+
+func Test_cli_complete(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name:     "stages",
+			args:     []string{"lem", "__complete", "stages", "--config", "../../testdata/sandbox/lem.toml"},
+			expected: "default\ndev\nnoexists\n",
+		},
+		{
+			name:     "groups",
+			args:     []string{"lem", "__complete", "groups", "--config", "../../testdata/sandbox/lem.toml"},
+			expected: "api\nui\n",
+		},
+		{
+			name:     "switch",
+			args:     []string{"lem", "switch", "--config", "../../testdata/sandbox/lem.toml", "--generate-shell-completion"},
+			expected: "default\ndev\nnoexists\n",
+		},
+		{
+			name:     "switch config not found",
+			args:     []string{"lem", "switch", "--config", "testdata/1/lem.toml", "--generate-shell-completion"},
+			expected: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &strings.Builder{}
+			err := newCmd(w, io.Discard).Run(context.Background(), tt.args)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, w.String())
+		})
+	}
+}
+
+func Test_cli_runReport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lem.toml": "[stage]\ndefault = \"./.env\"\n\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\n",
+		".env":     "API_KEY=key\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "api"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	w := &bytes.Buffer{}
+	err := newCmd(w, io.Discard).Run(context.Background(), []string{"lem", "run", "default", "--output", "json", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	var report lem.RunReport
+	assert.NoError(t, json.Unmarshal(w.Bytes(), &report))
+	assert.Equal(t, "default", report.Stage)
+	assert.Equal(t, []lem.GroupReport{
+		{Group: "api", Target: filepath.Join(dir, "api", ".env"), KeyCount: 1, Created: true},
+	}, report.Groups)
+}
+
+func Test_cli_graph(t *testing.T) {
+	dir := t.TempDir()
+	content := "[stage]\ndefault = \"./.env\"\n\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\ndirenv = [\"ui\", \"api\"]\n\n[group.ui]\nprefix = \"UI\"\ndir = \"./ui\"\ndirenv = [\"api\"]\n"
+	if err := os.WriteFile(filepath.Join(dir, "lem.toml"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w := &bytes.Buffer{}
+	err := newCmd(w, io.Discard).Run(context.Background(), []string{"lem", "graph", "--output", "dot", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	assert.Equal(t, "digraph lem {\n  \"api\";\n  \"api\" -> \"api\";\n  \"api\" -> \"ui\" [color=red];\n  \"ui\";\n  \"ui\" -> \"api\" [color=red];\n}\n", w.String())
+
+	w.Reset()
+	err = newCmd(w, io.Discard).Run(context.Background(), []string{"lem", "graph", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	assert.Contains(t, w.String(), "cycle: api -> ui -> api\n")
+
+	err = newCmd(io.Discard, io.Discard).Run(context.Background(), []string{"lem", "graph", "--output", "svg", "--config", filepath.Join(dir, "lem.toml")})
+	assert.ErrorContains(t, err, "invalid output format: svg")
+}
+
+func Test_cli_runReportWarnings(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lem.toml": "[stage]\ndefault = \"./.env\"\n\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\nplain = [\"SHARED\"]\n\n[group.ui]\nprefix = \"UI\"\ndir = \"./ui\"\nplain = [\"SHARED\"]\n",
+		".env":     "API_KEY=key\nSHARED=x\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, ew := &bytes.Buffer{}, &bytes.Buffer{}
+	err := newCmd(w, ew).Run(context.Background(), []string{"lem", "run", "default", "--output", "json", "--duplicate-key-policy", "warn", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	var report lem.RunReport
+	assert.NoError(t, json.Unmarshal(w.Bytes(), &report))
+	assert.Len(t, report.Groups, 2)
+	assert.Contains(t, ew.String(), `"event":"duplicate"`)
+	assert.Contains(t, ew.String(), `"key":"SHARED"`)
+}
+
+func Test_cli_runStageOverStageFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{".git", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"lem.toml":   "[stage]\ndev = \"./.env.dev\"\nprod = \"./.env.prod\"\n\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\n",
+		".env.dev":   "API_STAGE=dev\n",
+		".env.prod":  "API_STAGE=prod\n",
+		".lem-stage": "dev\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := newCmd(io.Discard, io.Discard).Run(context.Background(), []string{"lem", "run", "prod", "--stage-file", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_STAGE=prod\n", string(b))
+
+	err = newCmd(io.Discard, io.Discard).Run(context.Background(), []string{"lem", "run", "--stage-file", "--config", filepath.Join(dir, "lem.toml")})
+	assert.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_STAGE=dev\n", string(b))
+}
+
+func Test_cli_explain(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lem.toml": "[stage]\ndefault = \"./.env\"\n\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\n",
+		".env":     "API_KEY=key\n",
+		"api":      "",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name:     "explain",
+			args:     []string{"lem", "validate", "--explain", "--config", filepath.Join(dir, "lem.toml")},
+			expected: "hint: group.api.dir points to a file; set it to the containing directory and the file name to group.api.filename\n",
+		},
+		{
+			name:     "no explain",
+			args:     []string{"lem", "validate", "--config", filepath.Join(dir, "lem.toml")},
+			expected: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ew := &bytes.Buffer{}
+			err := newCmd(io.Discard, ew).Run(context.Background(), tt.args)
+			assert.ErrorContains(t, err, "is not a directory")
+			assert.Equal(t, tt.expected, ew.String())
+		})
+	}
+}
@@ -2,34 +2,199 @@ package lem
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
 	"github.com/fatih/color"
 	"github.com/fsnotify/fsnotify"
 )
 
-// initConfigPath is the default path to the configuration file.
-const initConfigPath = "lem.toml"
+const (
+	// centralHashKey is the key of the hash of the central env in the state file.
+	centralHashKey = "hash.central"
+
+	// initConfigPath is the default path to the configuration file.
+	initConfigPath = "lem.toml"
+
+	// defaultInitPrefix is the prefix of the first group generated by Init.
+	defaultInitPrefix = "API"
+
+	// defaultInitDir is the directory of the first group generated by Init.
+	defaultInitDir = "./backend"
+
+	// defaultFilename is the default name of the env file delivered to each group.
+	defaultFilename = ".env"
+
+	// defaultMaxFileSize is the default maximum size in bytes of an env file to be read.
+	defaultMaxFileSize = 64 << 20
+
+	// stageFilename is the name of the file in the project root that pins the stage.
+	stageFilename = ".lem-stage"
+
+	// localFilename is the name of the unmanaged env file in a group directory
+	// that overlays the delivered one through the generated .envrc.
+	localFilename = ".env.local"
+
+	// defaultSeparator is the default separator between the prefix and the rest of the key.
+	defaultSeparator = "_"
+
+	// separatorChars is the set of characters allowed in the separator.
+	separatorChars = "_.-:"
+
+	// checksumExt is the extension added to the path of an env file for its checksum sidecar.
+	checksumExt = ".sha256"
+
+	// backupExt is the extension of the backups of the env files written by Run with WithBackup.
+	backupExt = ".bak"
+
+	// backupLayout is the layout of the timestamp in the name of a backup between the name of
+	// the env file and the extension, such as .env.20240101T000000.000000000Z.bak.
+	// It has a fixed width, so that the names sort in time order.
+	backupLayout = "20060102T150405.000000000Z"
+
+	// defaultKVSeparator is the default separator between the key and the value in env files.
+	defaultKVSeparator = "="
+
+	// defaultNamingPattern is the default pattern that the group prefixes and the plain
+	// and replace entries are expected to match in full.
+	defaultNamingPattern = "[A-Z][A-Z0-9_]*"
+
+	// DuplicateKeyAllow silently allows keys delivered to more than one group.
+	DuplicateKeyAllow = "allow"
+
+	// DuplicateKeyWarn prints a warning for keys delivered to more than one group.
+	DuplicateKeyWarn = "warn"
+
+	// DuplicateKeyError fails for keys delivered to more than one group.
+	DuplicateKeyError = "error"
+
+	// FormatRaw reads and writes values as is. A value containing a newline
+	// is written across multiple lines and cannot be read back.
+	FormatRaw = "raw"
+
+	// FormatStrict quotes and escapes values containing newlines, quotes or
+	// surrounding whitespace when writing, and unquotes them when reading,
+	// so that the written env files round-trip.
+	FormatStrict = "strict"
+
+	// LineEndingLF ends each line of the env files with LF.
+	LineEndingLF = "lf"
+
+	// LineEndingCRLF ends each line of the env files with CRLF.
+	LineEndingCRLF = "crlf"
+
+	// OutputText prints the messages of Run as colored lines for humans.
+	OutputText = "text"
+
+	// OutputJSON prints the messages of Run as one JSON object per event for automation.
+	OutputJSON = "json"
+
+	// KindString is the kind of a value that is not classified as any other kind.
+	KindString = "string"
+
+	// KindInt is the kind of a value that is a decimal integer.
+	KindInt = "int"
+
+	// KindBool is the kind of a value that is true or false.
+	KindBool = "bool"
+
+	// KindJSON is the kind of a value that is a JSON object or array.
+	KindJSON = "json"
+
+	// jsonCompact removes the insignificant whitespace from JSON values when delivering.
+	jsonCompact = "compact"
+
+	// jsonPretty indents JSON values when delivering.
+	jsonPretty = "pretty"
+
+	// envOverridePrefix is the prefix of the process environment variables overriding the central env.
+	envOverridePrefix = "LEM_OVERRIDE_"
+
+	// includeDirective is the directive that reads another env file from the central env.
+	includeDirective = "#include "
+
+	// metaDirective is the directive in a comment that declares the metadata of the following key.
+	metaDirective = "lem:"
+
+	// maskedValue is the value shown in place of the value of a secret key.
+	maskedValue = "********"
+
+	// stageVariable is the reserved variable that is replaced with the name of the active
+	// stage when referenced as ${LEM_STAGE} in the values of the central env.
+	stageVariable = "LEM_STAGE"
+
+	// httpAuthVariable is the environment variable whose value, if set, is sent as the
+	// Authorization header when fetching the central env of a URL stage.
+	httpAuthVariable = "LEM_HTTP_AUTHORIZATION"
+
+	// defaultHTTPTimeout is the default timeout for fetching the central env of a URL stage.
+	defaultHTTPTimeout = 30 * time.Second
+
+	// maxRedirects is the number of redirects followed when fetching a URL stage, as in net/http.
+	maxRedirects = 10
+
+	// stagePlaceholder is the placeholder in group dirs and the output root
+	// that is replaced with the name of the active stage.
+	stagePlaceholder = "{{stage}}"
+
+	// multilineQuote is the quote that encloses a value spanning multiple lines.
+	multilineQuote = `"""`
+
+	// readerConfigName is the file name standing in for the configuration
+	// loaded from a reader, which identifies it in messages and the state file.
+	readerConfigName = "<stdin>"
+
+	// scaffoldMarker is the marker file name that indicates a group directory for scaffolding.
+	scaffoldMarker = ".lemgroup"
+)
 
 var (
-	//go:embed lem.toml
-	initConfig []byte
+	//go:embed lem.toml.tmpl
+	initConfig string
+
+	// errNoStage is returned when no stage is stored for the configuration in the state file.
+	errNoStage = errors.New("no stage stored")
+
+	// errSkipped is returned by validateGroupPair for an optional group whose dir does not exist,
+	// so that the callers skip the group instead of failing.
+	errSkipped = errors.New("optional group skipped: dir does not exist")
 
-	// gitDir is the directory name for the git repository.
+	// gitDir is the name of the default root marker, which is a directory for
+	// the git repository or a file for a worktree.
 	gitDir = ".git"
 
 	// statePathFunc returns the path to the state file.
 	statePathFunc = defaultStatePath
 
+	// retryInterval is the initial interval between attempts of transient file operations.
+	retryInterval = 100 * time.Millisecond
+
 	// gray is a function that returns a gray color for printing messages.
 	gray = color.New(color.FgHiBlack).SprintFunc()
 
@@ -38,6 +203,15 @@ var (
 
 	// green is a function that returns a green color for printing messages.
 	green = color.New(color.FgHiGreen).SprintFunc()
+
+	// yellow is a function that returns a yellow color for printing messages.
+	yellow = color.New(color.FgHiYellow).SprintFunc()
+
+	// ansiPattern matches the escape sequences for colors written by the color functions.
+	ansiPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+	// bareKeyPattern matches a bare key of TOML, which a group id derived by InitWith must be.
+	bareKeyPattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
 )
 
 // defaultStatePath returns the default path to the state file.
@@ -53,33 +227,387 @@ func defaultStatePath() (string, error) {
 // how it is divided, and to which groups it is delivered.
 // It is read from a configuration file in TOML format.
 type Config struct {
-	Stage map[string]string `toml:"stage"` // Stage holds the path to the central environment file.
-	Group map[string]Group  `toml:"group"` // Group holds the configuration for each group of environment variables.
+	Stage         map[string]Stage  `toml:"stage"`         // Stage holds the path to the central environment file.
+	Group         map[string]Group  `toml:"group"`         // Group holds the configuration for each group of environment variables.
+	Separator     string            `toml:"separator"`     // Separator between the prefix and the rest of the key, defaults to "_".
+	Kind          map[string]string `toml:"kind"`          // Kind declares the kind of the value for each key in the central env.
+	FromEnv       []string          `toml:"fromEnv"`       // FromEnv lists the keys taken from the environment and overlaid onto the central env.
+	GroupDefaults Group             `toml:"groupDefaults"` // GroupDefaults holds the group fields applied to all groups, which each group can override.
+
+	path            string                       // path is the absolute path to the configuration file
+	dir             string                       // dir is the configuration file directory
+	root            string                       // root is the project root directory with .git
+	size            int                          // size is the size of the map to be allocated when reading the central env
+	maxFileSize     int64                        // maxFileSize is the maximum size in bytes of an env file to be read
+	w               io.Writer                    // w is the writer to which the output is written
+	allowExternal   bool                         // allowExternal allows stage paths outside of the project root
+	followSymlinks  bool                         // followSymlinks checks the containment in the project root with the symlinks resolved
+	attempts        int                          // attempts is the number of attempts for writing env files
+	rawValues       bool                         // rawValues disables trimming of the values when reading the central env
+	normalize       bool                         // normalize trims the values and strips a surrounding quote pair when reading the central env
+	timeout         time.Duration                // timeout is the duration bounding the entire Run
+	httpTimeout     time.Duration                // httpTimeout is the timeout for fetching the central env of a URL stage
+	outSep          string                       // outSep is the separator between the key and the value when writing env files
+	kvSep           string                       // kvSep is the separator between the key and the value when reading env
+	dupPolicy       string                       // dupPolicy is the policy for keys delivered to more than one group
+	only            []string                     // only is the list of group ids to which Run distributes
+	format          string                       // format is the dotenv format for reading and writing env files
+	outputRoot      string                       // outputRoot is the directory under which the group dirs are mirrored when writing
+	continueOnError bool                         // continueOnError makes Run attempt every group and report all failures
+	outputFormat    string                       // outputFormat is the format of the messages printed by Run
+	lineEnding      string                       // lineEnding is the line ending of the env files
+	allStages       bool                         // allStages makes Validate check the empty values of the groups for every stage
+	namingPattern   string                       // namingPattern is the pattern that Validate expects the prefixes and keys of the groups to match
+	direnvCycles    bool                         // direnvCycles makes Validate warn about the cycles in the direnv references between groups
+	strict          bool                         // strict makes Validate fail on the risky configurations it otherwise warns about
+	rootMarkers     []string                     // rootMarkers are the names of the files or directories marking the project root
+	envPath         string                       // envPath overrides the path to the central env of the current stage
+	includes        bool                         // includes enables the #include directive when reading env files
+	sourceOrder     bool                         // sourceOrder orders the keys of the env files by their position in the central env
+	storeHash       bool                         // storeHash makes Run store the hashes of the central env and the env files in the state file
+	checksums       bool                         // checksums makes Run write a <file>.sha256 sidecar next to each env file
+	backup          bool                         // backup makes Run keep the previous content of each env file as a timestamped backup
+	dryRun          bool                         // dryRun makes Switch print the stage it would switch to without storing it
+	envOverrides    bool                         // envOverrides makes the LEM_OVERRIDE_<KEY> environment variables override the central env
+	timing          bool                         // timing makes Run print the duration of each phase
+	stageFile       bool                         // stageFile makes the .lem-stage file in the project root take precedence over the state file
+	directives      bool                         // directives enables the # lem: comments declaring the metadata of the following key
+	onlyChanged     bool                         // onlyChanged makes Run write only the groups whose env differs from the stored hashes
+	incremental     bool                         // incremental makes Run rewrite only the groups whose env changed since the previous Run
+	deliveredStage  string                       // deliveredStage is the stage of the previous Run if incremental
+	delivered       map[string]map[string]string // delivered is the env of each group written by the previous Run if incremental
+	order           map[string]int               // order is the position of each key in the last env read
+	meta            map[string]keyMeta           // meta is the metadata of each key declared by directives in the last env read
+	warnings        int                          // warnings is the number of warnings reported since Validate started
+}
+
+// Stage represents the central environment file for a stage.
+// It can be written either as a plain path string or as a table
+// with path, description and group overrides.
+type Stage struct {
+	Path        string              `toml:"path"`        // Path to the central environment file
+	Dir         bool                `toml:"dir"`         // Dir marks the path as a directory whose *.env files are merged
+	Description string              `toml:"description"` // Description of the purpose of the stage
+	Override    map[string]Override `toml:"override"`    // Group fields overridden only for the stage
+}
+
+// UnmarshalTOML decodes a stage from either a plain path string or a table.
+func (s *Stage) UnmarshalTOML(v any) error {
+	switch t := v.(type) {
+	case string:
+		s.Path = t
+	case map[string]any:
+		for k, val := range t {
+			switch k {
+			case "path", "description":
+				str, ok := val.(string)
+				if !ok {
+					return fmt.Errorf("invalid stage: %s: must be a string", k)
+				}
+				if k == "path" {
+					s.Path = str
+				} else {
+					s.Description = str
+				}
+			case "dir":
+				b, ok := val.(bool)
+				if !ok {
+					return fmt.Errorf("invalid stage: %s: must be a boolean", k)
+				}
+				s.Dir = b
+			case "override":
+				m, ok := val.(map[string]any)
+				if !ok {
+					return fmt.Errorf("invalid stage: %s: must be a table", k)
+				}
+				s.Override = make(map[string]Override, len(m))
+				for id, ov := range m {
+					var o Override
+					if err := o.UnmarshalTOML(ov); err != nil {
+						return fmt.Errorf("invalid stage: override.%s: %w", id, err)
+					}
+					s.Override[id] = o
+				}
+			default:
+				return fmt.Errorf("invalid stage: unknown key: %s", k)
+			}
+		}
+	default:
+		return errors.New("invalid stage: must be a string or a table")
+	}
+	return nil
+}
+
+// Override holds the group fields overridden for a specific stage.
+// Empty fields fall back to the base group.
+type Override struct {
+	Dir      string `toml:"dir"`      // Directory overriding the group's one
+	Filename string `toml:"filename"` // Filename overriding the group's one
+	IsCheck  *bool  `toml:"check"`    // Whether to check for empty values, overriding the group's one
+}
 
-	path string    // path is the absolute path to the configuration file
-	dir  string    // dir is the configuration file directory
-	root string    // root is the project root directory with .git
-	size int       // size is the size of the map to be allocated when reading the central env
-	w    io.Writer // w is the writer to which the output is written
+// UnmarshalTOML decodes an override from a table.
+func (o *Override) UnmarshalTOML(v any) error {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return errors.New("must be a table")
+	}
+	for k, val := range m {
+		switch k {
+		case "dir", "filename":
+			str, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("%s: must be a string", k)
+			}
+			if k == "dir" {
+				o.Dir = str
+			} else {
+				o.Filename = str
+			}
+		case "check":
+			b, ok := val.(bool)
+			if !ok {
+				return fmt.Errorf("%s: must be a boolean", k)
+			}
+			o.IsCheck = &b
+		default:
+			return fmt.Errorf("unknown key: %s", k)
+		}
+	}
+	return nil
 }
 
 // Group groups environment variables using several parameters.
 type Group struct {
-	Prefix        string   `toml:"prefix"`  // Prefix for the environment variable names
-	Dir           string   `toml:"dir"`     // Directory to which the environment variables are delivered
-	Replaceable   []string `toml:"replace"` // List of prefixes to be delivered by replacing group prefixes
-	Plain         []string `toml:"plain"`   // List of environment variables delivered without prefixes
-	DirenvSupport []string `toml:"direnv"`  // Groups for which .envrc is generated
-	IsCheck       bool     `toml:"check"`   // Whether to check for empty values
+	Prefix        string            `toml:"prefix"`     // Prefix for the environment variable names
+	Dir           string            `toml:"dir"`        // Directory to which the environment variables are delivered
+	Filename      string            `toml:"filename"`   // Name of the env file to be delivered, defaults to .env
+	Replaceable   []string          `toml:"replace"`    // List of prefixes to be delivered by replacing group prefixes
+	Plain         []string          `toml:"plain"`      // List of environment variables delivered without prefixes
+	DirenvSupport []string          `toml:"direnv"`     // Groups for which .envrc is generated
+	IsCheck       bool              `toml:"check"`      // Whether to check for empty values
+	Extends       string            `toml:"extends"`    // Group from which unset fields are inherited
+	CatchAll      bool              `toml:"catchall"`   // Whether to receive the keys not delivered to any group
+	JSON          string            `toml:"json"`       // How to format JSON values when delivering: compact or pretty
+	ValidateCmd   []string          `toml:"validate"`   // Command run with the path of the delivered env file appended
+	Defaults      map[string]string `toml:"defaults"`   // Values delivered for keys missing from the central env
+	Schema        string            `toml:"schema"`     // Path to the JSON schema file the delivered env is checked against
+	SkipEmpty     bool              `toml:"skipEmpty"`  // Whether to omit the keys with empty values from the env file
+	EnvrcExtra    []string          `toml:"envrcExtra"` // Lines appended verbatim to the generated .envrc
+	Targets       []string          `toml:"targets"`    // Paths of the files relative to the dir written instead of the env file
+	Optional      bool              `toml:"optional"`   // Whether to skip the group instead of failing if its dir does not exist
+}
+
+// filename returns the name of the env file to be delivered.
+func (group Group) filename() string {
+	if group.Filename == "" {
+		return defaultFilename
+	}
+	return group.Filename
+}
+
+// envSchema is the subset of JSON Schema that the env of a group is checked against.
+// Env values are always strings, so only the keywords about the keys and the string
+// values are supported, and the other keywords are ignored.
+type envSchema struct {
+	Required             []string                     `json:"required"`             // Keys that must be delivered
+	Properties           map[string]envSchemaProperty `json:"properties"`           // Constraints on the values of the keys
+	AdditionalProperties *bool                        `json:"additionalProperties"` // Whether keys not in properties are allowed
+}
+
+// envSchemaProperty represents the constraints on the value of a key in the schema.
+type envSchemaProperty struct {
+	Enum    []any  `json:"enum"`    // Values allowed for the key
+	Pattern string `json:"pattern"` // Regular expression the value must match
+
+	pattern *regexp.Regexp
+}
+
+// files returns the paths of the env files to be delivered relative to the group dir,
+// which are the targets if specified, or the filename otherwise.
+func (group Group) files() []string {
+	if len(group.Targets) != 0 {
+		return group.Targets
+	}
+	return []string{group.filename()}
 }
 
 // Entry represents an environment variable entry.
 type Entry struct {
-	Group  string // Group is the group name of the environment variable
-	Prefix string // Prefix is the prefix for the environment variable names of its group
-	Type   string // Type indicates whether the env entry is indirect
-	Name   string // Name is the key of the env entry, used for identification
-	Value  string // Value is the value of the env entry
+	Group  string `json:"group"`  // Group is the group name of the environment variable
+	Prefix string `json:"prefix"` // Prefix is the prefix for the environment variable names of its group
+	Type   string `json:"type"`   // Type indicates whether the env entry is indirect
+	Name   string `json:"name"`   // Name is the key of the env entry, used for identification
+	Value  string `json:"value"`  // Value is the value of the env entry
+	Kind   string `json:"kind"`   // Kind is the declared or inferred kind of the value
+}
+
+// ConfigDiff represents a difference in the stage or group table between two configurations.
+type ConfigDiff struct {
+	Table  string   `json:"table"`            // Table is the table name, stage or group
+	ID     string   `json:"id"`               // ID is the stage name or the group id
+	Change string   `json:"change"`           // Change is added, removed or changed
+	Fields []string `json:"fields,omitempty"` // Fields are the keys whose values differ if changed
+}
+
+// ImportConflict represents a central env key proposed by Import with different values
+// in the env files of more than one group, or under more than one key in the env file of
+// a group that the prefix of the group maps to the same key, such as FOO and API_FOO.
+type ImportConflict struct {
+	Key    string   `json:"key"`            // Key is the key of the proposed central env
+	Groups []string `json:"groups"`         // Groups are the sorted ids of the groups with different values, the first of which is kept
+	Keys   []string `json:"keys,omitempty"` // Keys are the sorted keys of the env file of the group mapped to the key, the first of which is kept
+}
+
+// Reconciliation represents the discrepancies of the keys in the delivered env files of a group
+// from the central env of the current stage, as reported by Reconcile.
+type Reconciliation struct {
+	Missing []string `json:"missing"` // Missing are the sorted keys to be delivered that are not in the env files
+	Stale   []string `json:"stale"`   // Stale are the sorted keys whose values in the env files differ from the central env
+}
+
+// keyMeta is the metadata of a key of the central env declared by a directive.
+type keyMeta struct {
+	groups []string // groups are the ids of the groups to which the key is delivered as is
+	secret bool     // secret masks the value of the key when listing
+}
+
+// RunReport represents the result of Run, such as to be printed as a single JSON object
+// for automation instead of the messages.
+type RunReport struct {
+	Stage  string        `json:"stage"`  // Stage is the stage of the central env
+	Path   string        `json:"path"`   // Path is the path to the central env
+	Groups []GroupReport `json:"groups"` // Groups holds the groups distributed by Run sorted by id
+}
+
+// GroupReport represents the delivery of a group in RunReport.
+type GroupReport struct {
+	Group    string `json:"group"`    // Group is the id of the group
+	Target   string `json:"target"`   // Target is the comma-separated paths of the written files
+	KeyCount int    `json:"keyCount"` // KeyCount is the number of keys written
+	Created  bool   `json:"created"`  // Created is whether the env file did not exist before
+}
+
+// FileAudit represents the permissions of an env file written for a group.
+type FileAudit struct {
+	Group string      `json:"group"` // Group is the id of the group
+	Path  string      `json:"path"`  // Path is the path to the env file
+	Mode  os.FileMode `json:"mode"`  // Mode is the file mode including the permission bits
+}
+
+// OutsideRootError is the error returned when a path resolved from the configuration,
+// such as a stage path, a group dir or an included env file, points outside of the
+// project root. It can be recovered with errors.As to inspect the offending path.
+type OutsideRootError struct {
+	Path string // Path is the absolute path that points outside of the project root
+	Root string // Root is the project root directory
+}
+
+// Error returns the message of the error with the offending path.
+func (e *OutsideRootError) Error() string {
+	return fmt.Sprintf("outside of the project root: %s", e.Path)
+}
+
+// hintError annotates an error with a suggested fix referencing the configuration key to change.
+type hintError struct {
+	err  error
+	hint string
+}
+
+// Error returns the message of the annotated error.
+func (e *hintError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the annotated error.
+func (e *hintError) Unwrap() error {
+	return e.err
+}
+
+// withHint annotates the error with the suggested fix without changing its message.
+func withHint(err error, format string, a ...any) error {
+	return &hintError{err: err, hint: fmt.Sprintf(format, a...)}
+}
+
+// Hint returns a one-line suggested fix for the error returned by lem, such as by Validate,
+// referencing the configuration key to change. It returns an empty string if there is none.
+func Hint(err error) string {
+	var h *hintError
+	if errors.As(err, &h) {
+		return h.hint
+	}
+	return ""
+}
+
+// stagedEvent is the event printed by Run in the JSON output format when the central env is read.
+type stagedEvent struct {
+	Event string `json:"event"`
+	Stage string `json:"stage"`
+	Path  string `json:"path"`
+}
+
+// skippedEvent is the event printed by Run in the JSON output format when an optional
+// group is skipped since its dir does not exist.
+type skippedEvent struct {
+	Event string `json:"event"`
+	Group string `json:"group"`
+}
+
+// distributedEvent is the event printed by Run in the JSON output format when the env file of a group is written.
+type distributedEvent struct {
+	Event  string `json:"event"`
+	Group  string `json:"group"`
+	Target string `json:"target"`
+}
+
+// unchangedEvent is the event printed by Run in the JSON output format when the env
+// of a group is unchanged since the previous run and its env file is not rewritten.
+type unchangedEvent struct {
+	Event string `json:"event"`
+	Group string `json:"group"`
+}
+
+// orphansEvent is the event printed by Run in the JSON output format when the central
+// env has keys not delivered to any group.
+type orphansEvent struct {
+	Event string `json:"event"`
+	Count int    `json:"count"`
+}
+
+// summaryEvent is the event printed by Run in the JSON output format at the end.
+type summaryEvent struct {
+	Event  string `json:"event"`
+	Groups int    `json:"groups"`
+	Keys   int    `json:"keys"`
+	Empty  int    `json:"empty"`
+}
+
+// timingEvent is the event printed by Run in the JSON output format for the duration of a phase.
+type timingEvent struct {
+	Event    string `json:"event"`
+	Phase    string `json:"phase"`
+	Duration string `json:"duration"`
+}
+
+// emptyKeyEvent is the event printed in the JSON output format for a line of the central env
+// with an empty key, which is skipped.
+type emptyKeyEvent struct {
+	Event string `json:"event"`
+	Path  string `json:"path"`
+	Line  string `json:"line"`
+}
+
+// duplicateEvent is the event printed by Run in the JSON output format for a key delivered to more than one group.
+type duplicateEvent struct {
+	Event  string   `json:"event"`
+	Stage  string   `json:"stage"`
+	Key    string   `json:"key"`
+	Groups []string `json:"groups"`
+}
+
+// rerunEvent is the event printed by Watch in the JSON output format when the central env changes.
+type rerunEvent struct {
+	Event string `json:"event"`
 }
 
 // Option is an option given when loading the configuration file.
@@ -107,330 +635,2788 @@ func WithWriter(w io.Writer) Option {
 	}
 }
 
-// Init initializes the configuration file with an example.
-// You can use this to create a new configuration file.
-func Init() error {
-	if err := os.WriteFile(initConfigPath, initConfig, 0o600); err != nil {
-		return fmt.Errorf("failed to initialize: %w", err)
+// WithWriters sets the writers to the Config so that the output is duplicated to each of them,
+// such as the terminal and a log file. Nil writers are ignored, and if none remains,
+// the output remains standard output. Color codes are kept only for the writers that are
+// terminals and are stripped for the others, so that log files contain plain text.
+func WithWriters(ws ...io.Writer) Option {
+	ws = slices.DeleteFunc(slices.Clone(ws), func(w io.Writer) bool { return w == nil })
+	switch len(ws) {
+	case 0:
+		return WithWriter(nil)
+	case 1:
+		return WithWriter(ws[0])
 	}
-	fmt.Printf("%s %s\n", cyan("created:"), initConfigPath)
-	return nil
-}
-
-// Load loads and instantiates the specified configuration file path.
-func Load(path string, opts ...Option) (*Config, error) {
-	var absPath string
-	cfg := &Config{}
-	if path == "" {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
-		}
-		cfg.root = projectRoot(cwd)
-		absPath, err = cfg.findConfig()
-		if err != nil {
-			return nil, fmt.Errorf("failed to find config file: %w", err)
-		}
-	} else {
-		var err error
-		absPath, err = sanitizePath(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to validate config path: %w", err)
+	mw := make([]io.Writer, 0, len(ws))
+	for _, w := range ws {
+		if !isTerminal(w) {
+			w = &plainWriter{w: w}
 		}
-		cfg.root = projectRoot(filepath.Dir(absPath))
+		mw = append(mw, w)
 	}
-	info, err := os.Stat(absPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to stat config path: %w", err)
+	return WithWriter(io.MultiWriter(mw...))
+}
+
+// plainWriter is a writer that strips the color codes before writing to the underlying writer.
+type plainWriter struct {
+	w io.Writer
+}
+
+// Write writes p to the underlying writer without the color codes.
+// It reports the length of p on success so that it can be used in io.MultiWriter.
+func (pw *plainWriter) Write(p []byte) (int, error) {
+	if _, err := pw.w.Write(ansiPattern.ReplaceAll(p, nil)); err != nil {
+		return 0, err
 	}
-	if info.IsDir() {
-		return nil, fmt.Errorf("failed to validate config path: %s: is a directory", path)
+	return len(p), nil
+}
+
+// isTerminal reports whether the writer is a file connected to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
 	}
-	if _, err := toml.DecodeFile(absPath, cfg); err != nil {
-		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// WithMaxFileSize sets the maximum size in bytes of an env file to be read, such as
+// the central env, so that a runaway generator cannot make lem exhaust the memory.
+// Larger files are rejected before reading. If not used, this value remains 64 MiB.
+func WithMaxFileSize(size int64) Option {
+	if size <= 0 {
+		size = defaultMaxFileSize
 	}
-	cfg.path = absPath
-	cfg.dir = filepath.Dir(absPath)
-	cfg.size = 32
-	cfg.w = os.Stdout
-	for _, opt := range opts {
-		opt(cfg)
+	return func(cfg *Config) {
+		cfg.maxFileSize = size
 	}
-	return cfg, nil
 }
 
-// Validate verifies that the configuration file is executable.
-// In addition to syntax checks, it also checks whether the path exists.
-func (cfg *Config) Validate() error {
-	if err := cfg.validateStageTable(); err != nil {
-		return err
+// WithRetry sets the number of attempts for writing env files when a
+// transient error occurs, such as on a networked filesystem.
+// If not used, this value remains 1, which means no retry.
+func WithRetry(attempts int) Option {
+	if attempts <= 0 {
+		attempts = 1
 	}
-	if err := cfg.validateGroupTable(); err != nil {
-		return err
+	return func(cfg *Config) {
+		cfg.attempts = attempts
 	}
-	for stage := range cfg.Stage {
-		if _, err := cfg.validateStagePair(stage); err != nil {
-			return err
-		}
+}
+
+// WithTimeout sets the duration bounding the entire Run. If exceeded, Run
+// aborts partway with a timeout error. If not used, there is no timeout.
+func WithTimeout(timeout time.Duration) Option {
+	if timeout < 0 {
+		timeout = 0
 	}
-	for id, group := range cfg.Group {
-		if _, err := cfg.validateGroupPair(id, group); err != nil {
-			return err
-		}
+	return func(cfg *Config) {
+		cfg.timeout = timeout
 	}
-	_, _ = fmt.Fprintln(cfg.w, green("all checks passed!"))
-	return nil
 }
 
-// Current shows the current stage context.
-func (cfg *Config) Current() error {
-	if err := cfg.validateStageTable(); err != nil {
-		return err
+// WithHTTPTimeout sets the timeout for fetching the central env of a stage whose path
+// is an http:// or https:// URL. If not used or not positive, this value is 30 seconds.
+func WithHTTPTimeout(timeout time.Duration) Option {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
 	}
-	stage, err := cfg.loadStage()
-	if err != nil {
-		return err
+	return func(cfg *Config) {
+		cfg.httpTimeout = timeout
 	}
-	if _, err := cfg.validateStagePair(stage); err != nil {
-		return err
+}
+
+// WithTrimValues sets whether to trim the surrounding whitespace of the values
+// when reading the central env. Keys are always trimmed.
+// If not used, values are trimmed.
+func WithTrimValues(trim bool) Option {
+	return func(cfg *Config) {
+		cfg.rawValues = !trim
 	}
-	_, _ = fmt.Fprintln(cfg.w, cyan("current: ", stage))
-	return nil
 }
 
-// Switch switches the current stage to the specified one.
-func (cfg *Config) Switch(stage string) error {
-	if err := cfg.validateStageTable(); err != nil {
-		return err
+// WithNormalizeValues sets whether to normalize the values when reading the central env.
+// A normalized value has its surrounding whitespace trimmed and then a surrounding pair of
+// double or single quotes stripped, so that ` "foo" ` becomes foo while " foo " keeps
+// the whitespace inside the quotes. It takes precedence over WithTrimValues, and is
+// ignored in the strict format, which unquotes values by itself.
+// If not used, values are not normalized.
+func WithNormalizeValues(normalize bool) Option {
+	return func(cfg *Config) {
+		cfg.normalize = normalize
 	}
-	if _, err := cfg.validateStagePair(stage); err != nil {
-		return err
+}
+
+// WithKVSeparator sets the separator between the key and the value when
+// reading the central env, such as ":" for files in the form of KEY: value.
+// If not used, this value remains "=".
+func WithKVSeparator(sep string) Option {
+	if sep == "" {
+		sep = defaultKVSeparator
 	}
-	if err := cfg.storeStage(stage); err != nil {
-		return err
+	return func(cfg *Config) {
+		cfg.kvSep = sep
 	}
-	_, _ = fmt.Fprintln(cfg.w, cyan("switched: ", stage))
-	return nil
 }
 
-// List returns a slice of Entry for all env entries of all groups for the given stage.
-// If stage is empty, returns an error.
-func (cfg *Config) List() ([]Entry, error) {
-	if err := cfg.validateStageTable(); err != nil {
-		return nil, err
+// WithOutputSeparator sets the separator between the key and the value when
+// writing the env files, such as ": " for consumers that expect KEY: value.
+// Read them back with WithKVSeparator set to the same separator without spaces.
+// The central env proposed by Import is always written with "=".
+// If not used, this value remains "=".
+func WithOutputSeparator(sep string) Option {
+	if sep == "" {
+		sep = defaultKVSeparator
 	}
-	stage, err := cfg.loadStage()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load stage: %w", err)
+	return func(cfg *Config) {
+		cfg.outSep = sep
 	}
-	path, err := cfg.validateStagePair(stage)
-	if err != nil {
-		return nil, err
+}
+
+// WithDuplicateKeyPolicy sets the policy for central env keys delivered to more
+// than one group at Run time: DuplicateKeyAllow, DuplicateKeyWarn or DuplicateKeyError.
+// If not used, this value remains DuplicateKeyAllow.
+func WithDuplicateKeyPolicy(policy string) Option {
+	if policy == "" {
+		policy = DuplicateKeyAllow
 	}
-	if err := cfg.validateGroupTable(); err != nil {
-		return nil, err
+	return func(cfg *Config) {
+		cfg.dupPolicy = policy
 	}
-	e, n, err := readEnv(path, cfg.size)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read central env: %w", err)
+}
+
+// WithFormat sets the dotenv format for reading and writing env files:
+// FormatRaw or FormatStrict. Note that FormatStrict also applies to the
+// central env, where double-quoted values are unquoted.
+// If not used, this value remains FormatRaw.
+func WithFormat(format string) Option {
+	if format == "" {
+		format = FormatRaw
 	}
-	entries := make([]Entry, 0, n)
-	for name, group := range cfg.Group {
+	return func(cfg *Config) {
+		cfg.format = format
+	}
+}
+
+// WithLineEnding sets the line ending of the env files: LineEndingLF or LineEndingCRLF.
+// It applies uniformly to every line, including the lines of multiline values, so that
+// the output is the same on every platform.
+// If not used, this value remains LineEndingLF.
+func WithLineEnding(eol string) Option {
+	if eol == "" {
+		eol = LineEndingLF
+	}
+	return func(cfg *Config) {
+		cfg.lineEnding = eol
+	}
+}
+
+// WithOutputRoot sets the directory under which Run writes the env file of each group,
+// mirroring the group directory relative to the project root, such as out/api/.env,
+// instead of writing it in place. Check and Freshness also look at the files there.
+// A relative dir is resolved from the configuration directory like the other paths.
+// If not used, the env files are written to the group directories.
+func WithOutputRoot(dir string) Option {
+	return func(cfg *Config) {
+		cfg.outputRoot = dir
+	}
+}
+
+// WithContinueOnError sets whether Run attempts every group even if some of them fail.
+// The groups that succeed are written, and the errors of the others are joined and
+// returned at the end. If not used, Run fails fast on the first group error.
+func WithContinueOnError(continueOnError bool) Option {
+	return func(cfg *Config) {
+		cfg.continueOnError = continueOnError
+	}
+}
+
+// WithStrict sets whether Validate fails if it reports any warning, such as a group dir
+// that is the configuration directory or a key delivered to more than one group.
+// It also makes reading a central env line with an empty key an error.
+// The warnings are still printed, and the error is returned after all checks.
+// If not used, Validate passes with the warnings.
+func WithStrict(strict bool) Option {
+	return func(cfg *Config) {
+		cfg.strict = strict
+	}
+}
+
+// WithAllStages sets whether Validate also checks the env of each group made from the
+// central env of every stage for empty values if the group checks them, as Run does,
+// reporting the failures of all stages at once, such as an empty value only in prod.
+// If not used, the empty values are only checked by Run for the current stage.
+func WithAllStages(allStages bool) Option {
+	return func(cfg *Config) {
+		cfg.allStages = allStages
+	}
+}
+
+// WithNamingPattern sets the regular expression that Validate expects the group prefixes
+// and the plain and replace entries to match in full, such as to catch a lowercase prefix
+// that matches no key. Every violation is reported as a warning.
+// If not used or empty, the pattern is [A-Z][A-Z0-9_]*.
+func WithNamingPattern(pattern string) Option {
+	return func(cfg *Config) {
+		cfg.namingPattern = pattern
+	}
+}
+
+// WithDirenvCycles sets whether Validate detects the cycles in the direnv references between
+// groups, such as api loading the env file of ui and ui loading that of api. Since such cycles
+// can be legitimate, each of them is reported as a warning, which fails only in strict mode.
+// If not used, the cycles are not checked.
+func WithDirenvCycles(direnvCycles bool) Option {
+	return func(cfg *Config) {
+		cfg.direnvCycles = direnvCycles
+	}
+}
+
+// WithEnvPath sets the path to the central env used instead of the path configured
+// for the current stage, such as to try a candidate env file without editing the
+// configuration. The stored stage and its group overrides are still used. A relative
+// path is resolved from the configuration directory, and the path is subject to the
+// same project root check as the stage paths. If not used, the stage path is used.
+func WithEnvPath(path string) Option {
+	return func(cfg *Config) {
+		cfg.envPath = path
+	}
+}
+
+// WithIncludes sets whether a line of the form #include <path> in the central env reads
+// the env file at that path in place, as if its lines were written there. The path is
+// resolved relative to the including file and must be within the project root unless
+// external paths are allowed. If not used, such lines are treated as comments.
+func WithIncludes(includes bool) Option {
+	return func(cfg *Config) {
+		cfg.includes = includes
+	}
+}
+
+// WithDirectives sets whether a comment of the form # lem:group=api,secret in an env file
+// declares the metadata of the key on the following line. A key with group=<id> is
+// delivered as is to that group, like the plain keys of the group, and the value of
+// a secret key is masked by List. If not used, such lines are treated as comments.
+func WithDirectives(directives bool) Option {
+	return func(cfg *Config) {
+		cfg.directives = directives
+	}
+}
+
+// WithSourceOrder sets whether the keys of the env files are ordered by their
+// position in the central env instead of alphabetically. Keys renamed by replace
+// follow the position of their original key, and keys not found in the central env,
+// such as defaults, come last in alphabetical order.
+// If not used, the keys are ordered alphabetically.
+func WithSourceOrder(sourceOrder bool) Option {
+	return func(cfg *Config) {
+		cfg.sourceOrder = sourceOrder
+	}
+}
+
+// WithStageFile sets whether the current stage is read from the .lem-stage file in the
+// project root, which contains just the stage name, before the state file. This lets
+// a repository pin its stage in version control, such as per branch. While the file
+// exists and is not empty, it takes precedence over the stage stored by Switch, which
+// still writes the state file. If not used, the stage is read from the state file only.
+// There is no LEM_STAGE environment variable or --stage flag selecting the stage, so
+// LEM_STAGE in the environment is ignored and the stage file always wins when present.
+func WithStageFile(stageFile bool) Option {
+	return func(cfg *Config) {
+		cfg.stageFile = stageFile
+	}
+}
+
+// WithIncremental sets whether Run rewrites only the groups whose env changed since the
+// previous Run of the same configuration, such as the reruns of Watch, comparing the env
+// of each group, so that a deleted key is also detected. The first Run, the Run after the
+// stage changed and the groups that failed before are distributed in full.
+// If not used, every group is rewritten on each Run.
+func WithIncremental(incremental bool) Option {
+	return func(cfg *Config) {
+		cfg.incremental = incremental
+	}
+}
+
+// WithOnlyChanged sets whether Run writes only the groups whose env differs from the hash
+// stored by the previous Run, or whose env files no longer match it, so that running
+// again without changes has no effect. The hashes are stored as with WithStoreHash.
+// If not used, every group is written on each Run.
+func WithOnlyChanged(onlyChanged bool) Option {
+	return func(cfg *Config) {
+		cfg.onlyChanged = onlyChanged
+	}
+}
+
+// WithEnvOverrides sets whether the process environment variables of the form
+// LEM_OVERRIDE_<KEY>=value override the value of KEY in the central env, or add it,
+// after the keys of FromEnv are overlaid, so that they take precedence over both.
+// They only apply to the env read in the process and are never written back to the
+// central env. If not used, such variables are ignored.
+func WithEnvOverrides(envOverrides bool) Option {
+	return func(cfg *Config) {
+		cfg.envOverrides = envOverrides
+	}
+}
+
+// WithTiming sets whether Run prints the duration of reading the central env, writing
+// the env files of each group and in total, and the whole run, after the summary.
+// This is diagnostic only. If not used, no durations are printed.
+func WithTiming(timing bool) Option {
+	return func(cfg *Config) {
+		cfg.timing = timing
+	}
+}
+
+// WithDryRun sets whether Switch only validates the stage and prints the stage it would
+// switch from and to, without storing it, so that the state file is left untouched.
+// If not used, Switch stores the stage.
+func WithDryRun(dryRun bool) Option {
+	return func(cfg *Config) {
+		cfg.dryRun = dryRun
+	}
+}
+
+// WithChecksums sets whether Run writes a sidecar named after each env file with the
+// .sha256 extension added, such as .env.sha256, holding the SHA-256 digest of the written
+// content in the format of sha256sum, so that consumers can verify the integrity of the file.
+// If not used, no sidecar is written.
+func WithChecksums(checksums bool) Option {
+	return func(cfg *Config) {
+		cfg.checksums = checksums
+	}
+}
+
+// WithBackup sets whether Run copies each env file to a backup next to it before
+// overwriting it with different content, named after it with a UTC timestamp and the .bak
+// extension, such as .env.20240101T000000.000000000Z.bak. PruneBackups removes only
+// the backups named so. If not used, the env files are overwritten without backups.
+func WithBackup(backup bool) Option {
+	return func(cfg *Config) {
+		cfg.backup = backup
+	}
+}
+
+// WithStoreHash sets whether Run stores the SHA-256 hashes of the central env file
+// and the env file of each group in the state file alongside the stage. Freshness
+// compares the stored hashes instead of the modification times if they are present,
+// which is reliable on filesystems where the modification times are not.
+// If not used, no hashes are stored.
+func WithStoreHash(storeHash bool) Option {
+	return func(cfg *Config) {
+		cfg.storeHash = storeHash
+	}
+}
+
+// WithOutputFormat sets the format of the messages printed by Run and Watch:
+// OutputText or OutputJSON. In OutputJSON, one JSON object is printed per event,
+// such as {"event":"staged","stage":"dev","path":"..."}, instead of colored lines.
+// If not used, this value remains OutputText.
+func WithOutputFormat(format string) Option {
+	if format == "" {
+		format = OutputText
+	}
+	return func(cfg *Config) {
+		cfg.outputFormat = format
+	}
+}
+
+// WithGroups restricts the distribution of Run, and therefore Watch, and the entries
+// of List to the specified groups. If not used, all groups are distributed and listed.
+func WithGroups(ids ...string) Option {
+	return func(cfg *Config) {
+		cfg.only = ids
+	}
+}
+
+// WithRootMarkers sets the names of the files or directories that mark the project root,
+// such as .hg, go.work or .lemroot. The nearest directory containing any of them is the root.
+// Empty names are ignored. If not used, or no name remains, .git is used, which matches both
+// the directory of a repository and the file of a worktree.
+func WithRootMarkers(markers []string) Option {
+	markers = slices.DeleteFunc(slices.Clone(markers), func(m string) bool { return m == "" })
+	return func(cfg *Config) {
+		cfg.rootMarkers = markers
+	}
+}
+
+// WithAllowExternal allows stage paths to point outside of the project root.
+// This is intended for multi-repo setups where the central env lives in a
+// sibling repository. Note that it lets the configuration file read any file
+// the current user can access, so enable it only for trusted configurations.
+// Group directories are always confined to the project root regardless of this option.
+func WithAllowExternal(allow bool) Option {
+	return func(cfg *Config) {
+		cfg.allowExternal = allow
+	}
+}
+
+// WithFollowSymlinks sets whether the paths from the configuration, such as group dirs,
+// are checked for the containment in the project root after resolving their symlinks.
+// A symlink inside the project root that points outside of it is then rejected, which
+// is safer, while a symlink pointing into the project root is allowed wherever it is.
+// The paths themselves are used as written, so the env files and .envrc are written
+// through the symlinks. If not used, the paths are checked as written without resolving
+// symlinks, so a symlinked dir inside the project root is allowed wherever it points.
+func WithFollowSymlinks(follow bool) Option {
+	return func(cfg *Config) {
+		cfg.followSymlinks = follow
+	}
+}
+
+// Init initializes the configuration file with an example.
+// You can use this to create a new configuration file.
+func Init() error {
+	return InitWith("", "")
+}
+
+// InitWith initializes the configuration file with an example in the same way as Init,
+// with the prefix and dir customizing the first group of the example; empty values fall
+// back to "API" and "./backend". The id of the group is the lowercased prefix, so the
+// prefix must consist of letters, digits, underscores and hyphens.
+func InitWith(prefix, dir string) error {
+	prefix = strings.ToUpper(cmp.Or(prefix, defaultInitPrefix))
+	dir = filepath.ToSlash(cmp.Or(dir, defaultInitDir))
+	if !bareKeyPattern.MatchString(prefix) {
+		return fmt.Errorf("failed to initialize: prefix %s must consist of letters, digits, underscores and hyphens", prefix)
+	}
+	if strings.ContainsAny(dir, "\"\\") {
+		return fmt.Errorf("failed to initialize: dir must not contain quotes or backslashes")
+	}
+	tmpl, err := template.New(initConfigPath).Parse(initConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+	var buf bytes.Buffer
+	data := map[string]string{
+		"ID":     strings.ToLower(prefix),
+		"Prefix": prefix,
+		"Dir":    dir,
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+	if err := os.WriteFile(initConfigPath, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+	fmt.Printf("%s %s\n", cyan("created:"), initConfigPath)
+	return nil
+}
+
+// Scaffold walks the specified directory and writes suggested group tables
+// to the writer for each subdirectory that contains a .env file or a marker file.
+// The group id and prefix are guessed from the relative path of the subdirectory.
+func Scaffold(w io.Writer, dir string) error {
+	root := filepath.Clean(dir)
+	ids := []string{}
+	groups := map[string]Group{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !exists(filepath.Join(path, defaultFilename)) && !exists(filepath.Join(path, scaffoldMarker)) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		id := strings.ToLower(strings.ReplaceAll(filepath.ToSlash(rel), "/", "-"))
+		groupDir := filepath.Join(dir, rel)
+		if !filepath.IsAbs(groupDir) && !isOutside(groupDir) {
+			groupDir = "." + string(filepath.Separator) + groupDir
+		}
+		ids = append(ids, id)
+		groups[id] = Group{
+			Prefix: prefixOf(id),
+			Dir:    filepath.ToSlash(groupDir),
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scaffold: %w", err)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("failed to scaffold: no group directory found in %s", dir)
+	}
+	slices.Sort(ids)
+	b := strings.Builder{}
+	for i, id := range ids {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(fmt.Sprintf("[group.%s]\n", id))
+		b.WriteString(fmt.Sprintf("prefix = %q\n", groups[id].Prefix))
+		b.WriteString(fmt.Sprintf("dir    = %q\n", groups[id].Dir))
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to scaffold: %w", err)
+	}
+	return nil
+}
+
+// Load loads and instantiates the specified configuration file path.
+func Load(path string, opts ...Option) (*Config, error) {
+	var absPath string
+	cfg := &Config{}
+	// The root markers must be known before the project root is detected,
+	// so the options are applied here too, and again after the defaults in setup.
+	cfg.applyOptions(opts)
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current directory: %w", err)
+		}
+		cfg.root = projectRoot(cwd, cfg.markers())
+		absPath, err = cfg.findConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find config file: %w", err)
+		}
+	} else {
+		var err error
+		absPath, err = sanitizePath(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate config path: %w", err)
+		}
+		cfg.root = projectRoot(filepath.Dir(absPath), cfg.markers())
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat config path: %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("failed to validate config path: %s: is a directory", path)
+	}
+	md, err := toml.DecodeFile(absPath, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+	return cfg.setup(md, absPath, opts...)
+}
+
+// LoadReader loads and instantiates the configuration in TOML format read from r,
+// such as a configuration generated on the fly and piped to stdin.
+// Since there is no file location, relative stage and group paths are resolved
+// from baseDir, and the project root is the nearest directory with .git from baseDir.
+// If baseDir is empty, the current directory is used.
+func LoadReader(r io.Reader, baseDir string, opts ...Option) (*Config, error) {
+	if baseDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current directory: %w", err)
+		}
+		baseDir = cwd
+	}
+	absDir, err := sanitizePath(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate base dir: %w", err)
+	}
+	info, err := os.Stat(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat base dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("failed to validate base dir: %s: not a directory", baseDir)
+	}
+	cfg := &Config{}
+	cfg.applyOptions(opts)
+	cfg.root = projectRoot(absDir, cfg.markers())
+	md, err := toml.NewDecoder(r).Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	return cfg.setup(md, filepath.Join(absDir, readerConfigName), opts...)
+}
+
+// setup resolves the group inheritance of the decoded configuration
+// located at absPath, merges the group defaults into all groups using the metadata
+// of the decoding to tell the explicitly set flags,
+// then applies the defaults and the options.
+// The groups without a prefix, even after inheritance, get the prefix derived from their id.
+func (cfg *Config) setup(md toml.MetaData, absPath string, opts ...Option) (*Config, error) {
+	if err := cfg.resolveExtends(md); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyGroupDefaults(md); err != nil {
+		return nil, err
+	}
+	cfg.defaultPrefixes()
+	cfg.path = absPath
+	cfg.dir = filepath.Dir(absPath)
+	cfg.size = 32
+	cfg.w = os.Stdout
+	cfg.attempts = 1
+	cfg.kvSep = defaultKVSeparator
+	cfg.dupPolicy = DuplicateKeyAllow
+	cfg.format = FormatRaw
+	cfg.lineEnding = LineEndingLF
+	cfg.outputFormat = OutputText
+	cfg.applyOptions(opts)
+	return cfg, nil
+}
+
+// applyOptions applies the options to the Config in order.
+func (cfg *Config) applyOptions(opts []Option) {
+	for _, opt := range opts {
+		opt(cfg)
+	}
+}
+
+// markers returns the names marking the project root, defaulting to .git.
+func (cfg *Config) markers() []string {
+	if len(cfg.rootMarkers) == 0 {
+		return []string{gitDir}
+	}
+	return cfg.rootMarkers
+}
+
+// Validate verifies that the configuration file is executable.
+// In addition to syntax checks, it also checks whether the path exists.
+// The content of a URL stage is not fetched and is left to Run.
+func (cfg *Config) Validate() error {
+	cfg.warnings = 0
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	if err := cfg.validateGroupTable(); err != nil {
+		return err
+	}
+	if err := cfg.validateSeparator(); err != nil {
+		return err
+	}
+	if err := cfg.validateDuplicateKeyPolicy(); err != nil {
+		return err
+	}
+	if err := cfg.validateFormat(); err != nil {
+		return err
+	}
+	if err := cfg.validateLineEnding(); err != nil {
+		return err
+	}
+	if err := cfg.validateKind(); err != nil {
+		return err
+	}
+	if err := cfg.checkNaming(); err != nil {
+		return err
+	}
+	paths := make(map[string]string, len(cfg.Stage))
+	for stage := range cfg.Stage {
+		path, err := cfg.validateStagePair(stage)
+		if err != nil {
+			return err
+		}
+		paths[stage] = path
+	}
+	// The env path stands in for the path of the current stage, as in Run
+	if cfg.envPath != "" {
+		stage, path, err := cfg.currentStage()
+		if err != nil {
+			return err
+		}
+		paths[stage] = path
+	}
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		if !strings.Contains(cfg.Group[id].Dir, stagePlaceholder) {
+			dir, err := cfg.validateGroupPair(id, cfg.Group[id])
+			if errors.Is(err, errSkipped) {
+				cfg.noteSkipped("", id)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			cfg.checkGroupDir(id, dir, paths)
+			continue
+		}
+		// A templated dir is checked as expanded for each stage
+		for _, stage := range slices.Sorted(maps.Keys(cfg.Stage)) {
+			group, _ := cfg.groupOf(stage, id)
+			dir, err := cfg.validateGroupPair(id, group)
+			if errors.Is(err, errSkipped) {
+				cfg.noteSkipped(stage, id)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to validate stage: %s: %w", stage, err)
+			}
+			cfg.checkGroupDir(id, dir, paths)
+		}
+	}
+	cfg.checkPrefixOverlap()
+	if cfg.direnvCycles {
+		if err := cfg.checkDirenvCycles(); err != nil {
+			return err
+		}
+	}
+	for stage, s := range cfg.Stage {
+		for id := range s.Override {
+			group, ok := cfg.groupOf(stage, id)
+			if !ok {
+				return fmt.Errorf("failed to validate stage: %s: override for unknown group: %s", stage, id)
+			}
+			if _, err := cfg.validateGroupPair(id, group); err != nil && !errors.Is(err, errSkipped) {
+				return fmt.Errorf("failed to validate stage: %s: %w", stage, err)
+			}
+		}
+	}
+	// Report the keys delivered to more than one group for each stage
+	errs := []error{}
+	for _, stage := range slices.Sorted(maps.Keys(paths)) {
+		// The central env served at a URL is checked by Run, which fetches it anyway
+		if isURL(paths[stage]) {
+			_, _ = fmt.Fprintf(cfg.w, "%s %s %s central env at a URL is not fetched\n", gray("skipped:"), stage, gray("->"))
+			continue
+		}
+		// The env is built as in Run, with the values from the environment overlaid
+		e, _, err := cfg.readStageEnv(context.Background(), stage, paths[stage])
+		if err != nil {
+			return fmt.Errorf("failed to validate stage: %s: %w", stage, err)
+		}
+		if err := cfg.checkDuplicateKeys(stage, e, true); err != nil {
+			return err
+		}
+		cfg.checkDirenvTargets(stage, e)
+		// Check the env of each group against its schema
+		for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+			group, _ := cfg.groupOf(stage, id)
+			o := cfg.makeEnv(group, e)
+			if err := cfg.checkSchema(id, group, o); err != nil {
+				return fmt.Errorf("failed to validate stage: %s: %w", stage, err)
+			}
+			if !cfg.allStages {
+				continue
+			}
+			if err := checkEmpty(group, o); err != nil {
+				errs = append(errs, fmt.Errorf("failed to validate stage: %s: group.%s: %w", stage, id, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if cfg.strict && cfg.warnings > 0 {
+		return fmt.Errorf("failed to validate: warnings reported in strict mode: %d", cfg.warnings)
+	}
+	_, _ = fmt.Fprintln(cfg.w, green("all checks passed!"))
+	return nil
+}
+
+// Current shows the current stage context.
+func (cfg *Config) Current() error {
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	stage, err := cfg.loadStage()
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.validateStagePair(stage); err != nil {
+		return err
+	}
+	if desc := cfg.Stage[stage].Description; desc != "" {
+		_, _ = fmt.Fprintln(cfg.w, cyan("current: ", stage), gray(desc))
+		return nil
+	}
+	_, _ = fmt.Fprintln(cfg.w, cyan("current: ", stage))
+	return nil
+}
+
+// Root returns the project root directory detected for the configuration and whether
+// a root marker such as .git was found there. If no marker is found up the directory tree,
+// the root falls back to the configuration directory, or the current directory for a
+// configuration read from a reader, which affects the checks for paths outside of the root.
+func (cfg *Config) Root() (string, bool) {
+	return cfg.root, hasMarker(cfg.root, cfg.markers())
+}
+
+// Stages shows all stages defined in the configuration with their descriptions.
+func (cfg *Config) Stages() error {
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(cfg.Stage))
+	width := 0
+	for name := range cfg.Stage {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if desc := cfg.Stage[name].Description; desc != "" {
+			_, _ = fmt.Fprintf(cfg.w, "%-*s  %s\n", width, name, gray(desc))
+			continue
+		}
+		_, _ = fmt.Fprintln(cfg.w, name)
+	}
+	return nil
+}
+
+// Switch switches the current stage to the specified one.
+// In dry run, it prints the current stage and the specified one without storing it.
+func (cfg *Config) Switch(stage string) error {
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	if _, err := cfg.validateStagePair(stage); err != nil {
+		return err
+	}
+	if cfg.dryRun {
+		current, err := cfg.loadStage()
+		if err != nil && !errors.Is(err, errNoStage) && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if current == "" {
+			current = "(none)"
+		}
+		_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("would switch:"), current, gray("->"), cyan(stage))
+		return nil
+	}
+	if err := cfg.storeStage(stage); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(cfg.w, cyan("switched: ", stage))
+	return nil
+}
+
+// StateDump returns the pretty-printed contents of the state file, which holds
+// the stage stored by Switch and the hashes stored by Run with WithStoreHash
+// for each configuration file path.
+// If the state file does not exist or is empty, it returns nil without error.
+func (cfg *Config) StateDump() ([]byte, error) {
+	path, err := statePathFunc()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	state, err := decodeState(path, data)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %w", err)
+	}
+	return b, nil
+}
+
+// ListStates returns the stage stored in the state file for each configuration file path,
+// such as to see which stage is selected in each repository lem has been used in.
+// The entries without a stored stage, which hold only hashes, are not returned.
+// If the state file does not exist or is empty, it returns an empty map without error.
+func ListStates() (map[string]string, error) {
+	path, err := statePathFunc()
+	if err != nil {
+		return nil, err
+	}
+	stages := map[string]string{}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return stages, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return stages, nil
+	}
+	state, err := decodeState(path, data)
+	if err != nil {
+		return nil, err
+	}
+	for config, v := range state {
+		if stage, ok := v["stage"]; ok {
+			stages[config] = stage
+		}
+	}
+	return stages, nil
+}
+
+// RenameStageInState renames the stage stored in the state file from old to new,
+// such as after renaming the stage in the configuration file. The new stage must be
+// set in the configuration file. If the stored stage is not old, it does nothing.
+func (cfg *Config) RenameStageInState(old, new string) error {
+	if old == "" || new == "" {
+		return errors.New("failed to rename stage: old and new stage names are required")
+	}
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	if _, err := cfg.validateStagePair(new); err != nil {
+		return err
+	}
+	stored, err := cfg.loadStoredStage()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errNoStage) {
+		return fmt.Errorf("failed to load stage: %w", err)
+	}
+	if stored != old {
+		_, _ = fmt.Fprintln(cfg.w, gray("unchanged: stored stage is not ", old))
+		return nil
+	}
+	if err := cfg.storeStage(new); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(cfg.w, cyan("renamed: ", old, " -> ", new))
+	return nil
+}
+
+// ResetState backs up the state file to the same path with the .bak extension added
+// and replaces it with an empty state, such as to recover from a corrupt state file.
+// The stages stored for all configuration files are discarded, so they have to be switched again.
+// If there is no state file, it only creates an empty one.
+func (cfg *Config) ResetState() error {
+	path, err := statePathFunc()
+	if err != nil {
+		return err
+	}
+	if exists(path) {
+		backup := path + ".bak"
+		if err := os.Rename(path, backup); err != nil {
+			return fmt.Errorf("failed to back up state file: %w", err)
+		}
+		_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("backup:"), path, gray("->"), backup)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to reset state file: %w", err)
+	}
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		return fmt.Errorf("failed to reset state file: %w", err)
+	}
+	_, _ = fmt.Fprintln(cfg.w, cyan("reset: ", path))
+	return nil
+}
+
+// List returns a slice of Entry for all env entries of all groups for the given stage.
+// If stage is empty, returns an error.
+// The values of the keys declared secret by directives are masked.
+// If the groups are restricted with WithGroups, only their entries are returned.
+func (cfg *Config) List() ([]Entry, error) {
+	ids, err := cfg.selectGroups()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.list(ids)
+}
+
+// ListGroup returns a slice of Entry for the env entries of the specified group only,
+// in the same way as List, such as for a focused view of one service.
+// It returns an error if the group is not set in the configuration.
+func (cfg *Config) ListGroup(id string) ([]Entry, error) {
+	if _, ok := cfg.Group[id]; !ok {
+		return nil, fmt.Errorf("failed to validate group: %s: not set in %s", id, cfg.path)
+	}
+	return cfg.list([]string{id})
+}
+
+// list returns the sorted entries of the specified groups for the current stage.
+func (cfg *Config) list(ids []string) ([]Entry, error) {
+	_, _, e, n, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateKind(); err != nil {
+		return nil, err
+	}
+	sep := cfg.separator()
+	entries := make([]Entry, 0, n)
+	for _, name := range ids {
+		group := cfg.Group[name]
 		for k, v := range e {
-			if after, ok := strings.CutPrefix(k, group.Prefix+"_"); ok {
+			if after, ok := strings.CutPrefix(k, group.Prefix+sep); ok {
 				entries = append(entries, Entry{
 					Group:  name,
 					Prefix: group.Prefix,
 					Type:   "direct",
 					Name:   after,
-					Value:  v,
+					Value:  cfg.maskValue(k, v),
+					Kind:   cfg.kindOf(k, v),
+				})
+			}
+		}
+		for _, prefix := range group.Replaceable {
+			for k, v := range e {
+				if after, ok := strings.CutPrefix(k, prefix+sep); ok {
+					entries = append(entries, Entry{
+						Group:  name,
+						Prefix: group.Prefix,
+						Type:   "indirect",
+						Name:   after,
+						Value:  cfg.maskValue(k, v),
+						Kind:   cfg.kindOf(k, v),
+					})
+				}
+			}
+		}
+		for _, key := range merge(group.Plain, cfg.directedKeys(name)) {
+			if v, ok := e[key]; ok {
+				entries = append(entries, Entry{
+					Group:  name,
+					Prefix: group.Prefix,
+					Type:   "plain",
+					Name:   key,
+					Value:  cfg.maskValue(key, v),
+					Kind:   cfg.kindOf(key, v),
 				})
 			}
 		}
-		for _, prefix := range group.Replaceable {
-			for k, v := range e {
-				if after, ok := strings.CutPrefix(k, prefix+"_"); ok {
-					entries = append(entries, Entry{
-						Group:  name,
-						Prefix: group.Prefix,
-						Type:   "indirect",
-						Name:   after,
-						Value:  v,
-					})
+		if group.CatchAll {
+			for k, v := range e {
+				if len(cfg.matchGroups(k)) == 0 {
+					entries = append(entries, Entry{
+						Group:  name,
+						Prefix: group.Prefix,
+						Type:   "catchall",
+						Name:   k,
+						Value:  cfg.maskValue(k, v),
+						Kind:   cfg.kindOf(k, v),
+					})
+				}
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if a.Group != b.Group {
+			return strings.Compare(a.Group, b.Group)
+		}
+		if a.Type != b.Type {
+			return strings.Compare(a.Type, b.Type)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return entries, nil
+}
+
+// ListCSV writes the entries returned by List to the writer as CSV with a header row
+// of Group, Prefix, Type, Name and Value, for consumers that render them on their own.
+func (cfg *Config) ListCSV(w io.Writer) error {
+	entries, err := cfg.List()
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Group", "Prefix", "Type", "Name", "Value"}); err != nil {
+		return fmt.Errorf("failed to write csv: %w", err)
+	}
+	for _, entry := range entries {
+		if err := cw.Write([]string{entry.Group, entry.Prefix, entry.Type, entry.Name, entry.Value}); err != nil {
+			return fmt.Errorf("failed to write csv: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write csv: %w", err)
+	}
+	return nil
+}
+
+// Resolved returns the central env of the current stage as read by lem
+// before it is divided into groups.
+func (cfg *Config) Resolved() (map[string]string, error) {
+	stage, path, err := cfg.currentStage()
+	if err != nil {
+		return nil, err
+	}
+	e, _, err := cfg.readEnv(context.Background(), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read central env: %w", err)
+	}
+	interpolateStage(e, stage)
+	return e, nil
+}
+
+// Orphans returns the sorted keys of the central env of the current stage that are
+// not claimed by the prefix, replace or plain of any group. The keys delivered to
+// a catch-all group are reported too, since no group claims them explicitly.
+func (cfg *Config) Orphans() ([]string, error) {
+	_, _, e, _, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return cfg.orphanKeys(e), nil
+}
+
+// orphanKeys returns the sorted keys of the central env not claimed by any group.
+func (cfg *Config) orphanKeys(e map[string]string) []string {
+	keys := []string{}
+	for k := range e {
+		if len(cfg.matchGroups(k)) == 0 {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// DirenvGraph returns the direnv targets of each group, which are the groups whose env files
+// the .envrc of the group loads, sorted and without duplicates. The groups without targets
+// map to an empty slice, so that every group is a node of the graph.
+// It returns an error if a target is not a group in the configuration.
+func (cfg *Config) DirenvGraph() (map[string][]string, error) {
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, err
+	}
+	graph := make(map[string][]string, len(cfg.Group))
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group := cfg.Group[id]
+		targets := []string{}
+		for _, target := range merge(group.DirenvSupport, nil) {
+			if _, ok := cfg.Group[target]; !ok {
+				return nil, withHint(fmt.Errorf("failed to validate: group.%s: invalid id: %s", id, target),
+					"remove %s from group.%s.direnv or add group.%s to the configuration", target, id, target)
+			}
+			targets = append(targets, target)
+		}
+		slices.Sort(targets)
+		graph[id] = targets
+	}
+	return graph, nil
+}
+
+// DirenvCycles returns the cycles in the direnv references between groups, such as
+// [api ui api] where the .envrc files of api and ui load the env files of each other.
+// Each cycle starts and ends with its smallest group id, and the cycles are sorted.
+// A group referencing itself is not a cycle.
+func (cfg *Config) DirenvCycles() ([][]string, error) {
+	graph, err := cfg.DirenvGraph()
+	if err != nil {
+		return nil, err
+	}
+	cycles := [][]string{}
+	for _, start := range slices.Sorted(maps.Keys(graph)) {
+		// Walk only the groups greater than the start so that each cycle is found once
+		var walk func(path []string)
+		walk = func(path []string) {
+			for _, next := range graph[path[len(path)-1]] {
+				switch {
+				case next == start && len(path) > 1:
+					cycles = append(cycles, append(slices.Clone(path), start))
+				case next > start && !slices.Contains(path, next):
+					walk(append(path, next))
+				}
+			}
+		}
+		walk([]string{start})
+	}
+	return cycles, nil
+}
+
+// GroupsFor returns the sorted ids of the groups to which the key of the central env
+// is delivered by their prefix, replace or plain, without reading the central env.
+// If no group claims the key, the catch-all group receives it if any.
+// It returns an empty slice if the key is delivered to no group.
+func (cfg *Config) GroupsFor(key string) []string {
+	ids := cfg.matchGroups(key)
+	if len(ids) > 0 {
+		return ids
+	}
+	for id, group := range cfg.Group {
+		if group.CatchAll {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Run reads the central environment and divides and distributes it
+// to each group based on the configuration file. If necessary,
+// it also checks if the environment variable values are empty.
+func (cfg *Config) Run() (string, error) {
+	report, err := cfg.RunWithReport()
+	if err != nil {
+		return "", err
+	}
+	return report.Path, nil
+}
+
+// RunWithReport performs Run and returns its result as a RunReport, such as to print
+// a reliable post-run summary without scraping the messages. The unchanged groups
+// skipped by Run are not reported.
+func (cfg *Config) RunWithReport() (*RunReport, error) {
+	ctx := context.Background()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+	report, err := cfg.run(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("failed to run: timed out after %s: %w", cfg.timeout, err)
+	}
+	return report, err
+}
+
+// run performs Run under the specified context.
+func (cfg *Config) run(ctx context.Context) (*RunReport, error) {
+	ctx = withFetched(ctx)
+	start := time.Now()
+	stage, path, e, _, err := cfg.readCentralEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timings := []timingEvent{{Event: "timing", Phase: "read", Duration: time.Since(start).String()}}
+	var write time.Duration
+	if err := cfg.validateDuplicateKeyPolicy(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateOutputFormat(); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkDuplicateKeys(stage, e, false); err != nil {
+		return nil, err
+	}
+	ids, err := cfg.selectGroups()
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string]string
+	if cfg.onlyChanged {
+		if stored, err = cfg.loadHashes(); err != nil {
+			return nil, err
+		}
+	}
+	storeHash := cfg.storeHash || cfg.onlyChanged
+	distributed := make([]distributedEvent, 0, len(ids))
+	reports := make([]GroupReport, 0, len(ids))
+	unchanged := []string{}
+	skipped := []string{}
+	delivered := make(map[string]map[string]string, len(ids))
+	hashes := make(map[string]string, len(ids)+1)
+	errs := []error{}
+	keys, empty := 0, 0
+	if cfg.outputFormat == OutputJSON {
+		cfg.emit(stagedEvent{Event: "staged", Stage: stage, Path: path})
+	} else {
+		_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("staged:"), stage, gray("->"), path)
+	}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if o, ok := cfg.unchanged(stage, id, e, stored); ok {
+			delivered[id] = o
+			unchanged = append(unchanged, id)
+			if storeHash {
+				b := &bytes.Buffer{}
+				cfg.renderEnv(b, o)
+				hashes[groupHashKey(id)] = hashOf(b.Bytes())
+			}
+			continue
+		}
+		groupStart := time.Now()
+		target, o, created, err := cfg.distribute(ctx, stage, id, e)
+		elapsed := time.Since(groupStart)
+		write += elapsed
+		timings = append(timings, timingEvent{Event: "timing", Phase: "group." + id, Duration: elapsed.String()})
+		if errors.Is(err, errSkipped) {
+			skipped = append(skipped, id)
+			continue
+		}
+		if err != nil {
+			if !cfg.continueOnError {
+				return nil, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		delivered[id] = o
+		keys += len(o)
+		for _, v := range o {
+			if isEmptyValue(v) {
+				empty++
+			}
+		}
+		if storeHash {
+			b := &bytes.Buffer{}
+			cfg.renderEnv(b, o)
+			hashes[groupHashKey(id)] = hashOf(b.Bytes())
+		}
+		distributed = append(distributed, distributedEvent{Event: "distributed", Group: id, Target: target})
+		reports = append(reports, GroupReport{Group: id, Target: target, KeyCount: len(o), Created: created})
+	}
+	if storeHash {
+		b, _, err := cfg.readCentral(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read central env: %w", err)
+		}
+		hashes[centralHashKey] = hashOf(b)
+		if err := cfg.storeHashes(hashes); err != nil {
+			return nil, fmt.Errorf("failed to store hashes: %w", err)
+		}
+	}
+	slices.SortFunc(distributed, func(a, b distributedEvent) int {
+		return strings.Compare(a.Group, b.Group)
+	})
+	slices.SortFunc(reports, func(a, b GroupReport) int {
+		return strings.Compare(a.Group, b.Group)
+	})
+	for _, d := range distributed {
+		if cfg.outputFormat == OutputJSON {
+			cfg.emit(d)
+		} else {
+			_, _ = fmt.Fprintf(cfg.w, "%s group.%s %s %s\n", gray("distributed:"), d.Group, gray("->"), d.Target)
+		}
+	}
+	slices.Sort(unchanged)
+	for _, id := range unchanged {
+		if cfg.outputFormat == OutputJSON {
+			cfg.emit(unchangedEvent{Event: "unchanged", Group: id})
+		} else {
+			_, _ = fmt.Fprintf(cfg.w, "%s group.%s\n", gray("unchanged:"), id)
+		}
+	}
+	slices.Sort(skipped)
+	for _, id := range skipped {
+		if cfg.outputFormat == OutputJSON {
+			cfg.emit(skippedEvent{Event: "skipped", Group: id})
+		} else {
+			cfg.noteSkipped("", id)
+		}
+	}
+	if cfg.incremental {
+		cfg.deliveredStage, cfg.delivered = stage, delivered
+	}
+	if cfg.outputFormat == OutputJSON {
+		cfg.emit(summaryEvent{Event: "summary", Groups: len(distributed), Keys: keys, Empty: empty})
+	} else {
+		_, _ = fmt.Fprintf(cfg.w, "%s distributed %d groups, %d keys, %d empty\n", gray("summary:"), len(distributed), keys, empty)
+	}
+	// Surface the dead variables as a passive stat, which never fails the run
+	if n := len(cfg.orphanKeys(e)); n > 0 {
+		if cfg.outputFormat == OutputJSON {
+			cfg.emit(orphansEvent{Event: "orphans", Count: n})
+		} else {
+			_, _ = fmt.Fprintf(cfg.w, "%s %d keys not delivered to any group, see lem orphans\n", gray("orphans:"), n)
+		}
+	}
+	if cfg.timing {
+		timings = append(timings,
+			timingEvent{Event: "timing", Phase: "write", Duration: write.String()},
+			timingEvent{Event: "timing", Phase: "total", Duration: time.Since(start).String()},
+		)
+		for _, t := range timings {
+			if cfg.outputFormat == OutputJSON {
+				cfg.emit(t)
+			} else {
+				_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("timing:"), t.Phase, gray("->"), t.Duration)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &RunReport{Stage: stage, Path: path, Groups: reports}, nil
+}
+
+// unchanged reports whether the env of the group made from the central env is the same
+// as the one written by the previous Run of the stage if incremental, or has the stored
+// hash with its env files still matching it if only changed, and returns it if so.
+// It reports false otherwise, so that the group is distributed.
+func (cfg *Config) unchanged(stage, id string, e map[string]string, stored map[string]string) (map[string]string, bool) {
+	group, _ := cfg.groupOf(stage, id)
+	if cfg.incremental && cfg.deliveredStage == stage {
+		prev, ok := cfg.delivered[id]
+		if ok && maps.Equal(prev, cfg.makeEnv(group, e)) {
+			return prev, true
+		}
+		return nil, false
+	}
+	hash, ok := stored[groupHashKey(id)]
+	if !cfg.onlyChanged || !ok {
+		return nil, false
+	}
+	o := cfg.makeEnv(group, e)
+	b := &bytes.Buffer{}
+	cfg.renderEnv(b, o)
+	if hashOf(b.Bytes()) != hash {
+		return nil, false
+	}
+	dir, err := cfg.validateGroupPair(id, group)
+	if err != nil {
+		return nil, false
+	}
+	out, err := cfg.outputDir(stage, dir)
+	if err != nil {
+		return nil, false
+	}
+	for _, file := range group.files() {
+		data, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(file)))
+		if err != nil || hashOf(data) != hash {
+			return nil, false
+		}
+	}
+	return o, true
+}
+
+// Promote reads the central env of the from stage and distributes it to the groups
+// with the dirs and overrides of the to stage, such as to stage the prod distribution
+// from the dev values. The stored current stage is neither used nor changed, so the
+// next Run distributes the central env of the current stage again, overwriting the
+// promoted files if the current stage delivers to the same dirs.
+// ${LEM_STAGE} is replaced with the name of the to stage that the files are delivered for.
+// The env path is rejected, since it overrides the central env of the current stage only.
+func (cfg *Config) Promote(from, to string) error {
+	ctx := context.Background()
+	if cfg.envPath != "" {
+		return fmt.Errorf("failed to promote: env path cannot be used, since it overrides the current stage only: %s", cfg.envPath)
+	}
+	if err := cfg.validateStageTable(); err != nil {
+		return err
+	}
+	path, err := cfg.validateStagePair(from)
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Stage[to]; !ok {
+		return fmt.Errorf("failed to validate stage: %s: not set in %s", to, cfg.path)
+	}
+	e, _, err := cfg.readStageEnv(ctx, to, path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validateDuplicateKeyPolicy(); err != nil {
+		return err
+	}
+	if err := cfg.checkDuplicateKeys(from, e, false); err != nil {
+		return err
+	}
+	ids, err := cfg.selectGroups()
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("promoting:"), from, gray("->"), to)
+	for _, id := range ids {
+		target, _, _, err := cfg.distribute(ctx, to, id, e)
+		if errors.Is(err, errSkipped) {
+			cfg.noteSkipped("", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(cfg.w, "%s group.%s %s %s\n", gray("distributed:"), id, gray("->"), target)
+	}
+	return nil
+}
+
+// distribute writes the env file of the specified group from the central env
+// and returns the path to the env file and the environment variables written,
+// and whether the env file was created rather than overwritten.
+func (cfg *Config) distribute(ctx context.Context, stage, id string, e map[string]string) (string, map[string]string, bool, error) {
+	// Apply the overrides for the current stage
+	group, _ := cfg.groupOf(stage, id)
+	dir, err := cfg.validateGroupPair(id, group)
+	if err != nil {
+		return "", nil, false, err
+	}
+	// Collect prefix matching entries from the central env to the group
+	// Some entries are added with group prefixes based on configuration
+	o := cfg.makeEnv(group, e)
+	// Check for empty values if specified
+	if err := checkEmpty(group, o); err != nil {
+		return "", nil, false, fmt.Errorf("failed to validate: %w", err)
+	}
+	// Check the env against the schema if specified
+	if err := cfg.checkSchema(id, group, o); err != nil {
+		return "", nil, false, err
+	}
+	// Create .envrc file if specified
+	if len(group.DirenvSupport) != 0 {
+		if _, err := cfg.createEnvrc(stage, group, dir); err != nil {
+			return "", nil, false, fmt.Errorf("failed to create .envrc for group.%s: %w", id, err)
+		}
+	}
+	// Write the environment variables to the group's env file
+	out, err := cfg.outputDir(stage, dir)
+	if err != nil {
+		return "", nil, false, err
+	}
+	targets := make([]string, 0, len(group.files()))
+	created := false
+	for i, file := range group.files() {
+		target := filepath.Join(out, filepath.FromSlash(file))
+		if i == 0 {
+			_, err := os.Stat(target)
+			created = errors.Is(err, fs.ErrNotExist)
+		}
+		if err := retry(ctx, cfg.attempts, func() error { return cfg.writeEnv(target, o) }); err != nil {
+			return "", nil, false, fmt.Errorf("failed to write env file for group.%s: %w", id, err)
+		}
+		// Run the validation command against the written env file if specified
+		if len(group.ValidateCmd) != 0 {
+			if err := cfg.runValidateCmd(ctx, group.ValidateCmd, target); err != nil {
+				return "", nil, false, fmt.Errorf("failed to validate env file for group.%s: %w", id, err)
+			}
+		}
+		targets = append(targets, target)
+	}
+	return strings.Join(targets, ", "), o, created, nil
+}
+
+// checkEmpty returns an error for the first key in sorted order with an empty value
+// in the env of the group if the group checks for empty values.
+func checkEmpty(group Group, o map[string]string) error {
+	if !group.IsCheck {
+		return nil
+	}
+	for _, k := range slices.Sorted(maps.Keys(o)) {
+		if isEmptyValue(o[k]) {
+			return fmt.Errorf("empty value: %s", k)
+		}
+	}
+	return nil
+}
+
+// checkSchema checks the env of the group against the schema of the group if specified,
+// and returns an error reporting all of the violations found.
+func (cfg *Config) checkSchema(id string, group Group, o map[string]string) error {
+	if group.Schema == "" {
+		return nil
+	}
+	schema, err := cfg.loadSchema(group.Schema)
+	if err != nil {
+		return fmt.Errorf("failed to validate group.%s: %w", id, err)
+	}
+	if errs := schema.check(o); len(errs) > 0 {
+		return fmt.Errorf("failed to validate group.%s against schema: %w", id, errors.Join(errs...))
+	}
+	return nil
+}
+
+// loadSchema reads the JSON schema file and compiles the patterns in it.
+// The path is resolved relative to the configuration file and confined to the project root.
+func (cfg *Config) loadSchema(path string) (*envSchema, error) {
+	absPath, isDir, err := cfg.resolvePath(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema: %w", err)
+	}
+	if isDir {
+		return nil, fmt.Errorf("failed to load schema: is a directory: %s", absPath)
+	}
+	b, err := os.ReadFile(filepath.Clean(absPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema: %w", err)
+	}
+	schema := &envSchema{}
+	if err := json.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %s: %w", absPath, err)
+	}
+	for k, p := range schema.Properties {
+		if p.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema pattern: %s: %w", k, err)
+		}
+		p.pattern = re
+		schema.Properties[k] = p
+	}
+	return schema, nil
+}
+
+// check returns the violations of the env against the schema, the missing required keys
+// first in the order of the schema, and then the others sorted by key. Values are compared without their surrounding quotes.
+func (schema *envSchema) check(o map[string]string) []error {
+	errs := []error{}
+	for _, k := range schema.Required {
+		if _, ok := o[k]; !ok {
+			errs = append(errs, fmt.Errorf("%s: required key missing", k))
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(o)) {
+		v := normalizeValue(o[k])
+		p, ok := schema.Properties[k]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				errs = append(errs, fmt.Errorf("%s: key not allowed", k))
+			}
+			continue
+		}
+		if len(p.Enum) != 0 && !slices.ContainsFunc(p.Enum, func(e any) bool { return fmt.Sprint(e) == v }) {
+			errs = append(errs, fmt.Errorf("%s: value not in enum: %s", k, v))
+		}
+		if p.pattern != nil && !p.pattern.MatchString(v) {
+			errs = append(errs, fmt.Errorf("%s: value does not match pattern %s: %s", k, p.Pattern, v))
+		}
+	}
+	return errs
+}
+
+// runValidateCmd runs the validation command with the path of the env file appended
+// as the last argument. The command runs in the configuration file directory, and its
+// output is streamed to the writer. A non-zero exit status is reported as an error.
+func (cfg *Config) runValidateCmd(ctx context.Context, args []string, target string) error {
+	cmd := exec.CommandContext(ctx, args[0], append(slices.Clone(args[1:]), target)...)
+	cmd.Dir = cfg.dir
+	cmd.Stdout = cfg.w
+	cmd.Stderr = cfg.w
+	return cmd.Run()
+}
+
+// Reconcile compares the env files on disk of each group with the central env of the
+// current stage key by key, and returns the keys to be delivered that are missing from
+// them or have different values, by group id. Unlike Check, which compares the whole
+// content, it reports the discrepancies of each key for a human-readable report, and
+// ignores the keys in the env files that are not delivered by lem.
+// Missing env files report all of their keys as missing.
+func (cfg *Config) Reconcile() (map[string]Reconciliation, error) {
+	stage, _, e, _, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]Reconciliation, len(cfg.Group))
+	for id := range cfg.Group {
+		group, _ := cfg.groupOf(stage, id)
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		o := cfg.makeEnv(group, e)
+		out, err := cfg.outputDir(stage, dir)
+		if err != nil {
+			return nil, err
+		}
+		missing, stale := map[string]bool{}, map[string]bool{}
+		for _, file := range group.files() {
+			actual, err := cfg.readDelivered(filepath.Join(out, filepath.FromSlash(file)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read env file for group.%s: %w", id, err)
+			}
+			for k, v := range o {
+				a, ok := actual[k]
+				switch {
+				case !ok:
+					missing[k] = true
+				case a != v:
+					stale[k] = true
+				}
+			}
+		}
+		result[id] = Reconciliation{
+			Missing: slices.Sorted(maps.Keys(missing)),
+			Stale:   slices.Sorted(maps.Keys(stale)),
+		}
+	}
+	return result, nil
+}
+
+// Audit stats the env files of each group for the current stage and returns their
+// modes sorted by group, such as to verify the permissions of the delivered
+// secrets after Run. The env files that do not exist are not returned.
+func (cfg *Config) Audit() ([]FileAudit, error) {
+	stage, _, err := cfg.currentStage()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, err
+	}
+	audits := []FileAudit{}
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group, _ := cfg.groupOf(stage, id)
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out, err := cfg.outputDir(stage, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range group.files() {
+			target := filepath.Join(out, filepath.FromSlash(file))
+			info, err := os.Stat(target)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return nil, fmt.Errorf("failed to stat env file for group.%s: %w", id, err)
+			}
+			audits = append(audits, FileAudit{Group: id, Path: target, Mode: info.Mode()})
+		}
+	}
+	return audits, nil
+}
+
+// PruneBackups removes the backups of the env files of each group for the current stage,
+// keeping the newest keep of them for each env file, and returns the removed paths sorted.
+// Only the backups written by Run with WithBackup are taken, named after the env file with
+// the timestamp in the exact layout and the .bak extension, so that the files not owned by
+// lem, such as .env.bak, are never removed. In dry run, the paths are returned without
+// removing them.
+func (cfg *Config) PruneBackups(keep int) ([]string, error) {
+	if keep < 0 {
+		return nil, fmt.Errorf("invalid keep: %d: must not be negative", keep)
+	}
+	stage, _, err := cfg.currentStage()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	seen := map[string]bool{}
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group, _ := cfg.groupOf(stage, id)
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out, err := cfg.outputDir(stage, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range group.files() {
+			target := filepath.Join(out, filepath.FromSlash(file))
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			backups, err := findBackups(target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find backups for group.%s: %w", id, err)
+			}
+			for _, backup := range backups[min(keep, len(backups)):] {
+				if cfg.dryRun {
+					removed = append(removed, backup)
+					continue
+				}
+				if err := os.Remove(backup); err != nil {
+					return nil, fmt.Errorf("failed to remove backup for group.%s: %w", id, err)
+				}
+				removed = append(removed, backup)
+			}
+		}
+	}
+	slices.Sort(removed)
+	return removed, nil
+}
+
+// findBackups returns the backups of the file at path from the newest to the oldest,
+// ordered by the timestamp in their names rather than the modification time.
+func findBackups(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	base := filepath.Base(path)
+	paths := []string{}
+	for _, entry := range entries {
+		if name := entry.Name(); entry.Type().IsRegular() && isBackupOf(name, base) {
+			paths = append(paths, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	slices.Sort(paths)
+	slices.Reverse(paths)
+	return paths, nil
+}
+
+// isBackupOf reports whether name is the backup of the file named base written by Run,
+// with the timestamp in the layout of backups between them. Other files sharing the prefix,
+// such as .env.bak or .env.local.bak for .env, are not taken.
+func isBackupOf(name, base string) bool {
+	rest, ok := strings.CutPrefix(name, base+".")
+	if !ok {
+		return false
+	}
+	stamp, ok := strings.CutSuffix(rest, backupExt)
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(backupLayout, stamp)
+	return err == nil
+}
+
+// Check verifies that the env files of each group are up to date with the
+// central env of the current stage without modifying any files.
+// The .envrc files of the groups with direnv support are compared with the content
+// that Run would generate as well, such as after the group dirs are moved.
+// It returns an error listing the drifted groups and .envrc files if any differ.
+func (cfg *Config) Check() error {
+	stage, _, e, _, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return err
+	}
+	drifted := make([]string, 0, len(cfg.Group))
+	for id := range cfg.Group {
+		group, _ := cfg.groupOf(stage, id)
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		o := cfg.makeEnv(group, e)
+		out, err := cfg.outputDir(stage, dir)
+		if err != nil {
+			return err
+		}
+		b := &bytes.Buffer{}
+		cfg.renderEnv(b, o)
+		for _, file := range group.files() {
+			actual, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(file)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to read env file for group.%s: %w", id, err)
+			}
+			if !bytes.Equal(actual, b.Bytes()) {
+				drifted = append(drifted, "group."+id)
+				break
+			}
+		}
+		// Check the .envrc file too, whose paths go stale when the group dirs change
+		if len(group.DirenvSupport) == 0 {
+			continue
+		}
+		expected, err := cfg.renderEnvrc(stage, group, dir)
+		if err != nil {
+			return fmt.Errorf("failed to render .envrc for group.%s: %w", id, err)
+		}
+		actual, err := os.ReadFile(filepath.Join(out, ".envrc"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to read .envrc file for group.%s: %w", id, err)
+		}
+		if string(actual) != expected {
+			drifted = append(drifted, "group."+id+"/.envrc")
+		}
+	}
+	if len(drifted) > 0 {
+		slices.Sort(drifted)
+		return fmt.Errorf("failed to check: drifted: %s", strings.Join(drifted, ", "))
+	}
+	_, _ = fmt.Fprintln(cfg.w, green("no drift detected!"))
+	return nil
+}
+
+// Freshness compares the modification time of the env file of each group with
+// that of the central env of the current stage. It returns true for the groups
+// whose env file is older than the central env or does not exist (stale).
+// If the hashes stored by Run with WithStoreHash are present for the group, the group
+// is stale instead if either the central env or its env file differs from them.
+func (cfg *Config) Freshness() (map[string]bool, error) {
+	stage, path, err := cfg.currentStage()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, err
+	}
+	b, modTime, err := cfg.readCentral(context.Background(), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read central env: %w", err)
+	}
+	hashes, err := cfg.loadHashes()
+	if err != nil {
+		return nil, err
+	}
+	var central string
+	if len(hashes) != 0 {
+		central = hashOf(b)
+	}
+	stale := make(map[string]bool, len(cfg.Group))
+	for id := range cfg.Group {
+		group, _ := cfg.groupOf(stage, id)
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out, err := cfg.outputDir(stage, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range group.files() {
+			target := filepath.Join(out, filepath.FromSlash(file))
+			targetInfo, err := os.Stat(target)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("failed to stat env file for group.%s: %w", id, err)
+				}
+				stale[id] = true
+				break
+			}
+			if stored, ok := hashes[groupHashKey(id)]; ok && hashes[centralHashKey] != "" {
+				b, err := os.ReadFile(filepath.Clean(target))
+				if err != nil {
+					return nil, fmt.Errorf("failed to read env file for group.%s: %w", id, err)
+				}
+				stale[id] = central != hashes[centralHashKey] || hashOf(b) != stored
+			} else {
+				stale[id] = targetInfo.ModTime().Before(modTime)
+			}
+			if stale[id] {
+				break
+			}
+		}
+	}
+	return stale, nil
+}
+
+// Print renders the env file content of the specified group for the current
+// stage to the writer instead of writing it to the group directory.
+// The output is exactly what Run would write to the group's .env file.
+func (cfg *Config) Print(id string) error {
+	stage, _, e, _, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return err
+	}
+	group, ok := cfg.groupOf(stage, id)
+	if !ok {
+		return fmt.Errorf("failed to validate group: %s: not set in %s", id, cfg.path)
+	}
+	if _, err := cfg.validateGroupPair(id, group); err != nil {
+		return err
+	}
+	o := cfg.makeEnv(group, e)
+	w := bufio.NewWriter(cfg.w)
+	cfg.renderEnv(w, o)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to print env for group.%s: %w", id, err)
+	}
+	return nil
+}
+
+// RenderAll renders the env file content of each group for the current stage
+// without writing it. The returned bytes are exactly what Run would write to
+// the group's env file, so that callers can persist or route them as they like.
+func (cfg *Config) RenderAll() (map[string][]byte, error) {
+	stage, _, e, _, err := cfg.readCentralEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ids, err := cfg.selectGroups()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(ids))
+	for _, id := range ids {
+		group, _ := cfg.groupOf(stage, id)
+		_, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		o := cfg.makeEnv(group, e)
+		b := &bytes.Buffer{}
+		cfg.renderEnv(b, o)
+		out[id] = b.Bytes()
+	}
+	return out, nil
+}
+
+// RunCombined renders the env file content of all groups for the current stage into the
+// writer as one stream, each group preceded by a # group.<id> header and separated by
+// a blank line, without writing to the group directories. It is a review and debug
+// artifact showing everything Run would distribute at once.
+func (cfg *Config) RunCombined(w io.Writer) error {
+	out, err := cfg.RenderAll()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for i, id := range slices.Sorted(maps.Keys(out)) {
+		if i > 0 {
+			_, _ = bw.WriteString("\n")
+		}
+		_, _ = fmt.Fprintf(bw, "# group.%s\n", id)
+		_, _ = bw.Write(out[id])
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to print combined env: %w", err)
+	}
+	return nil
+}
+
+// Import reads the existing env file of each group and writes a proposed central env
+// merged from them to the writer, such as to adopt lem in a repository that already has
+// group env files. If prefixFromGroup is true, the keys are prefixed with the prefix of
+// their group unless they already have it or are listed in plain, reversing makeEnv.
+// Missing env files are skipped. Keys with different values in more than one group are
+// returned as conflicts, and the value of the first group in id order is kept. So are the
+// keys of a group mapped to the same key with different values, keeping the first in
+// key order. The stage placeholder in group dirs is expanded for the stored stage, if any.
+func (cfg *Config) Import(w io.Writer, prefixFromGroup bool) ([]ImportConflict, error) {
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateSeparator(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateFormat(); err != nil {
+		return nil, err
+	}
+	sep := cfg.separator()
+	e := make(map[string]string, cfg.size)
+	owners := map[string]string{}
+	conflicts := map[string][]string{}
+	collisions := []ImportConflict{}
+	// The group env files are read with a copy, so that their order and metadata
+	// do not replace those of the central env
+	reader := *cfg
+	// Templated group dirs are read for the stored stage, if any
+	stage, _ := cfg.loadStoredStage()
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group := cfg.Group[id]
+		if stage != "" {
+			group.Dir = expandStage(group.Dir, stage)
+		}
+		dir, err := cfg.validateGroupPair(id, group)
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		o, _, err := reader.readEnv(context.Background(), filepath.Join(dir, filepath.FromSlash(group.files()[0])))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file for group.%s: %w", id, err)
+		}
+		sources := map[string]string{}
+		colliding := map[string][]string{}
+		for _, key := range slices.Sorted(maps.Keys(o)) {
+			k, v := key, o[key]
+			if prefixFromGroup && !strings.HasPrefix(k, group.Prefix+sep) && !slices.Contains(group.Plain, k) {
+				k = group.Prefix + sep + k
+			}
+			if source, ok := sources[k]; ok {
+				if o[source] != v {
+					if len(colliding[k]) == 0 {
+						colliding[k] = []string{source}
+					}
+					colliding[k] = append(colliding[k], key)
+				}
+				continue
+			}
+			sources[k] = key
+			prev, ok := e[k]
+			if !ok {
+				e[k] = v
+				owners[k] = id
+				continue
+			}
+			if prev == v || slices.Contains(conflicts[k], id) {
+				continue
+			}
+			if len(conflicts[k]) == 0 {
+				conflicts[k] = []string{owners[k]}
+			}
+			conflicts[k] = append(conflicts[k], id)
+		}
+		for _, k := range slices.Sorted(maps.Keys(colliding)) {
+			collisions = append(collisions, ImportConflict{Key: k, Groups: []string{id}, Keys: colliding[k]})
+		}
+	}
+	// The proposal is a central env written with "=" regardless of the output separator,
+	// and without the order of the group env files, which is meaningless for it
+	cfg.render(w, e, defaultKVSeparator, nil)
+	out := make([]ImportConflict, 0, len(conflicts)+len(collisions))
+	for _, k := range slices.Sorted(maps.Keys(conflicts)) {
+		out = append(out, ImportConflict{Key: k, Groups: conflicts[k]})
+	}
+	out = append(out, collisions...)
+	slices.SortStableFunc(out, func(a, b ImportConflict) int { return strings.Compare(a.Key, b.Key) })
+	return out, nil
+}
+
+// DiffConfig loads the configuration files a and b and reports the differences
+// in their stage and group tables from a to b.
+func DiffConfig(a, b string) ([]ConfigDiff, error) {
+	cfgA, err := Load(a)
+	if err != nil {
+		return nil, err
+	}
+	cfgB, err := Load(b)
+	if err != nil {
+		return nil, err
+	}
+	return cfgA.Diff(cfgB), nil
+}
+
+// Diff reports the stages and groups added, removed or changed from the configuration
+// to the other one, sorted by table and id. Groups are compared after resolving extends,
+// so that only the effective differences are reported.
+func (cfg *Config) Diff(other *Config) []ConfigDiff {
+	diffs := diffTable("group", cfg.Group, other.Group)
+	diffs = append(diffs, diffTable("stage", cfg.Stage, other.Stage)...)
+	return diffs
+}
+
+// diffTable reports the entries added, removed or changed from a to b in the table.
+func diffTable[T any](table string, a, b map[string]T) []ConfigDiff {
+	diffs := []ConfigDiff{}
+	ids := merge(slices.Sorted(maps.Keys(a)), slices.Sorted(maps.Keys(b)))
+	slices.Sort(ids)
+	for _, id := range ids {
+		va, inA := a[id]
+		vb, inB := b[id]
+		switch {
+		case !inA:
+			diffs = append(diffs, ConfigDiff{Table: table, ID: id, Change: "added"})
+		case !inB:
+			diffs = append(diffs, ConfigDiff{Table: table, ID: id, Change: "removed"})
+		default:
+			if fields := diffFields(va, vb); len(fields) > 0 {
+				diffs = append(diffs, ConfigDiff{Table: table, ID: id, Change: "changed", Fields: fields})
+			}
+		}
+	}
+	return diffs
+}
+
+// diffFields returns the toml keys of the struct fields whose values differ between a and b.
+func diffFields(a, b any) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	fields := []string{}
+	for i := range va.NumField() {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, va.Type().Field(i).Tag.Get("toml"))
+		}
+	}
+	return fields
+}
+
+// Watch watches for changes in the env file for the specified
+// stage and executes the run command when a change is detected.
+// Monitoring continues as long as it is not interrupted.
+// If incremental, each rerun rewrites only the groups whose env changed.
+func (cfg *Config) Watch() (string, error) {
+	if _, path, err := cfg.currentStage(); err == nil && isURL(path) {
+		return "", fmt.Errorf("failed to watch: %s: a URL stage cannot be watched for changes; use run instead", path)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return "", fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer func() {
+		if closeErr := watcher.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close watcher: %w", closeErr))
+		}
+	}()
+	stagePath, err := cfg.Run()
+	if err != nil {
+		return "", err
+	}
+	// A directory stage is watched itself for changes in its *.env files
+	dir := filepath.Dir(stagePath)
+	isDirStage := false
+	if info, err := os.Stat(stagePath); err == nil && info.IsDir() {
+		dir, isDirStage = stagePath, true
+	}
+	if err := watcher.Add(dir); err != nil {
+		return "", fmt.Errorf("failed to add dir to watcher: %w", err)
+	}
+	done := make(chan error)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				var (
+					isTarget      = event.Name == stagePath
+					isCreateEvent = event.Op&fsnotify.Create == fsnotify.Create
+					isWriteEvent  = event.Op&fsnotify.Write == fsnotify.Write
+					isRemoveEvent = event.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+				)
+				if isDirStage {
+					isTarget = filepath.Ext(event.Name) == ".env"
+					isWriteEvent = isWriteEvent || isRemoveEvent
+				}
+				if isTarget && (isWriteEvent || isCreateEvent) {
+					if cfg.outputFormat == OutputJSON {
+						cfg.emit(rerunEvent{Event: "rerun"})
+					} else {
+						_, _ = fmt.Fprintln(cfg.w, cyan("rerun..."))
+					}
+					if _, err := cfg.Run(); err != nil {
+						done <- err
+						return
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
 				}
+				done <- err
+				return
 			}
 		}
-		for _, key := range group.Plain {
-			if v, ok := e[key]; ok {
-				entries = append(entries, Entry{
-					Group:  name,
-					Prefix: group.Prefix,
-					Type:   "plain",
-					Name:   key,
-					Value:  v,
-				})
+	}()
+	if err := <-done; err != nil {
+		return "", err
+	}
+	return stagePath, err
+}
+
+// readCentralEnv loads the current stage and reads its central env.
+// It returns the stage, the path to the central env, its entries and the number of entries.
+func (cfg *Config) readCentralEnv(ctx context.Context) (string, string, map[string]string, int, error) {
+	stage, path, err := cfg.currentStage()
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+	e, n, err := cfg.readStageEnv(ctx, stage, path)
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+	return stage, path, e, n, nil
+}
+
+// readStageEnv validates the settings used for reading and writing env files, and reads
+// the central env of the stage at the path with the keys from the environment overlaid onto it.
+// The references to the stage variable in the central env are resolved to the stage.
+func (cfg *Config) readStageEnv(ctx context.Context, stage, path string) (map[string]string, int, error) {
+	if err := cfg.validateGroupTable(); err != nil {
+		return nil, 0, err
+	}
+	if err := cfg.validateSeparator(); err != nil {
+		return nil, 0, err
+	}
+	if err := cfg.validateFormat(); err != nil {
+		return nil, 0, err
+	}
+	if err := cfg.validateLineEnding(); err != nil {
+		return nil, 0, err
+	}
+	e, n, err := cfg.readEnv(ctx, path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read central env: %w", err)
+	}
+	interpolateStage(e, stage)
+	n, err = cfg.overlayFromEnv(e, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	n = cfg.overlayOverrides(e, n)
+	if err := cfg.validateMeta(); err != nil {
+		return nil, 0, err
+	}
+	return e, n, nil
+}
+
+// interpolateStage replaces ${LEM_STAGE} in the values of the env with the name of the stage,
+// such as API_ENV_NAME=${LEM_STAGE}. Unlike the environment, the variable is provided by lem,
+// so it is resolved even if LEM_STAGE is set in the environment or the env itself.
+func interpolateStage(e map[string]string, stage string) {
+	ref := "${" + stageVariable + "}"
+	for k, v := range e {
+		if strings.Contains(v, ref) {
+			e[k] = strings.ReplaceAll(v, ref, stage)
+		}
+	}
+}
+
+// validateMeta checks if the groups named by the directives of the last env read are set.
+func (cfg *Config) validateMeta() error {
+	for _, k := range slices.Sorted(maps.Keys(cfg.meta)) {
+		for _, id := range cfg.meta[k].groups {
+			if _, ok := cfg.Group[id]; !ok {
+				return withHint(fmt.Errorf("failed to validate directive: %s: group.%s not set in %s", k, id, cfg.path),
+					"fix the group id in the # lem: directive of %s or add [group.%s]", k, id)
 			}
 		}
 	}
-	slices.SortFunc(entries, func(a, b Entry) int {
-		if a.Group != b.Group {
-			return strings.Compare(a.Group, b.Group)
+	return nil
+}
+
+// overlayFromEnv overlays the values of the keys listed in FromEnv taken from the
+// environment onto the central env, and returns the updated number of entries.
+// The listed keys are required, so it fails if any of them is not set.
+func (cfg *Config) overlayFromEnv(e map[string]string, n int) (int, error) {
+	missing := []string{}
+	for _, key := range cfg.FromEnv {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			missing = append(missing, key)
+			continue
 		}
-		if a.Type != b.Type {
-			return strings.Compare(a.Type, b.Type)
+		if _, ok := e[key]; !ok {
+			n++
 		}
-		return strings.Compare(a.Name, b.Name)
-	})
-	return entries, nil
+		e[key] = v
+	}
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("failed to read from env: not set in the environment: %s", strings.Join(missing, ", "))
+	}
+	return n, nil
 }
 
-// Run reads the central environment and divides and distributes it
-// to each group based on the configuration file. If necessary,
-// it also checks if the environment variable values are empty.
-func (cfg *Config) Run() (string, error) {
+// overlayOverrides overlays the values of the LEM_OVERRIDE_<KEY> environment variables
+// onto the central env if enabled, and returns the updated number of entries.
+// The added keys follow the keys of the central env in the source order.
+func (cfg *Config) overlayOverrides(e map[string]string, n int) int {
+	if !cfg.envOverrides {
+		return n
+	}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		key, ok := strings.CutPrefix(k, envOverridePrefix)
+		if !ok || key == "" {
+			continue
+		}
+		if _, ok := e[key]; !ok {
+			n++
+			if cfg.order != nil {
+				cfg.order[key] = len(cfg.order)
+			}
+		}
+		e[key] = v
+	}
+	return n
+}
+
+// currentStage loads the current stage and returns it with the path to its central env.
+// If the env path is overridden, it is returned instead of the path of the stage.
+func (cfg *Config) currentStage() (string, string, error) {
 	if err := cfg.validateStageTable(); err != nil {
-		return "", err
+		return "", "", err
 	}
 	stage, err := cfg.loadStage()
 	if err != nil {
-		return "", fmt.Errorf("failed to load stage: %w", err)
+		return "", "", fmt.Errorf("failed to load stage: %w", err)
+	}
+	if cfg.envPath != "" {
+		if _, ok := cfg.Stage[stage]; !ok {
+			return "", "", fmt.Errorf("failed to validate stage: %s: not set in %s", stage, cfg.path)
+		}
+		path, err := cfg.validateEnvPath()
+		if err != nil {
+			return "", "", err
+		}
+		return stage, path, nil
 	}
 	path, err := cfg.validateStagePair(stage)
 	if err != nil {
+		return "", "", err
+	}
+	return stage, path, nil
+}
+
+// validateStageTable checks if the stage table is set in the configuration.
+func (cfg *Config) validateStageTable() error {
+	if len(cfg.Stage) == 0 {
+		return withHint(fmt.Errorf("failed to validate stage: stage not set in %s", cfg.path),
+			"add a stage table such as [stage] default = \"./.env\"")
+	}
+	return nil
+}
+
+// validateStagePair checks if the stage is set in the configuration and returns its absolute path.
+func (cfg *Config) validateStagePair(stage string) (string, error) {
+	s, ok := cfg.Stage[stage]
+	if !ok {
+		return "", withHint(fmt.Errorf("failed to validate stage: %s: not set in %s", stage, cfg.path),
+			"add stage.%s to the configuration or switch to one of the stages listed by `lem stages`", stage)
+	}
+	if s.Path == "" {
+		return "", withHint(fmt.Errorf("failed to validate stage: %s: path not set in %s", stage, cfg.path),
+			"set stage.%s.path to the central env file of the stage", stage)
+	}
+	// A URL stage is fetched as is, so the filesystem checks do not apply
+	if isURL(s.Path) {
+		if err := validateURL(s.Path); err != nil {
+			return "", fmt.Errorf("failed to validate stage path: %s: %w", stage, err)
+		}
+		if s.Dir {
+			return "", fmt.Errorf("failed to validate stage path: %s: a URL cannot be a directory", stage)
+		}
+		return s.Path, nil
+	}
+	absPath, isDir, err := cfg.resolvePath(s.Path, cfg.allowExternal)
+	if err != nil {
+		err = fmt.Errorf("failed to validate stage path: %s: %w", stage, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", withHint(err, "stage.%s.path does not exist; create the file or fix the path relative to %s", stage, cfg.dir)
+		}
+		var outside *OutsideRootError
+		if errors.As(err, &outside) {
+			return "", withHint(err, "stage.%s.path is outside of the project root %s; move the file under it or use --allow-external", stage, outside.Root)
+		}
 		return "", err
 	}
-	if err := cfg.validateGroupTable(); err != nil {
-		return "", err
+	if isDir && !s.Dir {
+		return "", withHint(fmt.Errorf("failed to validate stage path: %s: is a directory", stage),
+			"stage.%s.path points to a directory; set it to the central env file in it or set stage.%s.dir = true", stage, stage)
+	}
+	if !isDir && s.Dir {
+		return "", withHint(fmt.Errorf("failed to validate stage path: %s: is not a directory", stage),
+			"stage.%s.dir is true; set stage.%s.path to the directory of the *.env files", stage, stage)
+	}
+	return absPath, nil
+}
+
+// validateEnvPath checks if the overridden env path is a file and returns its absolute path.
+func (cfg *Config) validateEnvPath() (string, error) {
+	absPath, isDir, err := cfg.resolvePath(cfg.envPath, cfg.allowExternal)
+	if err != nil {
+		return "", fmt.Errorf("failed to validate env path: %w", err)
+	}
+	if isDir {
+		return "", fmt.Errorf("failed to validate env path: %s: is a directory", cfg.envPath)
+	}
+	return absPath, nil
+}
+
+// validateSeparator checks if the separator is a single reasonable token.
+func (cfg *Config) validateSeparator() error {
+	sep := cfg.separator()
+	if len(sep) > 2 || strings.Trim(sep, separatorChars) != "" {
+		return fmt.Errorf("failed to validate separator: %q: must be 1 or 2 characters of %q in %s", sep, separatorChars, cfg.path)
+	}
+	return nil
+}
+
+// separator returns the separator between the prefix and the rest of the key.
+func (cfg *Config) separator() string {
+	if cfg.Separator == "" {
+		return defaultSeparator
+	}
+	return cfg.Separator
+}
+
+// validateDuplicateKeyPolicy checks if the duplicate key policy is valid.
+func (cfg *Config) validateDuplicateKeyPolicy() error {
+	switch cfg.dupPolicy {
+	case "", DuplicateKeyAllow, DuplicateKeyWarn, DuplicateKeyError:
+		return nil
+	default:
+		return fmt.Errorf("failed to validate duplicate key policy: %s: must be one of %s, %s, %s", cfg.dupPolicy, DuplicateKeyAllow, DuplicateKeyWarn, DuplicateKeyError)
+	}
+}
+
+// validateOutputFormat checks if the output format is valid.
+func (cfg *Config) validateOutputFormat() error {
+	switch cfg.outputFormat {
+	case "", OutputText, OutputJSON:
+		return nil
+	default:
+		return fmt.Errorf("failed to validate output format: %s: must be one of %s, %s", cfg.outputFormat, OutputText, OutputJSON)
+	}
+}
+
+// emit prints the event as a JSON object on a single line to the writer.
+func (cfg *Config) emit(event any) {
+	_ = json.NewEncoder(cfg.w).Encode(event)
+}
+
+// validateFormat checks if the dotenv format is valid.
+func (cfg *Config) validateFormat() error {
+	switch cfg.format {
+	case "", FormatRaw, FormatStrict:
+		return nil
+	default:
+		return fmt.Errorf("failed to validate format: %s: must be one of %s, %s", cfg.format, FormatRaw, FormatStrict)
+	}
+}
+
+// validateLineEnding checks if the line ending is valid.
+func (cfg *Config) validateLineEnding() error {
+	switch cfg.lineEnding {
+	case "", LineEndingLF, LineEndingCRLF:
+		return nil
+	default:
+		return fmt.Errorf("failed to validate line ending: %s: must be one of %s, %s", cfg.lineEnding, LineEndingLF, LineEndingCRLF)
+	}
+}
+
+// validateKind checks if the declared kinds are valid.
+func (cfg *Config) validateKind() error {
+	for _, key := range slices.Sorted(maps.Keys(cfg.Kind)) {
+		switch kind := cfg.Kind[key]; kind {
+		case KindString, KindInt, KindBool, KindJSON:
+		default:
+			return fmt.Errorf("failed to validate kind.%s: %s: must be one of %s, %s, %s, %s in %s", key, kind, KindString, KindInt, KindBool, KindJSON, cfg.path)
+		}
+	}
+	return nil
+}
+
+// checkNaming warns about the group prefixes and the plain and replace entries that do not
+// match the naming pattern in full, reporting all of them. It returns an error only if the
+// pattern is invalid.
+func (cfg *Config) checkNaming() error {
+	pattern := cfg.namingPattern
+	if pattern == "" {
+		pattern = defaultNamingPattern
 	}
-	e, _, err := readEnv(path, cfg.size)
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
 	if err != nil {
-		return "", fmt.Errorf("failed to read central env: %w", err)
+		return fmt.Errorf("failed to validate naming pattern: %s: %w", pattern, err)
 	}
-	msgs := make([]string, len(cfg.Group))
-	i := 0
-	_, _ = fmt.Fprintf(cfg.w, "%s %s %s %s\n", gray("staged:"), stage, gray("->"), path)
-	for id, group := range cfg.Group {
-		dir, err := cfg.validateGroupPair(id, group)
-		if err != nil {
-			return "", err
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group := cfg.Group[id]
+		type entry struct{ field, name string }
+		entries := []entry{{"prefix", group.Prefix}}
+		for _, v := range group.Plain {
+			entries = append(entries, entry{"plain", v})
 		}
-		// Collect prefix matching entries from the central env to the group
-		// Some entries are added with group prefixes based on configuration
-		o := makeEnv(group, e, cfg.size)
-		// Check for empty values if specified
-		if group.IsCheck {
-			for k, v := range o {
-				if v == "" || v == "''" || v == `""` || v == "``" {
-					return "", fmt.Errorf("failed to validate: empty value: %s", k)
-				}
-			}
+		for _, v := range group.Replaceable {
+			entries = append(entries, entry{"replace", v})
 		}
-		// Create .envrc file if specified
-		if len(group.DirenvSupport) != 0 {
-			_, err = cfg.createEnvrc(group, dir)
-			if err != nil {
-				return "", fmt.Errorf("failed to create .envrc for group.%s: %w", id, err)
+		for _, e := range entries {
+			if e.name == "" || re.MatchString(e.name) {
+				continue
 			}
+			cfg.warn(fmt.Sprintf("group.%s: %s %s does not match the naming pattern %s", id, e.field, e.name, pattern))
 		}
-		// Write the environment variables to the group's env file
-		target := filepath.Join(dir, ".env")
-		if err := writeEnv(target, o); err != nil {
-			return "", fmt.Errorf("failed to write env file for group.%s: %w", id, err)
-		}
-		msgs[i] = fmt.Sprintf("%s group.%s %s %s", gray("distributed:"), id, gray("->"), target)
-		i++
 	}
-	slices.Sort(msgs)
-	for _, msg := range msgs {
-		_, _ = fmt.Fprintln(cfg.w, msg)
+	return nil
+}
+
+// kindOf returns the kind declared for the key in the central env,
+// or the kind inferred from the value if it is not declared.
+func (cfg *Config) kindOf(key, value string) string {
+	if kind, ok := cfg.Kind[key]; ok {
+		return kind
 	}
-	return path, nil
+	return inferKind(value)
 }
 
-// Watch watches for changes in the env file for the specified
-// stage and executes the run command when a change is detected.
-// Monitoring continues as long as it is not interrupted.
-func (cfg *Config) Watch() (string, error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return "", fmt.Errorf("failed to create watcher: %w", err)
+// inferKind infers the kind of the value conservatively. A value is classified
+// as int, bool or json only when it is unambiguous, otherwise as string.
+// For example, "007" is a string since the leading zeros would be lost as an int.
+func inferKind(v string) string {
+	switch {
+	case v == "true" || v == "false":
+		return KindBool
+	case isCanonicalInt(v):
+		return KindInt
+	case (strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[")) && json.Valid([]byte(v)):
+		return KindJSON
+	default:
+		return KindString
 	}
-	defer func() {
-		if closeErr := watcher.Close(); closeErr != nil {
-			err = errors.Join(err, fmt.Errorf("failed to close watcher: %w", closeErr))
+}
+
+// isCanonicalInt reports whether the value is a decimal integer in canonical form.
+func isCanonicalInt(v string) bool {
+	n, err := strconv.ParseInt(v, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == v
+}
+
+// checkGroupDir warns about the group whose dir is the configuration directory or contains
+// the directory of a central env, since its env file is written next to the configuration
+// or the central env and may shadow it. For a directory stage, the directory itself is
+// compared, whose *.env files are merged into the central env.
+func (cfg *Config) checkGroupDir(id, dir string, paths map[string]string) {
+	var risk string
+	if dir == cfg.dir {
+		risk = "dir is the configuration directory"
+	} else {
+		for _, stage := range slices.Sorted(maps.Keys(paths)) {
+			if isURL(paths[stage]) {
+				continue
+			}
+			central := paths[stage]
+			if info, err := os.Stat(central); err != nil || !info.IsDir() {
+				central = filepath.Dir(central)
+			}
+			if rel, err := filepath.Rel(dir, central); err == nil && !isOutside(rel) {
+				risk = fmt.Sprintf("dir contains the central env of %s", stage)
+				break
+			}
 		}
-	}()
-	stagePath, err := cfg.Run()
+	}
+	if risk == "" {
+		return
+	}
+	cfg.warn(fmt.Sprintf("group.%s: %s: the env file written there may shadow or be mistaken for the central env", id, risk))
+}
+
+// checkDirenvTargets warns about the direnv targets of each group that receive no keys
+// from the central env of the stage, since the .envrc then loads an env file without content.
+func (cfg *Config) checkDirenvTargets(stage string, e map[string]string) {
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		group, _ := cfg.groupOf(stage, id)
+		for _, target := range merge(group.DirenvSupport, nil) {
+			g, ok := cfg.groupOf(stage, target)
+			if !ok || len(cfg.makeEnv(g, e)) > 0 {
+				continue
+			}
+			cfg.warn(fmt.Sprintf("%s: group.%s: direnv target group.%s receives no keys, so the .envrc loads an empty env file", stage, id, target))
+		}
+	}
+}
+
+// checkDirenvCycles warns about each cycle in the direnv references between groups,
+// since it may indicate a modeling mistake even though it works.
+func (cfg *Config) checkDirenvCycles() error {
+	cycles, err := cfg.DirenvCycles()
 	if err != nil {
-		return "", err
+		return err
 	}
-	dir := filepath.Dir(stagePath)
-	if err := watcher.Add(dir); err != nil {
-		return "", fmt.Errorf("failed to add dir to watcher: %w", err)
+	for _, cycle := range cycles {
+		cfg.warn(fmt.Sprintf("direnv references form a cycle: group.%s, so the .envrc files load the env files of each other", strings.Join(cycle, " -> group.")))
 	}
-	done := make(chan error)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				var (
-					isTarget      = event.Name == stagePath
-					isCreateEvent = event.Op&fsnotify.Create == fsnotify.Create
-					isWriteEvent  = event.Op&fsnotify.Write == fsnotify.Write
-				)
-				if isTarget && (isWriteEvent || isCreateEvent) {
-					_, _ = fmt.Fprintln(cfg.w, cyan("rerun..."))
-					if _, err := cfg.Run(); err != nil {
-						done <- err
-						return
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				done <- err
-				return
+	return nil
+}
+
+// checkPrefixOverlap warns about the pairs of groups where the prefix of one group followed
+// by the separator starts with that of the other, such as API and API_V2, since the keys
+// with the longer prefix are then delivered to both groups by their direct rules.
+func (cfg *Config) checkPrefixOverlap() {
+	sep := cfg.separator()
+	ids := slices.Sorted(maps.Keys(cfg.Group))
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			pa, pb := cfg.Group[a].Prefix, cfg.Group[b].Prefix
+			if pa == "" || pb == "" {
+				continue
+			}
+			short, long := a, b
+			if len(pa) > len(pb) {
+				short, long = b, a
+			}
+			if !strings.HasPrefix(cfg.Group[long].Prefix+sep, cfg.Group[short].Prefix+sep) {
+				continue
 			}
+			cfg.warn(fmt.Sprintf("group.%s: prefix %s overlaps prefix %s of group.%s, so the keys starting with %s are delivered to both; use more specific prefixes or deliver those keys as plain",
+				short, cfg.Group[short].Prefix, cfg.Group[long].Prefix, long, cfg.Group[long].Prefix+sep))
 		}
-	}()
-	if err := <-done; err != nil {
-		return "", err
 	}
-	return stagePath, err
 }
 
-// validateStageTable checks if the stage table is set in the configuration.
-func (cfg *Config) validateStageTable() error {
-	if len(cfg.Stage) == 0 {
-		return fmt.Errorf("failed to validate stage: stage not set in %s", cfg.path)
+// noteSkipped prints an informational note about the optional group skipped since its dir
+// does not exist, prefixed with the stage if not empty. Unlike a warning, it is not counted
+// in strict mode.
+func (cfg *Config) noteSkipped(stage, id string) {
+	if stage != "" {
+		stage += ": "
+	}
+	_, _ = fmt.Fprintf(cfg.w, "%s %sgroup.%s %s optional dir does not exist\n", gray("skipped:"), stage, id, gray("->"))
+}
+
+// warn prints the warning and counts it, so that Validate fails on it in strict mode.
+func (cfg *Config) warn(msg string) {
+	cfg.warnings++
+	_, _ = fmt.Fprintf(cfg.w, "%s %s\n", yellow("warning:"), msg)
+}
+
+// checkDuplicateKeys applies the duplicate key policy to the keys of the central env
+// delivered to more than one group. If report is true, the keys are reported as
+// warnings even if the policy allows them.
+func (cfg *Config) checkDuplicateKeys(stage string, e map[string]string, report bool) error {
+	dups := cfg.duplicateKeys(e)
+	if len(dups) == 0 {
+		return nil
+	}
+	keys := slices.Sorted(maps.Keys(dups))
+	if cfg.dupPolicy == DuplicateKeyError {
+		return fmt.Errorf("failed to validate: %s: keys delivered to more than one group: %s", stage, strings.Join(keys, ", "))
+	}
+	if cfg.dupPolicy == DuplicateKeyWarn || report {
+		for _, k := range keys {
+			if cfg.outputFormat == OutputJSON {
+				cfg.warnings++
+				cfg.emit(duplicateEvent{Event: "duplicate", Stage: stage, Key: k, Groups: dups[k]})
+				continue
+			}
+			cfg.warn(fmt.Sprintf("%s: %s %s %s", stage, k, gray("->"), "group."+strings.Join(dups[k], ", group.")))
+		}
 	}
 	return nil
 }
 
-// validateStagePair checks if the stage is set in the configuration and returns its absolute path.
-func (cfg *Config) validateStagePair(stage string) (string, error) {
-	path, ok := cfg.Stage[stage]
-	if !ok {
-		return "", fmt.Errorf("failed to validate stage: %s: not set in %s", stage, cfg.path)
+// duplicateKeys returns the keys of the central env delivered to more than one group
+// with the sorted group ids that receive them.
+func (cfg *Config) duplicateKeys(e map[string]string) map[string][]string {
+	dups := map[string][]string{}
+	for k := range e {
+		if ids := cfg.matchGroups(k); len(ids) > 1 {
+			dups[k] = ids
+		}
 	}
-	absPath, isDir, err := cfg.resolvePath(path)
-	if err != nil {
-		return "", fmt.Errorf("failed to validate stage path: %s: %w", stage, err)
+	return dups
+}
+
+// matchGroups returns the sorted ids of the groups to which the key of the central env is delivered.
+func (cfg *Config) matchGroups(key string) []string {
+	sep := cfg.separator()
+	ids := []string{}
+	for id, group := range cfg.Group {
+		switch {
+		case strings.HasPrefix(key, group.Prefix+sep):
+		case slices.ContainsFunc(group.Replaceable, func(prefix string) bool { return strings.HasPrefix(key, prefix+sep) }):
+		case slices.Contains(group.Plain, key), slices.Contains(cfg.meta[key].groups, id):
+		default:
+			continue
+		}
+		ids = append(ids, id)
 	}
-	if isDir {
-		return "", fmt.Errorf("failed to validate stage path: %s: is a directory", stage)
+	slices.Sort(ids)
+	return ids
+}
+
+// selectGroups returns the sorted ids of the groups to be distributed by Run.
+// If the groups are restricted, it checks that all of them exist and keeps their order.
+func (cfg *Config) selectGroups() ([]string, error) {
+	if len(cfg.only) == 0 {
+		return slices.Sorted(maps.Keys(cfg.Group)), nil
 	}
-	return absPath, nil
+	ids := make([]string, 0, len(cfg.only))
+	for _, id := range cfg.only {
+		if _, ok := cfg.Group[id]; !ok {
+			return nil, fmt.Errorf("failed to validate group: %s: not set in %s", id, cfg.path)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
 }
 
-// validateGroupTable checks if the group table is set in the configuration.
+// validateGroupTable checks if the group table is set in the configuration
+// and at most one group receives the keys not delivered to any group.
 func (cfg *Config) validateGroupTable() error {
 	if len(cfg.Group) == 0 {
-		return fmt.Errorf("failed to validate group: group not set in %s", cfg.path)
+		return withHint(fmt.Errorf("failed to validate group: group not set in %s", cfg.path),
+			"add at least one group table such as [group.api] with prefix and dir")
+	}
+	ids := []string{}
+	for id, group := range cfg.Group {
+		if group.CatchAll {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 1 {
+		slices.Sort(ids)
+		return fmt.Errorf("failed to validate group: catchall set in more than one group: %s in %s", strings.Join(ids, ", "), cfg.path)
 	}
 	return nil
 }
@@ -438,17 +3424,55 @@ func (cfg *Config) validateGroupTable() error {
 // validateGroupPair checks if the group is set in the configuration and returns its absolute path.
 func (cfg *Config) validateGroupPair(id string, group Group) (string, error) {
 	if group.Prefix == "" {
-		return "", fmt.Errorf("failed to validate group.%s: prefix not set in %s", id, cfg.path)
+		return "", withHint(fmt.Errorf("failed to validate group.%s: prefix not set in %s", id, cfg.path),
+			"set group.%s.prefix to the prefix of the keys delivered to the group", id)
 	}
 	if group.Dir == "" {
-		return "", fmt.Errorf("failed to validate group.%s: dir not set in %s", id, cfg.path)
+		return "", withHint(fmt.Errorf("failed to validate group.%s: dir not set in %s", id, cfg.path),
+			"set group.%s.dir to the directory the env file is delivered to", id)
 	}
-	absPath, isDir, err := cfg.resolvePath(group.Dir)
+	absPath, isDir, err := cfg.resolvePath(group.Dir, false)
 	if err != nil {
-		return "", fmt.Errorf("failed to validate group.%s: %w", id, err)
+		if errors.Is(err, fs.ErrNotExist) && group.Optional {
+			return "", fmt.Errorf("group.%s: %w", id, errSkipped)
+		}
+		err = fmt.Errorf("failed to validate group.%s: %w", id, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", withHint(err, "group.%s.dir does not exist; create the directory or fix the path relative to %s", id, cfg.dir)
+		}
+		var outside *OutsideRootError
+		if errors.As(err, &outside) {
+			return "", withHint(err, "group.%s.dir is outside of the project root %s; group dirs must be under it", id, outside.Root)
+		}
+		return "", err
 	}
 	if !isDir {
-		return "", fmt.Errorf("failed to validate group.%s: is not a directory", id)
+		return "", withHint(fmt.Errorf("failed to validate group.%s: is not a directory", id),
+			"group.%s.dir points to a file; set it to the containing directory and the file name to group.%s.filename", id, id)
+	}
+	for _, target := range group.Targets {
+		if err := cfg.validateTarget(id, absPath, target); err != nil {
+			return "", err
+		}
+	}
+	if name := group.filename(); name == "." || name == ".." || filepath.Base(name) != name {
+		return "", withHint(fmt.Errorf("failed to validate group.%s: invalid filename: %s", id, name),
+			"set group.%s.filename to a file name without directories and move them to group.%s.dir", id, id)
+	}
+	switch group.JSON {
+	case "", jsonCompact, jsonPretty:
+	default:
+		return "", withHint(fmt.Errorf("failed to validate group.%s: invalid json: %s: must be one of %s, %s", id, group.JSON, jsonCompact, jsonPretty),
+			"set group.%s.json to %s or %s, or remove it to deliver JSON values as is", id, jsonCompact, jsonPretty)
+	}
+	// Indented values span multiple lines, which only the strict format quotes
+	// and escapes so that the env file can be read back
+	if group.JSON == jsonPretty && cfg.format != FormatStrict {
+		return "", withHint(fmt.Errorf("failed to validate group.%s: json %s requires the %s format", id, jsonPretty, FormatStrict),
+			"use the %s format, such as with --format %s, or set group.%s.json to %s", FormatStrict, FormatStrict, id, jsonCompact)
+	}
+	if len(group.ValidateCmd) != 0 && group.ValidateCmd[0] == "" {
+		return "", fmt.Errorf("failed to validate: group.%s: `validate` command is empty", id)
 	}
 	if slices.Contains(group.Replaceable, "") {
 		return "", fmt.Errorf("failed to validate: group.%s: `replace` contains empty", id)
@@ -456,25 +3480,279 @@ func (cfg *Config) validateGroupPair(id string, group Group) (string, error) {
 	if slices.Contains(group.Plain, "") {
 		return "", fmt.Errorf("failed to validate: group.%s: `plain` contains empty", id)
 	}
+	if _, ok := group.Defaults[""]; ok {
+		return "", fmt.Errorf("failed to validate: group.%s: `defaults` contains empty key", id)
+	}
 	if slices.Contains(group.DirenvSupport, "") {
 		return "", fmt.Errorf("failed to validate: group.%s: `direnv` contains empty", id)
 	}
-	for _, s := range group.DirenvSupport {
+	if slices.Contains(group.EnvrcExtra, "") {
+		return "", fmt.Errorf("failed to validate: group.%s: `envrcExtra` contains empty", id)
+	}
+	for i, s := range group.DirenvSupport {
 		if _, ok := cfg.Group[s]; !ok {
-			return "", fmt.Errorf("failed to validate: group.%s: invalid id: %s", id, s)
+			return "", withHint(fmt.Errorf("failed to validate: group.%s: invalid id: %s", id, s),
+				"remove %s from group.%s.direnv or add group.%s to the configuration", s, id, s)
+		}
+		if slices.Contains(group.DirenvSupport[:i], s) {
+			return "", fmt.Errorf("failed to validate: group.%s: `direnv` contains duplicate id: %s", id, s)
 		}
 	}
 	return absPath, nil
 }
 
+// validateTarget checks if the target is a relative file path whose parent directory
+// exists within the project root, resolved from the group dir.
+func (cfg *Config) validateTarget(id, dir, target string) error {
+	if target == "" {
+		return fmt.Errorf("failed to validate: group.%s: `targets` contains empty", id)
+	}
+	path := filepath.FromSlash(target)
+	if filepath.IsAbs(path) || strings.HasSuffix(target, "/") || filepath.Base(path) == ".." {
+		return fmt.Errorf("failed to validate group.%s: invalid target: %s: must be a file path relative to the dir", id, target)
+	}
+	parent, isDir, err := cfg.resolvePath(filepath.Join(dir, filepath.Dir(path)), false)
+	if err != nil {
+		return fmt.Errorf("failed to validate group.%s: target: %s: %w", id, target, err)
+	}
+	if !isDir {
+		return fmt.Errorf("failed to validate group.%s: target: %s: parent is not a directory", id, target)
+	}
+	if info, err := os.Stat(filepath.Join(parent, filepath.Base(path))); err == nil && info.IsDir() {
+		return fmt.Errorf("failed to validate group.%s: target: %s: is a directory", id, target)
+	}
+	return nil
+}
+
+// resolveExtends merges the fields of the parent groups into the groups that extend them.
+// See inherit for how the fields are merged. A flag explicitly set in the group, which md
+// of the decoding tells, wins over the parent. The dir, filename and targets are not
+// inherited, since they locate the env files of the group and a child sharing them would
+// overwrite the files of the parent.
+func (cfg *Config) resolveExtends(md toml.MetaData) error {
+	resolved := make(map[string]bool, len(cfg.Group))
+	var resolve func(id string, visiting []string) error
+	resolve = func(id string, visiting []string) error {
+		if resolved[id] {
+			return nil
+		}
+		if slices.Contains(visiting, id) {
+			return fmt.Errorf("failed to resolve extends: cycle detected: %s", strings.Join(append(visiting, id), " -> "))
+		}
+		group := cfg.Group[id]
+		if group.Extends == "" {
+			resolved[id] = true
+			return nil
+		}
+		if _, ok := cfg.Group[group.Extends]; !ok {
+			return fmt.Errorf("failed to resolve extends: group.%s: unknown group: %s", id, group.Extends)
+		}
+		if err := resolve(group.Extends, append(visiting, id)); err != nil {
+			return err
+		}
+		merged := keepDefinedFlags(md, id, inherit(group, cfg.Group[group.Extends]), group)
+		merged.Dir, merged.Filename, merged.Targets = group.Dir, group.Filename, group.Targets
+		cfg.Group[id] = merged
+		resolved[id] = true
+		return nil
+	}
+	for _, id := range slices.Sorted(maps.Keys(cfg.Group)) {
+		if err := resolve(id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inherit returns the group with the fields of the parent merged into it.
+// String fields set in the group win, arrays are concatenated in the order of parent
+// and group without duplicates, and flags are enabled if either of them enables them.
+func inherit(group, parent Group) Group {
+	group.Prefix = cmp.Or(group.Prefix, parent.Prefix)
+	group.Dir = cmp.Or(group.Dir, parent.Dir)
+	group.Filename = cmp.Or(group.Filename, parent.Filename)
+	group.JSON = cmp.Or(group.JSON, parent.JSON)
+	group.Schema = cmp.Or(group.Schema, parent.Schema)
+	group.Replaceable = merge(parent.Replaceable, group.Replaceable)
+	group.Plain = merge(parent.Plain, group.Plain)
+	group.DirenvSupport = merge(parent.DirenvSupport, group.DirenvSupport)
+	group.EnvrcExtra = merge(parent.EnvrcExtra, group.EnvrcExtra)
+	group.IsCheck = group.IsCheck || parent.IsCheck
+	group.SkipEmpty = group.SkipEmpty || parent.SkipEmpty
+	group.Optional = group.Optional || parent.Optional
+	if len(group.ValidateCmd) == 0 {
+		group.ValidateCmd = parent.ValidateCmd
+	}
+	if len(group.Targets) == 0 {
+		group.Targets = parent.Targets
+	}
+	if len(parent.Defaults) != 0 {
+		defaults := maps.Clone(parent.Defaults)
+		maps.Copy(defaults, group.Defaults)
+		group.Defaults = defaults
+	}
+	return group
+}
+
+// applyGroupDefaults merges the group fields of the top-level groupDefaults table into all
+// groups in the same way as extends, so the fields set in a group take precedence over them.
+// As with extends, a flag explicitly set in a group, such as check = false, is kept as is
+// even if the group defaults enable it, which md of the decoding tells.
+// The fields identifying a group, such as prefix and dir, cannot be set in the group defaults.
+// The table is not named defaults, which is the field of a group with the default values of keys.
+func (cfg *Config) applyGroupDefaults(md toml.MetaData) error {
+	d := cfg.GroupDefaults
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"prefix", d.Prefix != ""},
+		{"dir", d.Dir != ""},
+		{"extends", d.Extends != ""},
+		{"catchall", d.CatchAll},
+	} {
+		if f.set {
+			return fmt.Errorf("failed to apply group defaults: %s: cannot be set in groupDefaults", f.name)
+		}
+	}
+	for id, group := range cfg.Group {
+		cfg.Group[id] = keepDefinedFlags(md, id, inherit(group, d), group)
+	}
+	return nil
+}
+
+// keepDefinedFlags returns the merged group with the flags explicitly set in the group
+// restored, which md of the decoding tells, so that check = false in a group wins over
+// a parent or the defaults enabling it.
+func keepDefinedFlags(md toml.MetaData, id string, merged, group Group) Group {
+	if md.IsDefined("group", id, "check") {
+		merged.IsCheck = group.IsCheck
+	}
+	if md.IsDefined("group", id, "skipEmpty") {
+		merged.SkipEmpty = group.SkipEmpty
+	}
+	if md.IsDefined("group", id, "optional") {
+		merged.Optional = group.Optional
+	}
+	return merged
+}
+
+// defaultPrefixes sets the prefix of each group without one to the prefix derived from
+// its id, such as API for the group api, so that conventionally named groups need no prefix.
+func (cfg *Config) defaultPrefixes() {
+	for id, group := range cfg.Group {
+		if group.Prefix != "" {
+			continue
+		}
+		group.Prefix = prefixOf(id)
+		cfg.Group[id] = group
+	}
+}
+
+// prefixOf returns the prefix derived from the group id, uppercased with the characters
+// other than letters and digits replaced with underscores, such as API_WORKER for
+// api-worker, so that the keys with the prefix are valid identifiers.
+func prefixOf(id string) string {
+	return strings.Map(func(r rune) rune {
+		if ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(id))
+}
+
+// groupOf returns the group with the overrides for the specified stage applied.
+// The stage placeholder in the dir is expanded for the stage.
+// The keys delivered to the group by directives are added to its plain keys.
+// The base group is returned as is if the stage has no override for it.
+func (cfg *Config) groupOf(stage, id string) (Group, bool) {
+	group, ok := cfg.Group[id]
+	if !ok {
+		return Group{}, false
+	}
+	if keys := cfg.directedKeys(id); len(keys) > 0 {
+		group.Plain = merge(group.Plain, keys)
+	}
+	if o, ok := cfg.Stage[stage].Override[id]; ok {
+		if o.Dir != "" {
+			group.Dir = o.Dir
+		}
+		if o.Filename != "" {
+			group.Filename = o.Filename
+		}
+		if o.IsCheck != nil {
+			group.IsCheck = *o.IsCheck
+		}
+	}
+	group.Dir = expandStage(group.Dir, stage)
+	return group, true
+}
+
+// expandStage replaces the stage placeholder in s with the name of the stage.
+func expandStage(s, stage string) string {
+	return strings.ReplaceAll(s, stagePlaceholder, stage)
+}
+
+// outputDir returns the directory to which the files of the group in dir are written.
+// If the output root is set, dir is mirrored under it relative to the project root.
+// The stage placeholder in the output root is expanded for the stage.
+func (cfg *Config) outputDir(stage, dir string) (string, error) {
+	if cfg.outputRoot == "" {
+		return dir, nil
+	}
+	rel, err := filepath.Rel(cfg.root, dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output dir: %w", err)
+	}
+	return filepath.Join(cfg.outputRootOf(stage), rel), nil
+}
+
+// outputRootOf returns the absolute output root for the stage, with the stage placeholder
+// expanded and a relative output root resolved from the configuration directory.
+func (cfg *Config) outputRootOf(stage string) string {
+	root := expandStage(cfg.outputRoot, stage)
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(cfg.dir, root)
+	}
+	return filepath.Clean(root)
+}
+
 // createEnvrc creates a .envrc file for direnv support in the specified group directory.
-func (cfg *Config) createEnvrc(group Group, dir string) (string, error) {
-	dest := filepath.Join(dir, ".envrc")
+// The directories and env file names of the supported groups are resolved with the overrides for the stage.
+// If the output root is set, the .envrc file is written under it, keeping the relative paths.
+// If a supported group dir has a .env.local, which lem never writes, it is loaded after
+// the delivered env file so that its values win. The extra lines of the group are
+// appended verbatim after them.
+func (cfg *Config) createEnvrc(stage string, group Group, dir string) (string, error) {
+	out, err := cfg.outputDir(stage, dir)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(out, ".envrc")
+	content, err := cfg.renderEnvrc(stage, group, dir)
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.checkWritable(dest); err != nil {
+		return "", fmt.Errorf("failed to write .envrc file: %w", err)
+	}
+	if err := os.MkdirAll(out, 0o750); err != nil {
+		return "", fmt.Errorf("failed to create .envrc dir: %w", err)
+	}
+	if err := os.WriteFile(dest, []byte(content), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write .envrc file: %w", err)
+	}
+	return dest, nil
+}
+
+// renderEnvrc returns the content of the .envrc file for the group in dir as createEnvrc
+// writes it, so that Check can compare it with the .envrc file on disk.
+func (cfg *Config) renderEnvrc(stage string, group Group, dir string) (string, error) {
 	b := strings.Builder{}
 	b.Grow(2048)
-	for _, target := range group.DirenvSupport {
-		g := cfg.Group[target]
-		envDir, isDir, err := cfg.resolvePath(g.Dir)
+	for _, target := range merge(group.DirenvSupport, nil) {
+		g, _ := cfg.groupOf(stage, target)
+		envDir, isDir, err := cfg.resolvePath(g.Dir, false)
 		if err != nil {
 			return "", fmt.Errorf("%s: %w", target, err)
 		}
@@ -485,29 +3763,51 @@ func (cfg *Config) createEnvrc(group Group, dir string) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("%s: %w", target, err)
 		}
-		b.WriteString(fmt.Sprintf("watch_file %s/.env\n", relPath))
-		b.WriteString(fmt.Sprintf("dotenv_if_exists %s/.env\n", relPath))
+		for _, file := range g.files() {
+			b.WriteString(fmt.Sprintf("watch_file %s/%s\n", relPath, file))
+			b.WriteString(fmt.Sprintf("dotenv_if_exists %s/%s\n", relPath, file))
+		}
+		if !slices.Contains(g.files(), localFilename) && exists(filepath.Join(envDir, localFilename)) {
+			b.WriteString(fmt.Sprintf("dotenv_if_exists %s/%s\n", relPath, localFilename))
+		}
 	}
-	if err := os.WriteFile(dest, []byte(b.String()), 0o600); err != nil {
-		return "", fmt.Errorf("failed to write .envrc file: %w", err)
+	for _, line := range group.EnvrcExtra {
+		b.WriteString(line + "\n")
 	}
-	return dest, nil
+	return b.String(), nil
 }
 
 // resolvePath resolves the given path relative to the configuration directory.
-func (cfg *Config) resolvePath(path string) (string, bool, error) {
+// If allowExternal is true, the path is allowed to be outside of the project root.
+// Slashes in the path are converted to the separator of the platform, and the root
+// check compares cleaned path elements, so it behaves the same on Windows.
+// If symlinks are followed, the root check is done on the path with symlinks resolved.
+func (cfg *Config) resolvePath(path string, allowExternal bool) (string, bool, error) {
+	path = filepath.FromSlash(path)
 	var absPath string
 	if filepath.IsAbs(path) {
 		absPath = filepath.Clean(path)
 	} else {
 		absPath = filepath.Clean(filepath.Join(cfg.dir, path))
 	}
-	relPath, err := filepath.Rel(cfg.root, absPath)
-	if err != nil {
-		return "", false, fmt.Errorf("failed to resolve path: %w", err)
-	}
-	if strings.HasPrefix(relPath, "..") {
-		return "", false, fmt.Errorf("failed to resolve path: outside of the project root: %s", absPath)
+	if !allowExternal {
+		root, target := cfg.root, absPath
+		if cfg.followSymlinks {
+			var err error
+			if target, err = filepath.EvalSymlinks(absPath); err != nil {
+				return "", false, fmt.Errorf("failed to resolve symlinks: %w", err)
+			}
+			if r, err := filepath.EvalSymlinks(root); err == nil {
+				root = r
+			}
+		}
+		relPath, err := filepath.Rel(root, target)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		if isOutside(relPath) {
+			return "", false, fmt.Errorf("failed to resolve path: %w", &OutsideRootError{Path: absPath, Root: cfg.root})
+		}
 	}
 	info, err := os.Stat(absPath)
 	if err != nil {
@@ -516,8 +3816,90 @@ func (cfg *Config) resolvePath(path string) (string, bool, error) {
 	return absPath, info.IsDir(), nil
 }
 
-// storeStage stores the current stage in the state file.
-func (cfg *Config) storeStage(stage string) error {
+// checkWritable reports an error if the path to be written is outside of the project root,
+// unless external paths are allowed. A path under the output root of any stage, if set, is
+// also accepted since the output root is chosen explicitly. The check is done on the absolute
+// paths as the path may not exist yet, with the symlinks of their existing parts resolved
+// if symlinks are followed.
+func (cfg *Config) checkWritable(path string) error {
+	if cfg.allowExternal {
+		return nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	bases := []string{cfg.root}
+	switch {
+	case strings.Contains(cfg.outputRoot, stagePlaceholder):
+		for _, stage := range slices.Sorted(maps.Keys(cfg.Stage)) {
+			bases = append(bases, cfg.outputRootOf(stage))
+		}
+	case cfg.outputRoot != "":
+		bases = append(bases, cfg.outputRootOf(""))
+	}
+	if cfg.followSymlinks {
+		path = evalExisting(path)
+	}
+	for _, base := range bases {
+		if base, err = filepath.Abs(base); err != nil {
+			return err
+		}
+		if cfg.followSymlinks {
+			base = evalExisting(base)
+		}
+		if rel, err := filepath.Rel(base, path); err == nil && !isOutside(rel) {
+			return nil
+		}
+	}
+	return &OutsideRootError{Path: path, Root: cfg.root}
+}
+
+// evalExisting returns the path with the symlinks of its longest existing part resolved
+// and the rest joined as is, since the path to be written may not exist yet.
+func evalExisting(path string) string {
+	rest := []string{}
+	for p := path; ; p = filepath.Dir(p) {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		if p == filepath.Dir(p) {
+			return path
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+	}
+}
+
+// isOutside reports whether the relative path obtained by filepath.Rel points outside
+// of its base directory. It compares the first path element rather than the string
+// prefix, so that names starting with dots such as "..shared" are not misjudged.
+func isOutside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// storeStage stores the current stage in the state file.
+// The hashes stored for the previous stage are discarded.
+func (cfg *Config) storeStage(stage string) error {
+	return cfg.updateState(func(map[string]string) map[string]string {
+		return map[string]string{"stage": stage}
+	})
+}
+
+// storeHashes stores the hashes in the state file alongside the stage,
+// replacing the hashes stored before.
+func (cfg *Config) storeHashes(hashes map[string]string) error {
+	return cfg.updateState(func(entry map[string]string) map[string]string {
+		updated := maps.Clone(hashes)
+		if stage, ok := entry["stage"]; ok {
+			updated["stage"] = stage
+		}
+		return updated
+	})
+}
+
+// updateState replaces the entry of the configuration in the state file
+// with the one returned by fn, which receives the current entry.
+func (cfg *Config) updateState(fn func(entry map[string]string) map[string]string) error {
 	path, err := statePathFunc()
 	if err != nil {
 		return err
@@ -527,11 +3909,11 @@ func (cfg *Config) storeStage(stage string) error {
 	}
 	state := map[string]map[string]string{}
 	if data, err := os.ReadFile(filepath.Clean(path)); err == nil && len(data) > 0 {
-		if err := json.Unmarshal(data, &state); err != nil {
+		if state, err = decodeState(path, data); err != nil {
 			return err
 		}
 	}
-	state[cfg.path] = map[string]string{"stage": stage}
+	state[cfg.path] = fn(state[cfg.path])
 	b, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
@@ -539,8 +3921,71 @@ func (cfg *Config) storeStage(stage string) error {
 	return os.WriteFile(path, b, 0o600)
 }
 
-// loadStage loads the current stage from the state file.
+// decodeState decodes the state file at path, pointing at the file and at ResetState
+// if it is corrupt, such as truncated or edited by hand into invalid JSON.
+func decodeState(path string, data []byte) (map[string]map[string]string, error) {
+	state := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, withHint(fmt.Errorf("failed to decode state file: %s: %w", path, err),
+			"the state file is corrupt; run `lem state --reset` to back it up and start with an empty state")
+	}
+	return state, nil
+}
+
+// loadHashes loads the hashes stored by Run for the configuration from the state file.
+// It returns nil if the state file or the entry of the configuration does not exist.
+func (cfg *Config) loadHashes() (map[string]string, error) {
+	path, err := statePathFunc()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	state, err := decodeState(path, data)
+	if err != nil {
+		return nil, err
+	}
+	hashes := maps.Clone(state[cfg.path])
+	delete(hashes, "stage")
+	return hashes, nil
+}
+
+// groupHashKey returns the key of the hash of the env file of the group in the state file.
+func groupHashKey(id string) string {
+	return "hash.group." + id
+}
+
+// hashOf returns the hex-encoded SHA-256 hash of the data.
+func hashOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadStage loads the current stage from the .lem-stage file in the project root
+// if it is enabled and not empty, or from the state file otherwise.
 func (cfg *Config) loadStage() (string, error) {
+	if cfg.stageFile {
+		data, err := os.ReadFile(filepath.Join(cfg.root, stageFilename))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to read stage file: %w", err)
+		}
+		if stage := strings.TrimSpace(string(data)); stage != "" {
+			return stage, nil
+		}
+	}
+	return cfg.loadStoredStage()
+}
+
+// loadStoredStage loads the current stage from the state file.
+func (cfg *Config) loadStoredStage() (string, error) {
 	path, err := statePathFunc()
 	if err != nil {
 		return "", err
@@ -549,13 +3994,13 @@ func (cfg *Config) loadStage() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	m := map[string]map[string]string{}
-	if err := json.Unmarshal(data, &m); err != nil {
+	m, err := decodeState(path, data)
+	if err != nil {
 		return "", err
 	}
 	v, ok := m[cfg.path]
 	if !ok {
-		return "", fmt.Errorf("no stage stored for config: %s", cfg.path)
+		return "", fmt.Errorf("%w for config: %s", errNoStage, cfg.path)
 	}
 	stage, ok := v["stage"]
 	if !ok {
@@ -589,14 +4034,14 @@ func (cfg *Config) findConfig() (string, error) {
 	return "", fmt.Errorf("config file lem.toml not found from %s up to project root %s", cwd, cfg.root)
 }
 
-// projectRoot finds the project root directory by looking for the .git directory.
-// It traverses up the directory tree until it finds the .git directory or reaches the root.
-func projectRoot(baseDir string) string {
+// projectRoot finds the project root directory by looking for any of the markers,
+// which can be either files or directories, so that the .git file of a worktree counts.
+// It traverses up the directory tree until it finds a marker or reaches the root,
+// and falls back to baseDir if none is found.
+func projectRoot(baseDir string, markers []string) string {
 	current := filepath.Clean(baseDir)
 	for {
-		root := filepath.Join(current, gitDir)
-		info, err := os.Stat(root)
-		if err == nil && info.IsDir() {
+		if hasMarker(current, markers) {
 			return current
 		}
 		parent := filepath.Dir(current)
@@ -608,52 +4053,539 @@ func projectRoot(baseDir string) string {
 	return baseDir
 }
 
+// hasMarker reports whether the directory contains any of the markers.
+func hasMarker(dir string, markers []string) bool {
+	return slices.ContainsFunc(markers, func(m string) bool { return exists(filepath.Join(dir, m)) })
+}
+
 // readEnv reads the environment variables from the specified path and returns them as a map.
-func readEnv(path string, size int) (map[string]string, int, error) {
-	env := make(map[string]string, size)
-	f, err := os.Open(filepath.Clean(path))
+// Keys are always trimmed, and values are trimmed unless trimming is disabled.
+// A value starting with triple double quotes spans multiple lines until the closing
+// triple double quotes, preserving newlines. See readMultiline for details.
+// If includes are enabled, a line of the form #include <path> reads the file at that point.
+// If directives are enabled, a line of the form # lem:<attributes> declares the metadata
+// of the key on the following line. See parseMeta for the attributes.
+// If the path is a directory, its *.env files are read in sorted order and merged,
+// the later files overriding the values of the earlier ones.
+// If the path is an http:// or https:// URL, the central env is fetched from it.
+// A line with an empty key, such as =value, is skipped with a warning, or is an error
+// in strict mode.
+func (cfg *Config) readEnv(ctx context.Context, path string) (map[string]string, int, error) {
+	env := make(map[string]string, cfg.size)
+	order := make(map[string]int, cfg.size)
+	meta := map[string]keyMeta{}
+	if isURL(path) {
+		b, _, err := cfg.fetch(ctx, path)
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := cfg.scanEnv(ctx, path, bytes.NewReader(b), env, order, meta, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		cfg.order = order
+		cfg.meta = meta
+		return env, n, nil
+	}
+	paths, err := envFiles(path)
 	if err != nil {
 		return nil, 0, err
 	}
+	n := 0
+	for _, p := range paths {
+		m, err := cfg.readEnvFile(ctx, p, env, order, meta, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += m
+	}
+	cfg.order = order
+	cfg.meta = meta
+	return env, n, nil
+}
+
+// readDelivered reads the env file delivered at path with the output separator, trimmed
+// of the spaces around it since the keys and values are trimmed anyway. Unlike readEnv,
+// it does not replace the order and the directive metadata of the central env kept in cfg,
+// which the groups are still resolved with, and it neither follows includes nor parses directives.
+func (cfg *Config) readDelivered(path string) (map[string]string, error) {
+	c := *cfg
+	c.kvSep = cmp.Or(strings.TrimSpace(cfg.outputSeparator()), cfg.outputSeparator())
+	c.includes = false
+	c.directives = false
+	e, _, err := c.readEnv(context.Background(), path)
+	return e, err
+}
+
+// envFiles returns the sorted *.env files in the path if it is a directory,
+// or the path itself otherwise. A directory without *.env files is an error.
+// Hidden files, such as the .env written by a group delivering to the directory,
+// are skipped so that the delivered files are not merged back into the central env.
+func envFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.env"))
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if strings.HasPrefix(filepath.Base(match), ".") {
+			continue
+		}
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, match)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.env files in %s", path)
+	}
+	return paths, nil
+}
+
+// isURL reports whether the path of a stage is an http:// or https:// URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// validateURL checks if the URL of a stage is well-formed with a host.
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL: %s: host not set", rawURL)
+	}
+	return nil
+}
+
+// fetchedKey is the key of the context holding the contents fetched from URL stages.
+type fetchedKey struct{}
+
+// fetchedContent is the content of a URL stage and its modification time.
+type fetchedContent struct {
+	b       []byte
+	modTime time.Time
+}
+
+// withFetched returns a context in which fetch keeps the fetched contents, so that
+// a URL stage is fetched once and the same content is parsed and hashed.
+func withFetched(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fetchedKey{}, map[string]fetchedContent{})
+}
+
+// fetch returns the content of the central env served at the URL and its modification
+// time, taken from the Last-Modified header or the current time if it is absent.
+// If the context is made by withFetched, the content fetched before is returned instead.
+// The request is bounded by the HTTP timeout, and the Authorization header is set from
+// the LEM_HTTP_AUTHORIZATION environment variable if it is set and the URL is https.
+// Over plain http, the header is not sent and a warning is reported instead, and
+// a redirect from https to plain http is refused while the header is set.
+// A response other than 200 OK or larger than the maximum file size is an error.
+func (cfg *Config) fetch(ctx context.Context, rawURL string) (b []byte, modTime time.Time, err error) {
+	fetched, _ := ctx.Value(fetchedKey{}).(map[string]fetchedContent)
+	if c, ok := fetched[rawURL]; ok {
+		return c.b, c.modTime, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(cfg.httpTimeout, defaultHTTPTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch: %w", err)
+	}
+	if auth := os.Getenv(httpAuthVariable); auth != "" {
+		if req.URL.Scheme == "https" {
+			req.Header.Set("Authorization", auth)
+		} else {
+			cfg.warn(fmt.Sprintf("%s: %s is not sent over plain http; use https", rawURL, httpAuthVariable))
+		}
+	}
+	// The client keeps the header on a redirect to the same host even if it drops to http
+	client := *http.DefaultClient
+	if req.Header.Get("Authorization") != "" {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to plain http refused: %s: %s is not sent over plain http", req.URL.Redacted(), httpAuthVariable)
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close response body: %w", closeErr))
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch: %s: %s", rawURL, resp.Status)
+	}
+	limit := cfg.maxSize()
+	b, err = io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch: %s: %w", rawURL, err)
+	}
+	if int64(len(b)) > limit {
+		return nil, time.Time{}, fmt.Errorf("file too large: %s: exceeds the limit of %d bytes", rawURL, limit)
+	}
+	modTime, err = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Now()
+	}
+	if fetched != nil {
+		fetched[rawURL] = fetchedContent{b: b, modTime: modTime}
+	}
+	return b, modTime, nil
+}
+
+// readCentral returns the content of the central env at the path, concatenating
+// the *.env files in sorted order if it is a directory, and the latest modification
+// time among them, including that of the directory to account for removed files.
+// If the path is a URL, the content is fetched from it. See fetch for the time.
+func (cfg *Config) readCentral(ctx context.Context, path string) ([]byte, time.Time, error) {
+	if isURL(path) {
+		return cfg.fetch(ctx, path)
+	}
+	paths, err := envFiles(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		modTime = info.ModTime()
+	}
+	b := []byte{}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		data, err := os.ReadFile(filepath.Clean(p))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		b = append(b, data...)
+	}
+	return b, modTime, nil
+}
+
+// maxSize returns the maximum size in bytes of an env file to be read, defaulting to 64 MiB.
+func (cfg *Config) maxSize() int64 {
+	if cfg.maxFileSize <= 0 {
+		return defaultMaxFileSize
+	}
+	return cfg.maxFileSize
+}
+
+// readEnvFile reads the environment variables from the specified path into env,
+// recording the position of each new key in order and the metadata declared by directives
+// in meta, and returns the number of entries read.
+// The visiting paths are the files including this one, used to detect include cycles.
+func (cfg *Config) readEnvFile(ctx context.Context, path string, env map[string]string, order map[string]int, meta map[string]keyMeta, visiting []string) (int, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return 0, err
+	}
 	defer func() {
 		if closeErr := f.Close(); closeErr != nil {
 			err = errors.Join(err, fmt.Errorf("failed to close file: %w", closeErr))
 		}
 	}()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if limit := cfg.maxSize(); info.Size() > limit {
+		return 0, fmt.Errorf("file too large: %s: %d bytes exceeds the limit of %d bytes", path, info.Size(), limit)
+	}
+	return cfg.scanEnv(ctx, path, f, env, order, meta, visiting)
+}
+
+// scanEnv reads the environment variables from r, the content of the env file at path,
+// into env in the same way as readEnvFile.
+func (cfg *Config) scanEnv(ctx context.Context, path string, r io.Reader, env map[string]string, order map[string]int, meta map[string]keyMeta, visiting []string) (int, error) {
+	var err error
 	i := 0
-	scanner := bufio.NewScanner(f)
+	var pending *keyMeta
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if target, ok := strings.CutPrefix(trimmed, includeDirective); ok && cfg.includes {
+			m, err := cfg.readInclude(ctx, path, strings.TrimSpace(target), env, order, meta, visiting)
+			if err != nil {
+				return 0, err
+			}
+			i += m
+			continue
+		}
+		if comment, ok := strings.CutPrefix(trimmed, "#"); ok && cfg.directives {
+			if attrs, ok := strings.CutPrefix(strings.TrimSpace(comment), metaDirective); ok {
+				m, err := parseMeta(attrs)
+				if err != nil {
+					return 0, fmt.Errorf("failed to read directive: %s: %w", path, err)
+				}
+				pending = &m
+				continue
+			}
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
 			continue
 		}
-		kv := strings.SplitN(line, "=", 2)
+		if !cfg.rawValues {
+			line = trimmed
+		}
+		kv := strings.SplitN(line, cfg.kvSeparator(), 2)
 		if len(kv) == 2 {
 			k := strings.TrimSpace(kv[0])
-			v := strings.TrimSpace(kv[1])
+			v := kv[1]
+			if !cfg.rawValues {
+				v = strings.TrimSpace(v)
+			}
+			if rest, ok := strings.CutPrefix(strings.TrimLeft(v, " \t"), multilineQuote); ok {
+				v, err = readMultiline(scanner, rest)
+				if err != nil {
+					return 0, fmt.Errorf("failed to read multiline value: %s: %w", k, err)
+				}
+			} else if cfg.format == FormatStrict {
+				v, err = unquoteValue(v)
+				if err != nil {
+					return 0, fmt.Errorf("failed to unquote value: %s: %w", k, err)
+				}
+			} else if cfg.normalize {
+				v = normalizeValue(v)
+			}
+			if k == "" {
+				if cfg.strict {
+					return 0, fmt.Errorf("failed to read env: %s: empty key in line %q", path, trimmed)
+				}
+				if cfg.outputFormat == OutputJSON {
+					cfg.warnings++
+					cfg.emit(emptyKeyEvent{Event: "emptyKey", Path: path, Line: trimmed})
+				} else {
+					cfg.warn(fmt.Sprintf("%s: line %q has an empty key and is skipped", path, trimmed))
+				}
+				pending = nil
+				continue
+			}
 			env[k] = v
+			if _, ok := order[k]; !ok {
+				order[k] = len(order)
+			}
+			if pending != nil {
+				meta[k] = *pending
+				pending = nil
+			}
 			i++
 		}
 	}
 	if scanErr := scanner.Err(); scanErr != nil {
 		err = scanErr
-		return nil, 0, err
+		return 0, err
+	}
+	return i, err
+}
+
+// readInclude reads the env file included from the file at path into env.
+// The target is resolved relative to the including file and must be within
+// the project root unless external paths are allowed. It fails on include cycles.
+func (cfg *Config) readInclude(ctx context.Context, path, target string, env map[string]string, order map[string]int, meta map[string]keyMeta, visiting []string) (int, error) {
+	if target == "" {
+		return 0, fmt.Errorf("failed to include: path not set in %s", path)
+	}
+	if isURL(path) {
+		return 0, fmt.Errorf("failed to include: %s: not supported in the central env fetched from a URL", target)
+	}
+	from, err := filepath.Abs(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to include: %w", err)
+	}
+	target = filepath.FromSlash(target)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(from), target)
+	}
+	target = filepath.Clean(target)
+	if !cfg.allowExternal {
+		rel, err := filepath.Rel(cfg.root, target)
+		if err != nil {
+			return 0, fmt.Errorf("failed to include: %w", err)
+		}
+		if isOutside(rel) {
+			return 0, fmt.Errorf("failed to include: %w", &OutsideRootError{Path: target, Root: cfg.root})
+		}
+	}
+	visiting = append(slices.Clone(visiting), from)
+	if slices.Contains(visiting, target) {
+		return 0, fmt.Errorf("failed to include: cycle detected: %s", strings.Join(append(visiting, target), " -> "))
+	}
+	n, err := cfg.readEnvFile(ctx, target, env, order, meta, visiting)
+	if err != nil {
+		return 0, fmt.Errorf("failed to include %s: %w", target, err)
+	}
+	return n, nil
+}
+
+// parseMeta parses the comma-separated attributes of a directive. The attribute group=<id>
+// delivers the key as is to the group and can be repeated, and secret masks its value.
+func parseMeta(attrs string) (keyMeta, error) {
+	m := keyMeta{}
+	for attr := range strings.SplitSeq(attrs, ",") {
+		attr = strings.TrimSpace(attr)
+		name, value, _ := strings.Cut(attr, "=")
+		switch strings.TrimSpace(name) {
+		case "group":
+			if value = strings.TrimSpace(value); value == "" {
+				return keyMeta{}, errors.New("group id not set")
+			}
+			m.groups = merge(m.groups, []string{value})
+		case "secret":
+			m.secret = true
+		default:
+			return keyMeta{}, fmt.Errorf("unknown attribute: %q", attr)
+		}
+	}
+	return m, nil
+}
+
+// directedKeys returns the sorted keys of the last env read that are delivered
+// as is to the group by directives.
+func (cfg *Config) directedKeys(id string) []string {
+	var keys []string
+	for k, m := range cfg.meta {
+		if slices.Contains(m.groups, id) {
+			keys = append(keys, k)
+		}
 	}
-	return env, i, err
+	slices.Sort(keys)
+	return keys
+}
+
+// maskValue returns the value of the key to be shown, masked if the key is secret.
+func (cfg *Config) maskValue(key, value string) string {
+	if cfg.meta[key].secret {
+		return maskedValue
+	}
+	return value
+}
+
+// readMultiline reads the rest of a multiline value from the scanner until the closing
+// triple double quotes. The first line is the rest of the line after the opening quotes
+// and is skipped if empty, so that a block can start on the line after KEY=""".
+// Lines are preserved as is and joined with newlines.
+func readMultiline(scanner *bufio.Scanner, first string) (string, error) {
+	if before, _, ok := strings.Cut(first, multilineQuote); ok {
+		return before, nil
+	}
+	lines := []string{}
+	if first != "" {
+		lines = append(lines, first)
+	}
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if before, _, ok := strings.Cut(line, multilineQuote); ok {
+			if before != "" {
+				lines = append(lines, before)
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("unterminated value")
+}
+
+// normalizeValue trims the surrounding whitespace of a value and then strips
+// a surrounding pair of matching double or single quotes. The content inside
+// the quotes is kept as is, without unescaping.
+func normalizeValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// unquoteValue removes the surrounding quotes from a value in the strict format.
+// Double-quoted values are unescaped, and single-quoted values are taken literally.
+// Values without surrounding quotes are returned as is.
+func unquoteValue(v string) (string, error) {
+	t := strings.TrimSpace(v)
+	if len(t) < 2 {
+		return v, nil
+	}
+	switch {
+	case t[0] == '"' && t[len(t)-1] == '"':
+		return strconv.Unquote(t)
+	case t[0] == '\'' && t[len(t)-1] == '\'':
+		return t[1 : len(t)-1], nil
+	default:
+		return v, nil
+	}
+}
+
+// quoteValue quotes and escapes a value in the strict format if it contains
+// characters that would otherwise be lost or misread when read back.
+func quoteValue(v string) string {
+	if v != strings.TrimSpace(v) || strings.ContainsAny(v, `"'\`) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// kvSeparator returns the separator between the key and the value when reading env.
+func (cfg *Config) kvSeparator() string {
+	if cfg.kvSep == "" {
+		return defaultKVSeparator
+	}
+	return cfg.kvSep
+}
+
+// outputSeparator returns the separator between the key and the value when writing env files.
+func (cfg *Config) outputSeparator() string {
+	if cfg.outSep == "" {
+		return defaultKVSeparator
+	}
+	return cfg.outSep
 }
 
 // makeEnv creates a map of environment variables for the specified group.
 // It filters the base environment variables based on the group's prefix and replaceable prefixes.
-func makeEnv(group Group, base map[string]string, size int) map[string]string {
-	e := make(map[string]string, size)
+// The catch-all group also receives the keys as is that are not matched by any group.
+// The defaults of the group are added for the keys still missing after filtering.
+// JSON values are compacted or indented if the group specifies it, and the keys with
+// empty values are dropped if the group skips them, before the check for empty values.
+func (cfg *Config) makeEnv(group Group, base map[string]string) map[string]string {
+	e := make(map[string]string, cfg.size)
+	sep := cfg.separator()
 	for k, v := range base {
-		if strings.HasPrefix(k, group.Prefix+"_") {
+		if strings.HasPrefix(k, group.Prefix+sep) {
 			e[k] = v
 		}
 		for _, prefix := range group.Replaceable {
-			if strings.HasPrefix(k, prefix+"_") {
+			if strings.HasPrefix(k, prefix+sep) {
 				u := strings.Replace(k, prefix, group.Prefix, 1)
 				e[u] = v
+				if pos, ok := cfg.order[k]; ok && cfg.sourceOrder {
+					if _, ok := cfg.order[u]; !ok {
+						cfg.order[u] = pos
+					}
+				}
 			}
 		}
 		for _, key := range group.Plain {
@@ -661,39 +4593,212 @@ func makeEnv(group Group, base map[string]string, size int) map[string]string {
 				e[k] = v
 			}
 		}
+		if group.CatchAll && len(cfg.matchGroups(k)) == 0 {
+			e[k] = v
+		}
+	}
+	for k, v := range group.Defaults {
+		if _, ok := e[k]; !ok {
+			e[k] = v
+		}
+	}
+	if group.JSON != "" {
+		for k, v := range e {
+			e[k] = formatJSON(v, group.JSON)
+		}
+	}
+	if group.SkipEmpty {
+		maps.DeleteFunc(e, func(_, v string) bool { return isEmptyValue(v) })
 	}
 	return e
 }
 
+// formatJSON compacts or indents the value if it is a JSON object or array.
+// Other values are returned as is.
+func formatJSON(v, mode string) string {
+	if inferKind(v) != KindJSON {
+		return v
+	}
+	b := &bytes.Buffer{}
+	var err error
+	switch mode {
+	case jsonCompact:
+		err = json.Compact(b, []byte(v))
+	case jsonPretty:
+		err = json.Indent(b, []byte(v), "", "  ")
+	default:
+		return v
+	}
+	if err != nil {
+		return v
+	}
+	return b.String()
+}
+
 // writeEnv writes the environment variables to the specified path.
-func writeEnv(path string, env map[string]string) error {
+// The path is rejected if it is outside of the project root and the output root.
+// If checksums are enabled, the sidecar with the digest of the content is written after it.
+func (cfg *Config) writeEnv(path string, env map[string]string) error {
+	if err := cfg.checkWritable(path); err != nil {
+		return fmt.Errorf("failed to write env file: %w", err)
+	}
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0o750); err != nil {
 		return fmt.Errorf("failed to create env dir: %w", err)
 	}
+	b := &bytes.Buffer{}
+	cfg.renderEnv(b, env)
+	if cfg.backup {
+		if err := backupEnv(path, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(path, b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write env file: %w", err)
+	}
+	if !cfg.checksums {
+		return nil
+	}
+	sum := fmt.Sprintf("%s  %s\n", hashOf(b.Bytes()), filepath.Base(path))
+	if err := writeFile(path+checksumExt, []byte(sum)); err != nil {
+		return fmt.Errorf("failed to write checksum file: %w", err)
+	}
+	return nil
+}
+
+// backupEnv copies the env file at path to a backup named after it with the current
+// timestamp before it is overwritten with b, unless it does not exist or already has
+// the content. The backup is readable only by the owner, since env files hold secrets.
+func backupEnv(path string, b []byte) error {
+	current, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read env file for backup: %w", err)
+	}
+	if bytes.Equal(current, b) {
+		return nil
+	}
+	backup := path + "." + time.Now().UTC().Format(backupLayout) + backupExt
+	if err := os.WriteFile(backup, current, 0o600); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// writeFile creates or truncates the file at path and writes the data to it.
+func writeFile(path string, data []byte) (err error) {
 	f, err := os.Create(filepath.Clean(path))
 	if err != nil {
-		return fmt.Errorf("failed to create env file: %w", err)
+		return err
 	}
 	defer func() {
 		if closeErr := f.Close(); closeErr != nil {
 			err = errors.Join(err, fmt.Errorf("failed to close file: %w", closeErr))
 		}
 	}()
-	w := bufio.NewWriter(f)
+	_, err = f.Write(data)
+	return err
+}
+
+// retry calls fn up to the specified number of attempts while it returns a transient error,
+// waiting with exponential backoff between attempts. It returns the last error,
+// or the context error if the context is done before fn succeeds.
+func retry(ctx context.Context, attempts int, fn func() error) error {
+	var err error
+	for i := range max(attempts, 1) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err = fn(); err == nil || !isTransient(err) {
+			return err
+		}
+		if i < attempts-1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryInterval << i):
+			}
+		}
+	}
+	return err
+}
+
+// isTransient reports whether the error is a transient file operation error worth retrying.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ETXTBSY) || errors.Is(err, syscall.EINTR)
+}
+
+// renderEnv renders the environment variables to the writer in KEY=value form sorted by key,
+// or by the position in the central env if the source order is enabled.
+// The output separator is used in place of "=" if set.
+// In the strict format, values are quoted and escaped as needed.
+// Lines end with CRLF instead of LF if the line ending is set so.
+func (cfg *Config) renderEnv(w io.Writer, env map[string]string) {
+	cfg.render(w, env, cfg.outputSeparator(), cfg.order)
+}
+
+// render renders the environment variables as renderEnv does, with the separator and
+// the positions of the keys for the source order given explicitly.
+func (cfg *Config) render(w io.Writer, env map[string]string, sep string, order map[string]int) {
 	keys := make([]string, 0, len(env))
 	for k := range env {
 		keys = append(keys, k)
 	}
 	slices.Sort(keys)
+	if cfg.sourceOrder {
+		slices.SortStableFunc(keys, func(a, b string) int {
+			pa, oka := order[a]
+			pb, okb := order[b]
+			switch {
+			case oka && okb:
+				return cmp.Compare(pa, pb)
+			case oka:
+				return -1
+			case okb:
+				return 1
+			}
+			return 0
+		})
+	}
 	for _, k := range keys {
 		v := env[k]
-		_, _ = fmt.Fprintf(w, "%s=%s\n", k, v)
+		if cfg.format == FormatStrict {
+			v = quoteValue(v)
+		}
+		line := k + sep + v + "\n"
+		if cfg.lineEnding == LineEndingCRLF {
+			line = strings.ReplaceAll(line, "\n", "\r\n")
+		}
+		_, _ = io.WriteString(w, line)
+	}
+}
+
+// isEmptyValue reports whether the value is empty or consists only of a pair of quotes.
+func isEmptyValue(v string) bool {
+	return v == "" || v == "''" || v == `""` || v == "``"
+}
+
+// merge concatenates the slices in order without duplicates.
+// It returns nil if both slices are empty.
+func merge(a, b []string) []string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
 	}
-	if flushErr := w.Flush(); flushErr != nil {
-		return fmt.Errorf("failed to flush env file: %w", flushErr)
+	s := make([]string, 0, len(a)+len(b))
+	for _, v := range slices.Concat(a, b) {
+		if !slices.Contains(s, v) {
+			s = append(s, v)
+		}
 	}
-	return err
+	return s
+}
+
+// exists reports whether the specified file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 // sanitizePath sanitizes the given path by resolving it to an absolute path.
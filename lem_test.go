@@ -2,13 +2,25 @@ package lem
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/fatih/color"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,6 +39,7 @@ func TestMain(m *testing.M) {
 		gitDir = defaultGitDir
 		statePathFunc = defaultStatePath
 		_ = os.Remove("testdata/sandbox/state")
+		_ = os.Remove("testdata/sandbox/api/.env.override")
 	}()
 	m.Run()
 }
@@ -36,6 +49,11 @@ func dummyStatePath() (string, error) {
 	return filepath.Join("testdata", "sandbox", "state"), nil
 }
 
+// ptr returns a pointer to the given value.
+func ptr[T any](v T) *T {
+	return &v
+}
+
 func prepareState(path, stage string) {
 	statePath, err := dummyStatePath()
 	if err != nil {
@@ -92,6 +110,66 @@ func TestWithWriter(t *testing.T) {
 	}
 }
 
+func TestWithWriters(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	t.Cleanup(func() { color.NoColor = noColor })
+	type expected struct {
+		stdout  bool
+		content string
+	}
+	tests := []struct {
+		name     string
+		ws       func() []*bytes.Buffer
+		expected expected
+	}{
+		{
+			name:     "none",
+			ws:       func() []*bytes.Buffer { return nil },
+			expected: expected{stdout: true},
+		},
+		{
+			name:     "single",
+			ws:       func() []*bytes.Buffer { return []*bytes.Buffer{{}} },
+			expected: expected{content: cyan("created:") + " lem.toml\n"},
+		},
+		{
+			name:     "multiple",
+			ws:       func() []*bytes.Buffer { return []*bytes.Buffer{{}, {}} },
+			expected: expected{content: "created: lem.toml\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bufs := tt.ws()
+			ws := []io.Writer{nil}
+			for _, b := range bufs {
+				ws = append(ws, b)
+			}
+			actual := &Config{}
+			WithWriters(ws...)(actual)
+			if tt.expected.stdout {
+				assert.Equal(t, os.Stdout, actual.w)
+				return
+			}
+			_, _ = fmt.Fprintf(actual.w, "%s %s\n", cyan("created:"), "lem.toml")
+			for _, b := range bufs {
+				assert.Equal(t, tt.expected.content, b.String())
+			}
+		})
+	}
+}
+
+func Test_isTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.False(t, isTerminal(f))
+	assert.False(t, isTerminal(&bytes.Buffer{}))
+}
+
 func TestWithSize(t *testing.T) {
 	type args struct {
 		size int
@@ -129,39 +207,49 @@ func TestWithSize(t *testing.T) {
 	}
 }
 
-func TestInit(t *testing.T) {
+func TestWithRetry(t *testing.T) {
+	type args struct {
+		attempts int
+	}
 	type expected struct {
-		isError bool
+		attempts int
 	}
 	tests := []struct {
 		name     string
+		args     args
 		expected expected
 	}{
 		{
 			name:     "basic",
-			expected: expected{isError: false},
+			args:     args{attempts: 3},
+			expected: expected{attempts: 3},
+		},
+		{
+			name:     "zero",
+			args:     args{attempts: 0},
+			expected: expected{attempts: 1},
+		},
+		{
+			name:     "negative",
+			args:     args{attempts: -1},
+			expected: expected{attempts: 1},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := Init()
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
+			actual := &Config{}
+			WithRetry(tt.args.attempts)(actual)
+			assert.Equal(t, tt.expected.attempts, actual.attempts)
 		})
 	}
 }
 
-func TestLoad(t *testing.T) {
+func TestWithMaxFileSize(t *testing.T) {
 	type args struct {
-		path string
-		opts []Option
+		maxFileSize int64
 	}
 	type expected struct {
-		cfg     *Config
-		isError bool
+		maxFileSize int64
 	}
 	tests := []struct {
 		name     string
@@ -169,1228 +257,10197 @@ func TestLoad(t *testing.T) {
 		expected expected
 	}{
 		{
-			name: "basic",
-			args: args{
-				path: "testdata/sandbox/lem.toml",
-				opts: nil,
-			},
-			expected: expected{
-				cfg: &Config{
-					Stage: map[string]string{
-						"default":  "master/.env",
-						"dev":      "master/.env.development",
-						"noexists": "master/.env.noexists",
-					},
-					Group: map[string]Group{
-						"api": {
-							Prefix:        "API",
-							Dir:           "./api",
-							Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-							Plain:         []string{"FOO", "BAR"},
-							DirenvSupport: []string{"api", "ui"},
-							IsCheck:       true,
-						},
-						"ui": {
-							Prefix:        "UI",
-							Dir:           "./ui",
-							Replaceable:   []string{"REPLACEABLE1"},
-							Plain:         []string{"BAZ"},
-							DirenvSupport: []string{"ui"},
-							IsCheck:       false,
-						},
-					},
-					path: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/lem.toml")
-						return path
-					}(),
-					dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					root: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					size: 32,
-					w:    os.Stdout,
-				},
-				isError: false,
-			},
+			name:     "basic",
+			args:     args{maxFileSize: 1024},
+			expected: expected{maxFileSize: 1024},
 		},
 		{
-			name: "with options",
-			args: args{
-				path: "testdata/sandbox/lem.toml",
-				opts: []Option{
-					WithSize(1),
-					WithWriter(&bytes.Buffer{}),
-				},
-			},
-			expected: expected{
-				cfg: &Config{
-					Stage: map[string]string{
-						"default":  "master/.env",
-						"dev":      "master/.env.development",
-						"noexists": "master/.env.noexists",
-					},
-					Group: map[string]Group{
-						"api": {
-							Prefix:        "API",
-							Dir:           "./api",
-							Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-							Plain:         []string{"FOO", "BAR"},
-							DirenvSupport: []string{"api", "ui"},
-							IsCheck:       true,
-						},
-						"ui": {
-							Prefix:        "UI",
-							Dir:           "./ui",
-							Replaceable:   []string{"REPLACEABLE1"},
-							Plain:         []string{"BAZ"},
-							DirenvSupport: []string{"ui"},
-							IsCheck:       false,
-						},
-					},
-					path: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/lem.toml")
-						return path
-					}(),
-					dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					root: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					size: 1,
-					w:    &bytes.Buffer{},
-				},
-				isError: false,
-			},
+			name:     "zero",
+			args:     args{maxFileSize: 0},
+			expected: expected{maxFileSize: defaultMaxFileSize},
 		},
 		{
-			name: "empty file",
-			args: args{
-				path: "testdata/sandbox/lem.empty.toml",
-				opts: nil,
-			},
-			expected: expected{
-				cfg: &Config{
-					Stage: nil,
-					Group: nil,
-					path: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/lem.empty.toml")
-						return path
-					}(),
-					dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					root: func() string {
-						path, _ := filepath.Abs("testdata/sandbox")
-						return path
-					}(),
-					size: 32,
-					w:    os.Stdout,
-				},
-				isError: false,
-			},
+			name:     "negative",
+			args:     args{maxFileSize: -1},
+			expected: expected{maxFileSize: defaultMaxFileSize},
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithMaxFileSize(tt.args.maxFileSize)(actual)
+			assert.Equal(t, tt.expected.maxFileSize, actual.maxFileSize)
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	type args struct {
+		timeout time.Duration
+	}
+	type expected struct {
+		timeout time.Duration
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
 		{
-			name: "invalid file",
-			args: args{
-				path: "testdata/sandbox/lem.invalid.toml",
-				opts: nil,
-			},
-			expected: expected{
-				cfg:     nil,
-				isError: true,
-			},
+			name:     "basic",
+			args:     args{timeout: time.Second},
+			expected: expected{timeout: time.Second},
 		},
 		{
-			name: "file not found",
-			args: args{
-				path: "testdata/sandbox/lem.dummy.toml",
-				opts: nil,
-			},
-			expected: expected{
-				cfg:     nil,
-				isError: true,
-			},
+			name:     "zero",
+			args:     args{timeout: 0},
+			expected: expected{timeout: 0},
 		},
 		{
-			name: "is a directory",
-			args: args{
-				path: "testdata/sandbox/",
-				opts: nil,
-			},
-			expected: expected{
-				cfg:     nil,
-				isError: true,
-			},
+			name:     "negative",
+			args:     args{timeout: -time.Second},
+			expected: expected{timeout: 0},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			cfg, err := Load(tt.args.path, tt.args.opts...)
-			if (err != nil) && tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-			assert.Equal(t, tt.expected.cfg, cfg)
+			actual := &Config{}
+			WithTimeout(tt.args.timeout)(actual)
+			assert.Equal(t, tt.expected.timeout, actual.timeout)
 		})
 	}
 }
 
-func TestConfig_Validate(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
+func TestWithHTTPTimeout(t *testing.T) {
+	type args struct {
+		timeout time.Duration
 	}
 	type expected struct {
-		isError bool
+		timeout time.Duration
 	}
 	tests := []struct {
 		name     string
-		fields   fields
+		args     args
 		expected expected
 	}{
 		{
-			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-					"ui": {
-						Prefix:      "UI",
-						Dir:         "testdata/sandbox/ui",
-						Replaceable: []string{"REPLACEABLE1"},
-						IsCheck:     false,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
-			},
-			expected: expected{
-				isError: false,
-			},
+			name:     "basic",
+			args:     args{timeout: time.Second},
+			expected: expected{timeout: time.Second},
+		},
+		{
+			name:     "zero",
+			args:     args{timeout: 0},
+			expected: expected{timeout: 30 * time.Second},
+		},
+		{
+			name:     "negative",
+			args:     args{timeout: -time.Second},
+			expected: expected{timeout: 30 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithHTTPTimeout(tt.args.timeout)(actual)
+			assert.Equal(t, tt.expected.timeout, actual.httpTimeout)
+		})
+	}
+}
+
+func TestWithTrimValues(t *testing.T) {
+	type args struct {
+		trim bool
+	}
+	type expected struct {
+		rawValues bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{trim: true},
+			expected: expected{rawValues: false},
+		},
+		{
+			name:     "false",
+			args:     args{trim: false},
+			expected: expected{rawValues: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithTrimValues(tt.args.trim)(actual)
+			assert.Equal(t, tt.expected.rawValues, actual.rawValues)
+		})
+	}
+}
+
+func TestWithNormalizeValues(t *testing.T) {
+	type args struct {
+		normalize bool
+	}
+	type expected struct {
+		normalize bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{normalize: true},
+			expected: expected{normalize: true},
+		},
+		{
+			name:     "false",
+			args:     args{normalize: false},
+			expected: expected{normalize: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithNormalizeValues(tt.args.normalize)(actual)
+			assert.Equal(t, tt.expected.normalize, actual.normalize)
+		})
+	}
+}
+
+func TestWithKVSeparator(t *testing.T) {
+	type args struct {
+		sep string
+	}
+	type expected struct {
+		kvSep string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "colon",
+			args:     args{sep: ":"},
+			expected: expected{kvSep: ":"},
+		},
+		{
+			name:     "empty",
+			args:     args{sep: ""},
+			expected: expected{kvSep: "="},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithKVSeparator(tt.args.sep)(actual)
+			assert.Equal(t, tt.expected.kvSep, actual.kvSep)
+		})
+	}
+}
+
+func TestWithOutputSeparator(t *testing.T) {
+	type args struct {
+		sep string
+	}
+	type expected struct {
+		outSep string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "colon space",
+			args:     args{sep: ": "},
+			expected: expected{outSep: ": "},
+		},
+		{
+			name:     "empty",
+			args:     args{sep: ""},
+			expected: expected{outSep: "="},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithOutputSeparator(tt.args.sep)(actual)
+			assert.Equal(t, tt.expected.outSep, actual.outSep)
+		})
+	}
+}
+
+func TestWithDuplicateKeyPolicy(t *testing.T) {
+	type args struct {
+		policy string
+	}
+	type expected struct {
+		dupPolicy string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "warn",
+			args:     args{policy: DuplicateKeyWarn},
+			expected: expected{dupPolicy: DuplicateKeyWarn},
+		},
+		{
+			name:     "error",
+			args:     args{policy: DuplicateKeyError},
+			expected: expected{dupPolicy: DuplicateKeyError},
+		},
+		{
+			name:     "empty",
+			args:     args{policy: ""},
+			expected: expected{dupPolicy: DuplicateKeyAllow},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithDuplicateKeyPolicy(tt.args.policy)(actual)
+			assert.Equal(t, tt.expected.dupPolicy, actual.dupPolicy)
+		})
+	}
+}
+
+func TestWithFormat(t *testing.T) {
+	type args struct {
+		format string
+	}
+	type expected struct {
+		format string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "strict",
+			args:     args{format: FormatStrict},
+			expected: expected{format: "strict"},
+		},
+		{
+			name:     "empty",
+			args:     args{format: ""},
+			expected: expected{format: "raw"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithFormat(tt.args.format)(actual)
+			assert.Equal(t, tt.expected.format, actual.format)
+		})
+	}
+}
+
+func TestWithLineEnding(t *testing.T) {
+	type args struct {
+		eol string
+	}
+	type expected struct {
+		lineEnding string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "lf",
+			args:     args{eol: LineEndingLF},
+			expected: expected{lineEnding: LineEndingLF},
+		},
+		{
+			name:     "crlf",
+			args:     args{eol: LineEndingCRLF},
+			expected: expected{lineEnding: LineEndingCRLF},
+		},
+		{
+			name:     "empty",
+			args:     args{eol: ""},
+			expected: expected{lineEnding: LineEndingLF},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithLineEnding(tt.args.eol)(actual)
+			assert.Equal(t, tt.expected.lineEnding, actual.lineEnding)
+		})
+	}
+}
+
+func TestWithOutputRoot(t *testing.T) {
+	type args struct {
+		dir string
+	}
+	type expected struct {
+		outputRoot string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "basic",
+			args:     args{dir: "out"},
+			expected: expected{outputRoot: "out"},
+		},
+		{
+			name:     "empty",
+			args:     args{dir: ""},
+			expected: expected{outputRoot: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithOutputRoot(tt.args.dir)(actual)
+			assert.Equal(t, tt.expected.outputRoot, actual.outputRoot)
+		})
+	}
+}
+
+func TestWithContinueOnError(t *testing.T) {
+	type args struct {
+		continueOnError bool
+	}
+	type expected struct {
+		continueOnError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{continueOnError: true},
+			expected: expected{continueOnError: true},
+		},
+		{
+			name:     "false",
+			args:     args{continueOnError: false},
+			expected: expected{continueOnError: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithContinueOnError(tt.args.continueOnError)(actual)
+			assert.Equal(t, tt.expected.continueOnError, actual.continueOnError)
+		})
+	}
+}
+
+func TestWithStrict(t *testing.T) {
+	type args struct {
+		strict bool
+	}
+	type expected struct {
+		strict bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{strict: true},
+			expected: expected{strict: true},
+		},
+		{
+			name:     "false",
+			args:     args{strict: false},
+			expected: expected{strict: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithStrict(tt.args.strict)(actual)
+			assert.Equal(t, tt.expected.strict, actual.strict)
+		})
+	}
+}
+
+func TestWithAllStages(t *testing.T) {
+	type args struct {
+		allStages bool
+	}
+	type expected struct {
+		allStages bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{allStages: true},
+			expected: expected{allStages: true},
+		},
+		{
+			name:     "false",
+			args:     args{allStages: false},
+			expected: expected{allStages: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithAllStages(tt.args.allStages)(actual)
+			assert.Equal(t, tt.expected.allStages, actual.allStages)
+		})
+	}
+}
+
+func TestWithNamingPattern(t *testing.T) {
+	type args struct {
+		pattern string
+	}
+	type expected struct {
+		namingPattern string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "basic",
+			args:     args{pattern: "[A-Z]+"},
+			expected: expected{namingPattern: "[A-Z]+"},
+		},
+		{
+			name:     "empty",
+			args:     args{pattern: ""},
+			expected: expected{namingPattern: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithNamingPattern(tt.args.pattern)(actual)
+			assert.Equal(t, tt.expected.namingPattern, actual.namingPattern)
+		})
+	}
+}
+
+func TestWithEnvPath(t *testing.T) {
+	type args struct {
+		path string
+	}
+	type expected struct {
+		envPath string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "basic",
+			args:     args{path: "./candidate.env"},
+			expected: expected{envPath: "./candidate.env"},
+		},
+		{
+			name:     "empty",
+			args:     args{path: ""},
+			expected: expected{envPath: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithEnvPath(tt.args.path)(actual)
+			assert.Equal(t, tt.expected.envPath, actual.envPath)
+		})
+	}
+}
+
+func TestWithIncludes(t *testing.T) {
+	type args struct {
+		includes bool
+	}
+	type expected struct {
+		includes bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{includes: true},
+			expected: expected{includes: true},
+		},
+		{
+			name:     "false",
+			args:     args{includes: false},
+			expected: expected{includes: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithIncludes(tt.args.includes)(actual)
+			assert.Equal(t, tt.expected.includes, actual.includes)
+		})
+	}
+}
+
+func TestWithDirectives(t *testing.T) {
+	type args struct {
+		directives bool
+	}
+	type expected struct {
+		directives bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{directives: true},
+			expected: expected{directives: true},
+		},
+		{
+			name:     "false",
+			args:     args{directives: false},
+			expected: expected{directives: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithDirectives(tt.args.directives)(actual)
+			assert.Equal(t, tt.expected.directives, actual.directives)
+		})
+	}
+}
+
+func TestWithSourceOrder(t *testing.T) {
+	type args struct {
+		sourceOrder bool
+	}
+	type expected struct {
+		sourceOrder bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{sourceOrder: true},
+			expected: expected{sourceOrder: true},
+		},
+		{
+			name:     "false",
+			args:     args{sourceOrder: false},
+			expected: expected{sourceOrder: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithSourceOrder(tt.args.sourceOrder)(actual)
+			assert.Equal(t, tt.expected.sourceOrder, actual.sourceOrder)
+		})
+	}
+}
+
+func TestWithStoreHash(t *testing.T) {
+	type args struct {
+		storeHash bool
+	}
+	type expected struct {
+		storeHash bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{storeHash: true},
+			expected: expected{storeHash: true},
+		},
+		{
+			name:     "false",
+			args:     args{storeHash: false},
+			expected: expected{storeHash: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithStoreHash(tt.args.storeHash)(actual)
+			assert.Equal(t, tt.expected.storeHash, actual.storeHash)
+		})
+	}
+}
+
+func TestWithChecksums(t *testing.T) {
+	type args struct {
+		checksums bool
+	}
+	type expected struct {
+		checksums bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{checksums: true},
+			expected: expected{checksums: true},
+		},
+		{
+			name:     "false",
+			args:     args{checksums: false},
+			expected: expected{checksums: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithChecksums(tt.args.checksums)(actual)
+			assert.Equal(t, tt.expected.checksums, actual.checksums)
+		})
+	}
+}
+
+func TestWithDirenvCycles(t *testing.T) {
+	type args struct {
+		direnvCycles bool
+	}
+	type expected struct {
+		direnvCycles bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{direnvCycles: true},
+			expected: expected{direnvCycles: true},
+		},
+		{
+			name:     "false",
+			args:     args{direnvCycles: false},
+			expected: expected{direnvCycles: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithDirenvCycles(tt.args.direnvCycles)(actual)
+			assert.Equal(t, tt.expected.direnvCycles, actual.direnvCycles)
+		})
+	}
+}
+
+func TestWithDryRun(t *testing.T) {
+	type args struct {
+		dryRun bool
+	}
+	type expected struct {
+		dryRun bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{dryRun: true},
+			expected: expected{dryRun: true},
+		},
+		{
+			name:     "false",
+			args:     args{dryRun: false},
+			expected: expected{dryRun: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithDryRun(tt.args.dryRun)(actual)
+			assert.Equal(t, tt.expected.dryRun, actual.dryRun)
+		})
+	}
+}
+
+func TestWithBackup(t *testing.T) {
+	type args struct {
+		backup bool
+	}
+	type expected struct {
+		backup bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{backup: true},
+			expected: expected{backup: true},
+		},
+		{
+			name:     "false",
+			args:     args{backup: false},
+			expected: expected{backup: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithBackup(tt.args.backup)(actual)
+			assert.Equal(t, tt.expected.backup, actual.backup)
+		})
+	}
+}
+
+func TestWithTiming(t *testing.T) {
+	type args struct {
+		timing bool
+	}
+	type expected struct {
+		timing bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{timing: true},
+			expected: expected{timing: true},
+		},
+		{
+			name:     "false",
+			args:     args{timing: false},
+			expected: expected{timing: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithTiming(tt.args.timing)(actual)
+			assert.Equal(t, tt.expected.timing, actual.timing)
+		})
+	}
+}
+
+func TestWithEnvOverrides(t *testing.T) {
+	type args struct {
+		envOverrides bool
+	}
+	type expected struct {
+		envOverrides bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{envOverrides: true},
+			expected: expected{envOverrides: true},
+		},
+		{
+			name:     "false",
+			args:     args{envOverrides: false},
+			expected: expected{envOverrides: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithEnvOverrides(tt.args.envOverrides)(actual)
+			assert.Equal(t, tt.expected.envOverrides, actual.envOverrides)
+		})
+	}
+}
+
+func TestWithIncremental(t *testing.T) {
+	type args struct {
+		incremental bool
+	}
+	type expected struct {
+		incremental bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{incremental: true},
+			expected: expected{incremental: true},
+		},
+		{
+			name:     "false",
+			args:     args{incremental: false},
+			expected: expected{incremental: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithIncremental(tt.args.incremental)(actual)
+			assert.Equal(t, tt.expected.incremental, actual.incremental)
+		})
+	}
+}
+
+func TestWithOnlyChanged(t *testing.T) {
+	type args struct {
+		onlyChanged bool
+	}
+	type expected struct {
+		onlyChanged bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{onlyChanged: true},
+			expected: expected{onlyChanged: true},
+		},
+		{
+			name:     "false",
+			args:     args{onlyChanged: false},
+			expected: expected{onlyChanged: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithOnlyChanged(tt.args.onlyChanged)(actual)
+			assert.Equal(t, tt.expected.onlyChanged, actual.onlyChanged)
+		})
+	}
+}
+
+func TestWithStageFile(t *testing.T) {
+	type args struct {
+		stageFile bool
+	}
+	type expected struct {
+		stageFile bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{stageFile: true},
+			expected: expected{stageFile: true},
+		},
+		{
+			name:     "false",
+			args:     args{stageFile: false},
+			expected: expected{stageFile: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithStageFile(tt.args.stageFile)(actual)
+			assert.Equal(t, tt.expected.stageFile, actual.stageFile)
+		})
+	}
+}
+
+func TestWithOutputFormat(t *testing.T) {
+	type args struct {
+		format string
+	}
+	type expected struct {
+		outputFormat string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "json",
+			args:     args{format: OutputJSON},
+			expected: expected{outputFormat: "json"},
+		},
+		{
+			name:     "empty",
+			args:     args{format: ""},
+			expected: expected{outputFormat: "text"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithOutputFormat(tt.args.format)(actual)
+			assert.Equal(t, tt.expected.outputFormat, actual.outputFormat)
+		})
+	}
+}
+
+func TestWithGroups(t *testing.T) {
+	type args struct {
+		ids []string
+	}
+	type expected struct {
+		only []string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "basic",
+			args:     args{ids: []string{"api", "ui"}},
+			expected: expected{only: []string{"api", "ui"}},
+		},
+		{
+			name:     "empty",
+			args:     args{ids: nil},
+			expected: expected{only: nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithGroups(tt.args.ids...)(actual)
+			assert.Equal(t, tt.expected.only, actual.only)
+		})
+	}
+}
+
+func TestWithRootMarkers(t *testing.T) {
+	type args struct {
+		markers []string
+	}
+	type expected struct {
+		rootMarkers []string
+		markers     []string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "basic",
+			args:     args{markers: []string{".hg", "go.work"}},
+			expected: expected{rootMarkers: []string{".hg", "go.work"}, markers: []string{".hg", "go.work"}},
+		},
+		{
+			name:     "empty names",
+			args:     args{markers: []string{"", ".lemroot"}},
+			expected: expected{rootMarkers: []string{".lemroot"}, markers: []string{".lemroot"}},
+		},
+		{
+			name:     "nil",
+			args:     args{markers: nil},
+			expected: expected{rootMarkers: nil, markers: []string{dummyGitDir}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithRootMarkers(tt.args.markers)(actual)
+			assert.Equal(t, tt.expected.rootMarkers, actual.rootMarkers)
+			assert.Equal(t, tt.expected.markers, actual.markers())
+		})
+	}
+}
+
+func TestWithAllowExternal(t *testing.T) {
+	type args struct {
+		allow bool
+	}
+	type expected struct {
+		allowExternal bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name:     "true",
+			args:     args{allow: true},
+			expected: expected{allowExternal: true},
+		},
+		{
+			name:     "false",
+			args:     args{allow: false},
+			expected: expected{allowExternal: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &Config{}
+			WithAllowExternal(tt.args.allow)(actual)
+			assert.Equal(t, tt.expected.allowExternal, actual.allowExternal)
+		})
+	}
+}
+
+func TestInit(t *testing.T) {
+	t.Chdir(t.TempDir())
+	assert.NoError(t, Init())
+	cfg := &Config{}
+	_, err := toml.DecodeFile(initConfigPath, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "API", cfg.Group["api"].Prefix)
+	assert.Equal(t, "./backend", cfg.Group["api"].Dir)
+}
+
+func TestInitWith(t *testing.T) {
+	type args struct {
+		prefix string
+		dir    string
+	}
+	type expected struct {
+		groups  map[string]Group
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "default",
+			args: args{},
+			expected: expected{
+				groups: map[string]Group{
+					"api": {Prefix: "API", Dir: "./backend", Replaceable: []string{"REPLACEABLE1"}, Plain: []string{"PLAIN1"}, DirenvSupport: []string{"api"}, IsCheck: true},
+					"ui":  {Prefix: "UI", Dir: "./frontend", Replaceable: []string{"REPLACEABLE2"}, Plain: []string{"PLAIN2"}, DirenvSupport: []string{"ui"}, IsCheck: true},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "custom",
+			args: args{prefix: "billing", dir: "./services/billing"},
+			expected: expected{
+				groups: map[string]Group{
+					"billing": {Prefix: "BILLING", Dir: "./services/billing", Replaceable: []string{"REPLACEABLE1"}, Plain: []string{"PLAIN1"}, DirenvSupport: []string{"billing"}, IsCheck: true},
+					"ui":      {Prefix: "UI", Dir: "./frontend", Replaceable: []string{"REPLACEABLE2"}, Plain: []string{"PLAIN2"}, DirenvSupport: []string{"ui"}, IsCheck: true},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "same as ui",
+			args: args{prefix: "UI", dir: "./web"},
+			expected: expected{
+				groups: map[string]Group{
+					"ui": {Prefix: "UI", Dir: "./web", Replaceable: []string{"REPLACEABLE1"}, Plain: []string{"PLAIN1"}, DirenvSupport: []string{"ui"}, IsCheck: true},
+				},
+				isError: false,
+			},
+		},
+		{
+			name:     "quote in dir",
+			args:     args{prefix: "API", dir: `./back"end`},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "dot in prefix",
+			args:     args{prefix: "MY.APP", dir: "./app"},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "quote in prefix",
+			args:     args{prefix: `A"PI`, dir: "./app"},
+			expected: expected{isError: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			err := InitWith(tt.args.prefix, tt.args.dir)
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			cfg := &Config{}
+			_, err = toml.DecodeFile(initConfigPath, cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.groups, cfg.Group)
+		})
+	}
+}
+
+func TestScaffold(t *testing.T) {
+	type args struct {
+		dir string
+	}
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		setup    func(t *testing.T) string
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				dir: "testdata/sandbox",
+			},
+			expected: expected{
+				output: `[group.api]
+prefix = "API"
+dir    = "./testdata/sandbox/api"
+
+[group.master]
+prefix = "MASTER"
+dir    = "./testdata/sandbox/master"
+
+[group.ui]
+prefix = "UI"
+dir    = "./testdata/sandbox/ui"
+`,
+				isError: false,
+			},
+		},
+		{
+			name: "nested with marker",
+			setup: func(t *testing.T) string {
+				dir := t.TempDir()
+				for _, path := range []string{
+					"services/web-app/.lemgroup",
+					"services/worker/.env",
+					"docs/README.md",
+					".hidden/.env",
+				} {
+					path = filepath.Join(dir, path)
+					if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, nil, 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return dir
+			},
+			expected: expected{
+				output: `[group.services-web-app]
+prefix = "SERVICES_WEB_APP"
+dir    = "<dir>/services/web-app"
+
+[group.services-worker]
+prefix = "SERVICES_WORKER"
+dir    = "<dir>/services/worker"
+`,
+				isError: false,
+			},
+		},
+		{
+			name: "no group directory",
+			args: args{
+				dir: "testdata/sandbox/api",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+		},
+		{
+			name: "not found",
+			args: args{
+				dir: "testdata/dummy",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tt.args.dir
+			if tt.setup != nil {
+				dir = tt.setup(t)
+			}
+			w := &bytes.Buffer{}
+			err := Scaffold(w, dir)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, strings.ReplaceAll(tt.expected.output, "<dir>", filepath.ToSlash(dir)), w.String())
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	type args struct {
+		path string
+		opts []Option
+	}
+	type expected struct {
+		cfg     *Config
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				path: "testdata/sandbox/lem.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+						"dev": {
+							Path:        "master/.env.development",
+							Description: "Development environment",
+							Override: map[string]Override{
+								"ui": {IsCheck: ptr(true)},
+							},
+						},
+						"noexists": {Path: "master/.env.noexists"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:        "API",
+							Dir:           "./api",
+							Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+							Plain:         []string{"FOO", "BAR"},
+							DirenvSupport: []string{"api", "ui"},
+							IsCheck:       true,
+						},
+						"ui": {
+							Prefix:        "UI",
+							Dir:           "./ui",
+							Replaceable:   []string{"REPLACEABLE1"},
+							Plain:         []string{"BAZ"},
+							DirenvSupport: []string{"ui"},
+							IsCheck:       false,
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/lem.toml")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            os.Stdout,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "with options",
+			args: args{
+				path: "testdata/sandbox/lem.toml",
+				opts: []Option{
+					WithSize(1),
+					WithWriter(&bytes.Buffer{}),
+				},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+						"dev": {
+							Path:        "master/.env.development",
+							Description: "Development environment",
+							Override: map[string]Override{
+								"ui": {IsCheck: ptr(true)},
+							},
+						},
+						"noexists": {Path: "master/.env.noexists"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:        "API",
+							Dir:           "./api",
+							Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+							Plain:         []string{"FOO", "BAR"},
+							DirenvSupport: []string{"api", "ui"},
+							IsCheck:       true,
+						},
+						"ui": {
+							Prefix:        "UI",
+							Dir:           "./ui",
+							Replaceable:   []string{"REPLACEABLE1"},
+							Plain:         []string{"BAZ"},
+							DirenvSupport: []string{"ui"},
+							IsCheck:       false,
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/lem.toml")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         1,
+					w:            &bytes.Buffer{},
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "extends",
+			args: args{
+				path: "testdata/sandbox/lem.extends.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:      "API",
+							Dir:         "./api",
+							Replaceable: []string{"REPLACEABLE1"},
+							Plain:       []string{"FOO"},
+							IsCheck:     true,
+						},
+						"worker": {
+							Prefix:      "API",
+							Dir:         "./ui",
+							Replaceable: []string{"REPLACEABLE1"},
+							Plain:       []string{"FOO", "BAR"},
+							IsCheck:     true,
+							Extends:     "api",
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/lem.extends.toml")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            os.Stdout,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "extends cycle",
+			args: args{
+				path: "testdata/sandbox/lem.cycle.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "empty file",
+			args: args{
+				path: "testdata/sandbox/lem.empty.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: nil,
+					Group: nil,
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/lem.empty.toml")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            os.Stdout,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "invalid file",
+			args: args{
+				path: "testdata/sandbox/lem.invalid.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "file not found",
+			args: args{
+				path: "testdata/sandbox/lem.dummy.toml",
+				opts: nil,
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "is a directory",
+			args: args{
+				path: "testdata/sandbox/",
+				opts: nil,
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.args.path, tt.args.opts...)
+			if (err != nil) && tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.cfg, cfg)
+		})
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	type args struct {
+		r       io.Reader
+		baseDir string
+		opts    []Option
+	}
+	type expected struct {
+		cfg     *Config
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[group.api]\nprefix = \"API\"\ndir = \"./api\"\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix: "API",
+							Dir:    "./api",
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/<stdin>")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            io.Discard,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "group defaults",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[groupDefaults]\ncheck = true\nfilename = \".env.local\"\nplain = [\"FOO\"]\ndefaults = { FOO = \"foo\" }\n[defaults]\ncheck = false\n[group.api]\ndir = \"./api\"\nplain = [\"BAR\"]\n[group.ui]\ndir = \"./ui\"\nfilename = \".env\"\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:   "API",
+							Dir:      "./api",
+							Filename: ".env.local",
+							Plain:    []string{"FOO", "BAR"},
+							IsCheck:  true,
+							Defaults: map[string]string{"FOO": "foo"},
+						},
+						"ui": {
+							Prefix:   "UI",
+							Dir:      "./ui",
+							Filename: ".env",
+							Plain:    []string{"FOO"},
+							IsCheck:  true,
+							Defaults: map[string]string{"FOO": "foo"},
+						},
+					},
+					GroupDefaults: Group{
+						Filename: ".env.local",
+						Plain:    []string{"FOO"},
+						IsCheck:  true,
+						Defaults: map[string]string{"FOO": "foo"},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/<stdin>")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            io.Discard,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "group defaults overridden by explicit flags",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[groupDefaults]\ncheck = true\nskipEmpty = true\n[group.api]\ndir = \"./api\"\ncheck = false\n[group.ui]\ndir = \"./ui\"\nskipEmpty = false\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:    "API",
+							Dir:       "./api",
+							IsCheck:   false,
+							SkipEmpty: true,
+						},
+						"ui": {
+							Prefix:    "UI",
+							Dir:       "./ui",
+							IsCheck:   true,
+							SkipEmpty: false,
+						},
+					},
+					GroupDefaults: Group{
+						IsCheck:   true,
+						SkipEmpty: true,
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/<stdin>")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            io.Discard,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "extends overridden by explicit flags",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[group.api]\ndir = \"./api\"\ncheck = true\nskipEmpty = true\n[group.worker]\nextends = \"api\"\ndir = \"./ui\"\ncheck = false\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix:    "API",
+							Dir:       "./api",
+							IsCheck:   true,
+							SkipEmpty: true,
+						},
+						"worker": {
+							Prefix:    "WORKER",
+							Dir:       "./ui",
+							IsCheck:   false,
+							SkipEmpty: true,
+							Extends:   "api",
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/<stdin>")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            io.Discard,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "group defaults with dir",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[groupDefaults]\ndir = \"./api\"\n[group.api]\nprefix = \"API\"\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "default prefix",
+			args: args{
+				r:       strings.NewReader("[stage]\ndefault = \"master/.env\"\n[group.api]\ndir = \"./api\"\n[group.api-worker]\ndir = \"./api\"\nfilename = \".env.worker\"\n[group.ui]\nprefix = \"WEB\"\ndir = \"./ui\"\n"),
+				baseDir: "testdata/sandbox",
+				opts:    []Option{WithWriter(io.Discard)},
+			},
+			expected: expected{
+				cfg: &Config{
+					Stage: map[string]Stage{
+						"default": {Path: "master/.env"},
+					},
+					Group: map[string]Group{
+						"api": {
+							Prefix: "API",
+							Dir:    "./api",
+						},
+						"api-worker": {
+							Prefix:   "API_WORKER",
+							Dir:      "./api",
+							Filename: ".env.worker",
+						},
+						"ui": {
+							Prefix: "WEB",
+							Dir:    "./ui",
+						},
+					},
+					path: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/<stdin>")
+						return path
+					}(),
+					dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					root: func() string {
+						path, _ := filepath.Abs("testdata/sandbox")
+						return path
+					}(),
+					size:         32,
+					w:            io.Discard,
+					attempts:     1,
+					kvSep:        "=",
+					dupPolicy:    "allow",
+					format:       "raw",
+					outputFormat: "text",
+					lineEnding:   "lf",
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "invalid toml",
+			args: args{
+				r:       strings.NewReader("[stage\n"),
+				baseDir: "testdata/sandbox",
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "base dir not found",
+			args: args{
+				r:       strings.NewReader(""),
+				baseDir: "testdata/sandbox/dummy",
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+		{
+			name: "base dir is a file",
+			args: args{
+				r:       strings.NewReader(""),
+				baseDir: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				cfg:     nil,
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadReader(tt.args.r, tt.args.baseDir, tt.args.opts...)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.cfg, cfg)
+		})
+	}
+}
+
+func TestStage_UnmarshalTOML(t *testing.T) {
+	type args struct {
+		v any
+	}
+	type expected struct {
+		stage   Stage
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "string",
+			args: args{
+				v: "master/.env",
+			},
+			expected: expected{
+				stage:   Stage{Path: "master/.env"},
+				isError: false,
+			},
+		},
+		{
+			name: "table",
+			args: args{
+				v: map[string]any{
+					"path":        "master/.env",
+					"description": "Default environment",
+				},
+			},
+			expected: expected{
+				stage:   Stage{Path: "master/.env", Description: "Default environment"},
+				isError: false,
+			},
+		},
+		{
+			name: "table without description",
+			args: args{
+				v: map[string]any{
+					"path": "master/.env",
+				},
+			},
+			expected: expected{
+				stage:   Stage{Path: "master/.env"},
+				isError: false,
+			},
+		},
+		{
+			name: "table with dir",
+			args: args{
+				v: map[string]any{
+					"path": "master",
+					"dir":  true,
+				},
+			},
+			expected: expected{
+				stage:   Stage{Path: "master", Dir: true},
+				isError: false,
+			},
+		},
+		{
+			name: "dir invalid type",
+			args: args{
+				v: map[string]any{
+					"path": "master",
+					"dir":  "true",
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "table with override",
+			args: args{
+				v: map[string]any{
+					"path": "master/.env",
+					"override": map[string]any{
+						"api": map[string]any{
+							"dir":      "./deploy/api",
+							"filename": ".env.local",
+							"check":    false,
+						},
+					},
+				},
+			},
+			expected: expected{
+				stage: Stage{
+					Path: "master/.env",
+					Override: map[string]Override{
+						"api": {Dir: "./deploy/api", Filename: ".env.local", IsCheck: ptr(false)},
+					},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "override is not a table",
+			args: args{
+				v: map[string]any{
+					"path":     "master/.env",
+					"override": "dummy",
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "override unknown key",
+			args: args{
+				v: map[string]any{
+					"path": "master/.env",
+					"override": map[string]any{
+						"api": map[string]any{
+							"prefix": "API",
+						},
+					},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "override invalid type",
+			args: args{
+				v: map[string]any{
+					"path": "master/.env",
+					"override": map[string]any{
+						"api": map[string]any{
+							"check": "true",
+						},
+					},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "override group is not a table",
+			args: args{
+				v: map[string]any{
+					"path": "master/.env",
+					"override": map[string]any{
+						"api": "dummy",
+					},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "unknown key",
+			args: args{
+				v: map[string]any{
+					"path":  "master/.env",
+					"dummy": "dummy",
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "non-string value",
+			args: args{
+				v: map[string]any{
+					"path": int64(1),
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid type",
+			args: args{
+				v: int64(1),
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual Stage
+			err := actual.UnmarshalTOML(tt.args.v)
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.stage, actual)
+		})
+	}
+}
+
+func TestConfig_Import(t *testing.T) {
+	type args struct {
+		prefixFromGroup bool
+		outSep          string
+	}
+	type expected struct {
+		output    string
+		conflicts []ImportConflict
+		isError   bool
+	}
+	tests := []struct {
+		name     string
+		group    map[string]Group
+		dirs     []string
+		files    map[string]string
+		args     args
+		expected expected
+	}{
+		{
+			name: "prefix from group",
+			group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api", Plain: []string{"PORT"}},
+				"ui":  {Prefix: "UI", Dir: "ui"},
+				"job": {Prefix: "JOB", Dir: "job"},
+			},
+			dirs: []string{"api", "ui", "job"},
+			files: map[string]string{
+				"api/.env": "API_URL=https://example.com\nTOKEN=abc\nPORT=8080\n",
+				"ui/.env":  "THEME=dark\n",
+			},
+			args: args{prefixFromGroup: true},
+			expected: expected{
+				output:    "API_TOKEN=abc\nAPI_URL=https://example.com\nPORT=8080\nUI_THEME=dark\n",
+				conflicts: []ImportConflict{},
+				isError:   false,
+			},
+		},
+		{
+			name: "output separator not applied",
+			group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+			},
+			dirs: []string{"api"},
+			files: map[string]string{
+				"api/.env": "API_URL=https://example.com\n",
+			},
+			args: args{outSep: ": "},
+			expected: expected{
+				output:    "API_URL=https://example.com\n",
+				conflicts: []ImportConflict{},
+				isError:   false,
+			},
+		},
+		{
+			name: "conflicts",
+			group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+				"ui":  {Prefix: "UI", Dir: "ui"},
+				"web": {Prefix: "WEB", Dir: "web"},
+			},
+			dirs: []string{"api", "ui", "web"},
+			files: map[string]string{
+				"api/.env": "PORT=8080\nHOST=localhost\n",
+				"ui/.env":  "PORT=3000\nHOST=localhost\n",
+				"web/.env": "PORT=80\n",
+			},
+			args: args{prefixFromGroup: false},
+			expected: expected{
+				output: "HOST=localhost\nPORT=8080\n",
+				conflicts: []ImportConflict{
+					{Key: "PORT", Groups: []string{"api", "ui", "web"}},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "keys mapped to the same key",
+			group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+				"ui":  {Prefix: "UI", Dir: "ui"},
+			},
+			dirs: []string{"api", "ui"},
+			files: map[string]string{
+				"api/.env": "FOO=1\nAPI_FOO=2\nBAR=x\nAPI_BAR=x\n",
+				"ui/.env":  "API_FOO=3\n",
+			},
+			args: args{prefixFromGroup: true},
+			expected: expected{
+				output: "API_BAR=x\nAPI_FOO=2\nUI_API_FOO=3\n",
+				conflicts: []ImportConflict{
+					{Key: "API_FOO", Groups: []string{"api"}, Keys: []string{"API_FOO", "FOO"}},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "group dir not found",
+			group: map[string]Group{
+				"api": {Prefix: "API", Dir: "dummy"},
+			},
+			dirs:  []string{},
+			files: map[string]string{},
+			args:  args{prefixFromGroup: true},
+			expected: expected{
+				output:    "",
+				conflicts: nil,
+				isError:   true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, d := range tt.dirs {
+				if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := &bytes.Buffer{}
+			order := map[string]int{"CENTRAL": 0}
+			cfg := &Config{
+				Group:  tt.group,
+				dir:    dir,
+				root:   dir,
+				size:   32,
+				outSep: tt.args.outSep,
+				order:  order,
+			}
+			conflicts, err := cfg.Import(w, tt.args.prefixFromGroup)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+			assert.Equal(t, tt.expected.conflicts, conflicts)
+			assert.Equal(t, tt.args.outSep, cfg.outSep)
+			assert.Equal(t, map[string]int{"CENTRAL": 0}, cfg.order)
+		})
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	type args struct {
+		a string
+		b string
+	}
+	type expected struct {
+		diffs   []ConfigDiff
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				a: "testdata/sandbox/lem.toml",
+				b: "testdata/sandbox/lem.diff.toml",
+			},
+			expected: expected{
+				diffs: []ConfigDiff{
+					{Table: "group", ID: "misc", Change: "added"},
+					{Table: "group", ID: "ui", Change: "changed", Fields: []string{"dir", "plain"}},
+					{Table: "stage", ID: "dev", Change: "changed", Fields: []string{"description", "override"}},
+					{Table: "stage", ID: "noexists", Change: "removed"},
+					{Table: "stage", ID: "stg", Change: "added"},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "same",
+			args: args{
+				a: "testdata/sandbox/lem.toml",
+				b: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				diffs:   []ConfigDiff{},
+				isError: false,
+			},
+		},
+		{
+			name: "not found",
+			args: args{
+				a: "testdata/sandbox/lem.toml",
+				b: "testdata/sandbox/lem.dummy.toml",
+			},
+			expected: expected{
+				diffs:   nil,
+				isError: true,
+			},
+		},
+		{
+			name: "invalid",
+			args: args{
+				a: "testdata/sandbox/lem.invalid.toml",
+				b: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				diffs:   nil,
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, err := DiffConfig(tt.args.a, tt.args.b)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.diffs, diffs)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	type fields struct {
+		Stage      map[string]Stage
+		Group      map[string]Group
+		Separator  string
+		path       string
+		size       int
+		w          io.Writer
+		dupPolicy  string
+		lineEnding string
+	}
+	type expected struct {
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						IsCheck:     false,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: false,
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						IsCheck:     false,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid stage path",
+			fields: fields{
+				Stage: map[string]Stage{
+					"dummy": {Path: "../.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						IsCheck:     false,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "stage path not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "./.dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						IsCheck:     false,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "stage is a directory",
+			fields: fields{
+				Stage: map[string]Stage{
+					"dummy": {Path: "testdata/sandbox"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						IsCheck:     false,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group table not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     os.Stdout,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "empty group prefix",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "empty group dir",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid group path",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "../api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group path not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api/.env",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group path is not a directory",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/dummy",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group replaceable array contains empty string",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api/",
+						Replaceable: []string{"FOO", ""},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group plain array contains empty string",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:  "API",
+						Dir:     "testdata/sandbox/api/",
+						Plain:   []string{"FOO", "BAR", ""},
+						IsCheck: true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group defaults contains empty key",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:   "API",
+						Dir:      "testdata/sandbox/api/",
+						Defaults: map[string]string{"API_TIMEOUT": "30", "": "x"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group direnv array contains empty string",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api/",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", ""},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group envrc extra contains empty string",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api/",
+						DirenvSupport: []string{"api"},
+						EnvrcExtra:    []string{"layout go", ""},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group direnv array contains invalid id",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api/",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "invalid"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "group direnv array contains duplicate id",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api/",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "api"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "stage override",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {
+						Path: "testdata/sandbox/master/.env",
+						Override: map[string]Override{
+							"api": {Dir: "testdata/sandbox/ui", Filename: ".env.local", IsCheck: ptr(false)},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:  "API",
+						Dir:     "testdata/sandbox/api",
+						IsCheck: true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: false,
+			},
+		},
+		{
+			name: "stage override for unknown group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {
+						Path: "testdata/sandbox/master/.env",
+						Override: map[string]Override{
+							"dummy": {Dir: "testdata/sandbox/ui"},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "stage override with invalid dir",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {
+						Path: "testdata/sandbox/master/.env",
+						Override: map[string]Override{
+							"api": {Dir: "testdata/sandbox/dummy"},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid filename",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:   "API",
+						Dir:      "testdata/sandbox/api",
+						Filename: "../.env",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "valid separator",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				Separator: "__",
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+			},
+			expected: expected{
+				isError: false,
+			},
+		},
+		{
+			name: "invalid separator",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				Separator: "=",
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "too long separator",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				Separator: "___",
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "duplicate key error",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+					},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+				dupPolicy: DuplicateKeyError,
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid duplicate key policy",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+				dupPolicy: "dummy",
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "invalid line ending",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path:       "testdata/sandbox/lem.toml",
+				size:       32,
+				w:          io.Discard,
+				lineEnding: "cr",
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage:      tt.fields.Stage,
+				Group:      tt.fields.Group,
+				Separator:  tt.fields.Separator,
+				path:       tt.fields.path,
+				size:       tt.fields.size,
+				w:          tt.fields.w,
+				dupPolicy:  tt.fields.dupPolicy,
+				lineEnding: tt.fields.lineEnding,
+			}
+			err := cfg.Validate()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_groupDir(t *testing.T) {
+	type fields struct {
+		dir    string
+		group  Group
+		strict bool
+	}
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "separate dir",
+			fields: fields{
+				dir:   "testdata/sandbox",
+				group: Group{Prefix: "API", Dir: "api"},
+			},
+			expected: expected{
+				output:  "all checks passed!\n",
+				isError: false,
+			},
+		},
+		{
+			name: "configuration directory",
+			fields: fields{
+				dir:   "testdata/sandbox",
+				group: Group{Prefix: "API", Dir: "."},
+			},
+			expected: expected{
+				output:  "warning: group.api: dir is the configuration directory: the env file written there may shadow or be mistaken for the central env\nall checks passed!\n",
+				isError: false,
+			},
+		},
+		{
+			name: "central env directory",
+			fields: fields{
+				dir:   "testdata/sandbox",
+				group: Group{Prefix: "API", Dir: "master"},
+			},
+			expected: expected{
+				output:  "warning: group.api: dir contains the central env of default: the env file written there may shadow or be mistaken for the central env\nall checks passed!\n",
+				isError: false,
+			},
+		},
+		{
+			name: "strict",
+			fields: fields{
+				dir:    "testdata/sandbox",
+				group:  Group{Prefix: "API", Dir: "."},
+				strict: true,
+			},
+			expected: expected{
+				output:  "warning: group.api: dir is the configuration directory: the env file written there may shadow or be mistaken for the central env\n",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				Group:  map[string]Group{"api": tt.fields.group},
+				path:   "testdata/sandbox/lem.toml",
+				dir:    tt.fields.dir,
+				size:   32,
+				w:      w,
+				strict: tt.fields.strict,
+			}
+			err := cfg.Validate()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+		})
+	}
+}
+
+func TestHint(t *testing.T) {
+	type expected struct {
+		hint string
+	}
+	tests := []struct {
+		name     string
+		group    Group
+		expected expected
+	}{
+		{
+			name:  "dir not set",
+			group: Group{Prefix: "API"},
+			expected: expected{
+				hint: "set group.api.dir to the directory the env file is delivered to",
+			},
+		},
+		{
+			name:  "dir is a file",
+			group: Group{Prefix: "API", Dir: "lem.toml"},
+			expected: expected{
+				hint: "group.api.dir points to a file; set it to the containing directory and the file name to group.api.filename",
+			},
+		},
+		{
+			name:  "dir not found",
+			group: Group{Prefix: "API", Dir: "dummy"},
+			expected: expected{
+				hint: "group.api.dir does not exist; create the directory or fix the path relative to testdata/sandbox",
+			},
+		},
+		{
+			name:  "invalid json",
+			group: Group{Prefix: "API", Dir: "api", JSON: "dummy"},
+			expected: expected{
+				hint: "set group.api.json to compact or pretty, or remove it to deliver JSON values as is",
+			},
+		},
+		{
+			name:  "pretty json without strict format",
+			group: Group{Prefix: "API", Dir: "api", JSON: "pretty"},
+			expected: expected{
+				hint: "use the strict format, such as with --format strict, or set group.api.json to compact",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				Group: map[string]Group{"api": tt.group},
+				path:  "testdata/sandbox/lem.toml",
+				dir:   "testdata/sandbox",
+				size:  32,
+				w:     io.Discard,
+			}
+			err := cfg.Validate()
+			assert.Error(t, err)
+			assert.Equal(t, tt.expected.hint, Hint(err))
+		})
+	}
+	assert.Equal(t, "", Hint(errors.New("dummy")))
+	assert.Equal(t, "", Hint(nil))
+}
+
+func TestConfig_Validate_strict(t *testing.T) {
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		strict   bool
+		expected expected
+	}{
+		{
+			name:   "not strict",
+			strict: false,
+			expected: expected{
+				output:  "warning: default: FOO -> group.api, group.ui\nall checks passed!\n",
+				isError: false,
+			},
+		},
+		{
+			name:   "strict",
+			strict: true,
+			expected: expected{
+				output:  "warning: default: FOO -> group.api, group.ui\n",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {Prefix: "API", Dir: "api", Plain: []string{"FOO"}},
+					"ui":  {Prefix: "UI", Dir: "ui", Plain: []string{"FOO"}},
+				},
+				path:   "testdata/sandbox/lem.toml",
+				dir:    "testdata/sandbox",
+				size:   32,
+				w:      w,
+				strict: tt.strict,
+			}
+			err := cfg.Validate()
+			if tt.expected.isError {
+				assert.EqualError(t, err, "failed to validate: warnings reported in strict mode: 1")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+		})
+	}
+}
+
+func TestConfig_Validate_direnvTargets(t *testing.T) {
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", DirenvSupport: []string{"api", "db"}},
+			"ui":  {Prefix: "UI", Dir: "ui", DirenvSupport: []string{"ui"}},
+			"db":  {Prefix: "DB", Dir: "ui", Filename: ".env.db"},
+		},
+		path:   "testdata/sandbox/lem.toml",
+		dir:    "testdata/sandbox",
+		size:   32,
+		w:      w,
+		strict: true,
+	}
+	err := cfg.Validate()
+	assert.EqualError(t, err, "failed to validate: warnings reported in strict mode: 1")
+	assert.Equal(t, "warning: default: group.api: direnv target group.db receives no keys, so the .envrc loads an empty env file\n", w.String())
+}
+
+func TestConfig_checkNaming(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		group    map[string]Group
+		expected string
+		isError  bool
+	}{
+		{
+			name: "default pattern",
+			group: map[string]Group{
+				"api": {Prefix: "api", Plain: []string{"BAZ", "baz"}, Replaceable: []string{"Shared"}},
+				"ui":  {Prefix: "UI_V2", Plain: []string{"EMPTY"}},
+			},
+			expected: "warning: group.api: prefix api does not match the naming pattern [A-Z][A-Z0-9_]*\n" +
+				"warning: group.api: plain baz does not match the naming pattern [A-Z][A-Z0-9_]*\n" +
+				"warning: group.api: replace Shared does not match the naming pattern [A-Z][A-Z0-9_]*\n",
+		},
+		{
+			name:    "custom pattern",
+			pattern: "[a-z]+|[A-Z]+",
+			group: map[string]Group{
+				"api": {Prefix: "api", Plain: []string{"BAZ", "Baz"}},
+			},
+			expected: "warning: group.api: plain Baz does not match the naming pattern [a-z]+|[A-Z]+\n",
+		},
+		{
+			name:    "invalid pattern",
+			pattern: "[A-Z",
+			group: map[string]Group{
+				"api": {Prefix: "API"},
+			},
+			isError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Group:         tt.group,
+				namingPattern: tt.pattern,
+				w:             w,
+			}
+			err := cfg.checkNaming()
+			if tt.isError {
+				assert.ErrorContains(t, err, "failed to validate naming pattern: [A-Z")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, w.String())
+		})
+	}
+}
+
+func TestConfig_checkPrefixOverlap(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    map[string]Group
+		expected string
+	}{
+		{
+			name: "nested",
+			group: map[string]Group{
+				"api":   {Prefix: "API_V2"},
+				"api1":  {Prefix: "API"},
+				"admin": {Prefix: "ADMIN"},
+			},
+			expected: "warning: group.api1: prefix API overlaps prefix API_V2 of group.api, so the keys starting with API_V2_ are delivered to both; use more specific prefixes or deliver those keys as plain\n",
+		},
+		{
+			name: "same",
+			group: map[string]Group{
+				"api": {Prefix: "API"},
+				"web": {Prefix: "API"},
+			},
+			expected: "warning: group.api: prefix API overlaps prefix API of group.web, so the keys starting with API_ are delivered to both; use more specific prefixes or deliver those keys as plain\n",
+		},
+		{
+			name: "string prefix only",
+			group: map[string]Group{
+				"api":  {Prefix: "API"},
+				"apix": {Prefix: "APIX"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Group: tt.group,
+				w:     w,
+			}
+			cfg.checkPrefixOverlap()
+			assert.Equal(t, tt.expected, w.String())
+		})
+	}
+}
+
+func TestConfig_DirenvCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    map[string]Group
+		expected [][]string
+	}{
+		{
+			name: "mutual",
+			group: map[string]Group{
+				"api": {DirenvSupport: []string{"api", "ui"}},
+				"ui":  {DirenvSupport: []string{"api"}},
+			},
+			expected: [][]string{{"api", "ui", "api"}},
+		},
+		{
+			name: "nested",
+			group: map[string]Group{
+				"api":   {DirenvSupport: []string{"web"}},
+				"web":   {DirenvSupport: []string{"admin", "api"}},
+				"admin": {DirenvSupport: []string{"api"}},
+			},
+			expected: [][]string{{"admin", "api", "web", "admin"}, {"api", "web", "api"}},
+		},
+		{
+			name: "self only",
+			group: map[string]Group{
+				"api": {DirenvSupport: []string{"api"}},
+				"ui":  {DirenvSupport: []string{"api", "ui"}},
+			},
+			expected: [][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Group: tt.group}
+			actual, err := cfg.DirenvCycles()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestConfig_checkDirenvCycles(t *testing.T) {
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Group: map[string]Group{
+			"api": {DirenvSupport: []string{"api", "ui"}},
+			"ui":  {DirenvSupport: []string{"api"}},
+		},
+		w: w,
+	}
+	assert.NoError(t, cfg.checkDirenvCycles())
+	assert.Equal(t, "warning: direnv references form a cycle: group.api -> group.ui -> group.api, so the .envrc files load the env files of each other\n", w.String())
+	assert.Equal(t, 1, cfg.warnings)
+}
+
+func TestConfig_Validate_envPathStageVariable(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"master/.env":   "API_STAGE=${LEM_STAGE}\n",
+		"candidate.env": "API_STAGE=${LEM_STAGE}\n",
+		"schema.json":   `{"properties": {"API_STAGE": {"enum": ["default"]}}}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", Schema: "schema.json"},
+		},
+		path:    path,
+		dir:     dir,
+		root:    dir,
+		size:    32,
+		w:       w,
+		envPath: filepath.Join(dir, "candidate.env"),
+	}
+	assert.NoError(t, cfg.Validate())
+	assert.NotContains(t, w.String(), "candidate.env")
+}
+
+func TestConfig_Validate_allStages(t *testing.T) {
+	tests := []struct {
+		name      string
+		allStages bool
+		expected  string
+	}{
+		{
+			name:      "all stages",
+			allStages: true,
+			expected:  "failed to validate stage: error: group.api: empty value: API_1_ENV",
+		},
+		{
+			name:      "not all stages",
+			allStages: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+					"error":   {Path: "master/.env.error"},
+				},
+				Group: map[string]Group{
+					"api": {Prefix: "API", Dir: "api", IsCheck: true},
+					"ui":  {Prefix: "UI", Dir: "ui", IsCheck: true},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				dir:       "testdata/sandbox",
+				size:      32,
+				w:         io.Discard,
+				allStages: tt.allStages,
+			}
+			err := cfg.Validate()
+			if tt.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestConfig_Validate_schema(t *testing.T) {
+	type expected struct {
+		err     string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		schema   string
+		expected expected
+	}{
+		{
+			name:   "valid",
+			schema: "schema/api.json",
+			expected: expected{
+				err:     "",
+				isError: false,
+			},
+		},
+		{
+			name:   "violations",
+			schema: "schema/api.invalid.json",
+			expected: expected{
+				err:     "failed to validate stage: default: failed to validate group.api against schema: API_MISSING: required key missing\nAPI_1_ENV: value does not match pattern ^[a-z]+$: 111\nAPI_2_ENV: value not in enum: 222\nAPI_3_ENV: key not allowed\nAPI_4_ENV: key not allowed\nAPI_6_ENV: key not allowed",
+				isError: true,
+			},
+		},
+		{
+			name:   "broken",
+			schema: "schema/api.broken.json",
+			expected: expected{
+				err:     "failed to decode schema",
+				isError: true,
+			},
+		},
+		{
+			name:   "not found",
+			schema: "schema/api.notfound.json",
+			expected: expected{
+				err:     "failed to load schema",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						Schema:      tt.schema,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				dir:  "testdata/sandbox",
+				size: 32,
+				w:    io.Discard,
+			}
+			err := cfg.Validate()
+			if tt.expected.isError {
+				assert.ErrorContains(t, err, tt.expected.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_overlay(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"master/.env":     "API_A=\n",
+		"master/.env.dev": "API_A=\n",
+		"api.json":        `{"required": ["API_TOKEN"]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+			"dev":     {Path: "master/.env.dev"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", IsCheck: true, Schema: "api.json"},
+		},
+		FromEnv:      []string{"API_TOKEN"},
+		path:         filepath.Join(dir, "lem.toml"),
+		dir:          dir,
+		root:         dir,
+		size:         32,
+		w:            io.Discard,
+		allStages:    true,
+		envOverrides: true,
+	}
+	t.Setenv("API_TOKEN", "token")
+	t.Setenv("LEM_OVERRIDE_API_A", "1")
+	assert.NoError(t, cfg.Validate())
+
+	t.Setenv("LEM_OVERRIDE_API_A", "")
+	assert.ErrorContains(t, cfg.Validate(), "empty value: API_A")
+}
+
+func TestConfig_Current(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+		w     io.Writer
+	}
+	type expected struct {
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+		{
+			name: "missing env file",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "noexists")
+			},
+		},
+		{
+			name: "missing config path in state",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/invalid", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     tt.fields.w,
+			}
+			err := cfg.Current()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Root(t *testing.T) {
+	type expected struct {
+		root  string
+		found bool
+	}
+	tests := []struct {
+		name     string
+		root     string
+		gitDir   string
+		expected expected
+	}{
+		{
+			name:     "found",
+			root:     "testdata/sandbox",
+			expected: expected{root: "testdata/sandbox", found: true},
+		},
+		{
+			name:     "not found",
+			root:     "testdata/sandbox/api",
+			expected: expected{root: "testdata/sandbox/api", found: false},
+		},
+		{
+			name:     "marker is a file",
+			root:     "testdata/sandbox",
+			gitDir:   "lem.toml",
+			expected: expected{root: "testdata/sandbox", found: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.gitDir != "" {
+				gitDir = tt.gitDir
+				t.Cleanup(func() { gitDir = dummyGitDir })
+			}
+			cfg := &Config{root: tt.root}
+			root, found := cfg.Root()
+			assert.Equal(t, tt.expected.root, root)
+			assert.Equal(t, tt.expected.found, found)
+		})
+	}
+}
+
+func TestConfig_Stages(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		path  string
+	}
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"prod":    {Path: "testdata/sandbox/master/.env", Description: "Production"},
+					"default": {Path: "testdata/sandbox/master/.env"},
+					"dev":     {Path: "testdata/sandbox/master/.env.development", Description: "Development"},
+				},
+				path: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				output:  "default\ndev      Development\nprod     Production\n",
+				isError: false,
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				path:  "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				path:  tt.fields.path,
+				w:     w,
+			}
+			err := cfg.Stages()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+		})
+	}
+}
+
+func TestConfig_Switch(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+		w     io.Writer
+	}
+	type args struct {
+		stage string
+	}
+	type expected struct {
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		args     args
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			args: args{
+				stage: "default",
+			},
+			expected: expected{
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     io.Discard,
+			},
+			args: args{
+				stage: "default",
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			args: args{
+				stage: "dummy",
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing config path in state",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			args: args{
+				stage: "default",
+			},
+			expected: expected{
+				isError: false, // Written as a new config path
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/invalid", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     tt.fields.w,
+			}
+			err := cfg.Switch(tt.args.stage)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Switch_dryRun(t *testing.T) {
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+			"error":   {Path: "master/.env.error"},
+		},
+		path:   "testdata/sandbox/lem.toml",
+		dir:    "testdata/sandbox",
+		size:   32,
+		w:      w,
+		dryRun: true,
+	}
+	prepareState("testdata/sandbox/lem.toml", "default")
+	before, err := os.ReadFile("testdata/sandbox/state")
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Switch("error"))
+	assert.Equal(t, "would switch: default -> error\n", w.String())
+	after, err := os.ReadFile("testdata/sandbox/state")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// The stage is still validated
+	assert.Error(t, cfg.Switch("dummy"))
+
+	// Without a state file, none is created
+	_ = os.Remove("testdata/sandbox/state")
+	w.Reset()
+	assert.NoError(t, cfg.Switch("default"))
+	assert.Equal(t, "would switch: (none) -> default\n", w.String())
+	assert.False(t, exists("testdata/sandbox/state"))
+}
+
+func TestConfig_StateDump(t *testing.T) {
+	type expected struct {
+		b       []byte
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			expected: expected{
+				b:       []byte("{\n  \"testdata/sandbox/lem.toml\": {\n    \"stage\": \"default\"\n  }\n}"),
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "no state file",
+			expected: expected{
+				b:       nil,
+				isError: false,
+			},
+			setup: func() {
+				_ = os.Remove("testdata/sandbox/state")
+			},
+		},
+		{
+			name: "empty state file",
+			expected: expected{
+				b:       nil,
+				isError: false,
+			},
+			setup: func() {
+				_ = os.WriteFile("testdata/sandbox/state", []byte(""), 0o600)
+			},
+		},
+		{
+			name: "invalid state file",
+			expected: expected{
+				b:       nil,
+				isError: true,
+			},
+			setup: func() {
+				_ = os.WriteFile("testdata/sandbox/state", []byte("{"), 0o600)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				path: "testdata/sandbox/lem.toml",
+				w:    io.Discard,
+			}
+			b, err := cfg.StateDump()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.b, b)
+		})
+	}
+}
+
+func TestListStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    string
+		expected map[string]string
+		isError  bool
+	}{
+		{
+			name:  "basic",
+			state: `{"a/lem.toml": {"stage": "dev"}, "b/lem.toml": {"stage": "prd", "hash.group.api": "x"}, "c/lem.toml": {"hash.group.api": "y"}}`,
+			expected: map[string]string{
+				"a/lem.toml": "dev",
+				"b/lem.toml": "prd",
+			},
+		},
+		{
+			name:     "no state file",
+			expected: map[string]string{},
+		},
+		{
+			name:     "empty state file",
+			state:    " ",
+			expected: map[string]string{},
+		},
+		{
+			name:    "invalid state file",
+			state:   "{",
+			isError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove("testdata/sandbox/state")
+			if tt.state != "" {
+				_ = os.WriteFile("testdata/sandbox/state", []byte(tt.state), 0o600)
+			}
+			actual, err := ListStates()
+			if tt.isError {
+				assert.ErrorContains(t, err, "failed to decode state file")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestConfig_ResetState(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Remove("testdata/sandbox/state.bak")
+	})
+	cfg := &Config{
+		path: "testdata/sandbox/lem.toml",
+		w:    io.Discard,
+	}
+
+	// The corrupt state file is reported with its path and a hint
+	_ = os.WriteFile("testdata/sandbox/state", []byte(`{"testdata/sandbox/lem.toml": {"stage":`), 0o600)
+	_, err := cfg.loadStage()
+	assert.ErrorContains(t, err, "failed to decode state file: testdata/sandbox/state")
+	assert.Contains(t, Hint(err), "lem state --reset")
+
+	assert.NoError(t, cfg.ResetState())
+	backup, err := os.ReadFile("testdata/sandbox/state.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"testdata/sandbox/lem.toml": {"stage":`, string(backup))
+	b, err := cfg.StateDump()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("{}"), b)
+	_, err = cfg.loadStage()
+	assert.ErrorIs(t, err, errNoStage)
+
+	// Without a state file, an empty one is created
+	_ = os.Remove("testdata/sandbox/state")
+	_ = os.Remove("testdata/sandbox/state.bak")
+	assert.NoError(t, cfg.ResetState())
+	assert.False(t, exists("testdata/sandbox/state.bak"))
+	assert.True(t, exists("testdata/sandbox/state"))
+}
+
+func TestConfig_RenameStageInState(t *testing.T) {
+	type args struct {
+		old string
+		new string
+	}
+	type expected struct {
+		stage   string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			args: args{
+				old: "staging",
+				new: "dev",
+			},
+			expected: expected{
+				stage:   "dev",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "staging")
+			},
+		},
+		{
+			name: "stored stage is not old",
+			args: args{
+				old: "staging",
+				new: "dev",
+			},
+			expected: expected{
+				stage:   "default",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "no stage stored for config",
+			args: args{
+				old: "staging",
+				new: "dev",
+			},
+			expected: expected{
+				stage:   "",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/invalid", "staging")
+			},
+		},
+		{
+			name: "new stage not set in config",
+			args: args{
+				old: "default",
+				new: "dummy",
+			},
+			expected: expected{
+				stage:   "default",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "empty name",
+			args: args{
+				old: "",
+				new: "dev",
+			},
+			expected: expected{
+				stage:   "default",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+					"dev":     {Path: "testdata/sandbox/master/.env.development"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			}
+			err := cfg.RenameStageInState(tt.args.old, tt.args.new)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			stage, _ := cfg.loadStage()
+			assert.Equal(t, tt.expected.stage, stage)
+		})
+	}
+}
+
+func TestConfig_List(t *testing.T) {
+	type fields struct {
+		Stage     map[string]Stage
+		Group     map[string]Group
+		Separator string
+		Kind      map[string]string
+		only      []string
+		path      string
+		size      int
+		w         io.Writer
+	}
+	type expected struct {
+		entries []Entry
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "./api",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						Plain:         []string{"FOO", "BAR"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix:        "UI",
+						Dir:           "./ui",
+						Replaceable:   []string{"REPLACEABLE1"},
+						Plain:         []string{"BAZ"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				entries: []Entry{
+					{Group: "api", Prefix: "API", Type: "direct", Name: "1_ENV", Value: "111", Kind: "int"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "2_ENV", Value: "\"222\"", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "3_ENV", Value: "'333'", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "4_ENV", Value: "`444`", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "indirect", Name: "6_ENV", Value: "6 7 8", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "plain", Name: "BAR", Value: "bar", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "plain", Name: "FOO", Value: "foo", Kind: "string"},
+					{Group: "ui", Prefix: "UI", Type: "direct", Name: "5_ENV", Value: "555", Kind: "int"},
+					{Group: "ui", Prefix: "UI", Type: "indirect", Name: "6_ENV", Value: "6 7 8", Kind: "string"},
+					{Group: "ui", Prefix: "UI", Type: "plain", Name: "BAZ", Value: "baz", Kind: "string"},
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+		{
+			name: "group table not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     os.Stdout,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing config path in state",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/invalid", "default")
+			},
+		},
+		{
+			name: "dot separator",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.dots"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "api",
+						Dir:         "./api",
+						Replaceable: []string{"shared"},
+					},
+					"ui": {
+						Prefix: "ui",
+						Dir:    "./ui",
+					},
+				},
+				Separator: ".",
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+			},
+			expected: expected{
+				entries: []Entry{
+					{Group: "api", Prefix: "api", Type: "direct", Name: "db.host", Value: "localhost", Kind: "string"},
+					{Group: "api", Prefix: "api", Type: "direct", Name: "key", Value: "1", Kind: "int"},
+					{Group: "api", Prefix: "api", Type: "indirect", Name: "token", Value: "abc", Kind: "string"},
+					{Group: "ui", Prefix: "ui", Type: "direct", Name: "key", Value: "3", Kind: "int"},
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "declared kind",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "./api",
+						Plain:  []string{"FOO"},
+					},
+				},
+				Kind: map[string]string{
+					"API_1_ENV": "string",
+					"FOO":       "json",
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				entries: []Entry{
+					{Group: "api", Prefix: "API", Type: "direct", Name: "1_ENV", Value: "111", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "2_ENV", Value: "\"222\"", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "3_ENV", Value: "'333'", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "4_ENV", Value: "`444`", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "plain", Name: "FOO", Value: "foo", Kind: "json"},
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid kind",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "./api",
+					},
+				},
+				Kind: map[string]string{
+					"API_1_ENV": "float",
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "catch-all",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "./api",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"FOO"},
+					},
+					"misc": {
+						Prefix:   "MISC",
+						Dir:      "./misc",
+						CatchAll: true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				entries: []Entry{
+					{Group: "api", Prefix: "API", Type: "direct", Name: "1_ENV", Value: "111", Kind: "int"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "2_ENV", Value: "\"222\"", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "3_ENV", Value: "'333'", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "direct", Name: "4_ENV", Value: "`444`", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "indirect", Name: "6_ENV", Value: "6 7 8", Kind: "string"},
+					{Group: "api", Prefix: "API", Type: "plain", Name: "FOO", Value: "foo", Kind: "string"},
+					{Group: "misc", Prefix: "MISC", Type: "catchall", Name: "BAR", Value: "bar", Kind: "string"},
+					{Group: "misc", Prefix: "MISC", Type: "catchall", Name: "BAZ", Value: "baz", Kind: "string"},
+					{Group: "misc", Prefix: "MISC", Type: "catchall", Name: "UI_5_ENV", Value: "555", Kind: "int"},
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "catch-all in more than one group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:   "API",
+						Dir:      "./api",
+						CatchAll: true,
+					},
+					"misc": {
+						Prefix:   "MISC",
+						Dir:      "./misc",
+						CatchAll: true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "only groups",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "./api",
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "./ui",
+						Plain:  []string{"BAZ"},
+					},
+				},
+				only: []string{"ui"},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				entries: []Entry{
+					{Group: "ui", Prefix: "UI", Type: "direct", Name: "5_ENV", Value: "555", Kind: "int"},
+					{Group: "ui", Prefix: "UI", Type: "plain", Name: "BAZ", Value: "baz", Kind: "string"},
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "unknown only group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "./api",
+					},
+				},
+				only: []string{"dummy"},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage:     tt.fields.Stage,
+				Group:     tt.fields.Group,
+				Separator: tt.fields.Separator,
+				Kind:      tt.fields.Kind,
+				only:      tt.fields.only,
+				path:      tt.fields.path,
+				size:      tt.fields.size,
+				w:         tt.fields.w,
+			}
+			actual, err := cfg.List()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, actual, tt.expected.entries)
+		})
+	}
+}
+
+func TestConfig_DirenvGraph(t *testing.T) {
+	cfg := &Config{
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "./api", DirenvSupport: []string{"ui", "api", "ui"}},
+			"ui":  {Prefix: "UI", Dir: "./ui"},
+		},
+		path: "testdata/sandbox/lem.toml",
+	}
+	graph, err := cfg.DirenvGraph()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"api": {"api", "ui"},
+		"ui":  {},
+	}, graph)
+
+	cfg.Group["ui"] = Group{Prefix: "UI", Dir: "./ui", DirenvSupport: []string{"web"}}
+	_, err = cfg.DirenvGraph()
+	assert.ErrorContains(t, err, "failed to validate: group.ui: invalid id: web")
+
+	cfg.Group = nil
+	_, err = cfg.DirenvGraph()
+	assert.Error(t, err)
+}
+
+func TestConfig_ListGroup(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix: "API",
+				Dir:    "./api",
+				Plain:  []string{"FOO"},
+			},
+			"ui": {
+				Prefix: "UI",
+				Dir:    "./ui",
+			},
+		},
+		path: "testdata/sandbox/lem.toml",
+		size: 32,
+		w:    io.Discard,
+	}
+	actual, err := cfg.ListGroup("ui")
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{Group: "ui", Prefix: "UI", Type: "direct", Name: "5_ENV", Value: "555", Kind: "int"},
+	}, actual)
+
+	_, err = cfg.ListGroup("dummy")
+	assert.ErrorContains(t, err, "failed to validate group: dummy: not set in testdata/sandbox/lem.toml")
+}
+
+func TestConfig_ListCSV(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:      "API",
+				Dir:         "./api",
+				Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+			},
+			"ui": {
+				Prefix:      "UI",
+				Dir:         "./ui",
+				Replaceable: []string{"REPLACEABLE1"},
+				Plain:       []string{"BAZ"},
+			},
+		},
+		path: "testdata/sandbox/lem.toml",
+		size: 32,
+		w:    io.Discard,
+	}
+	w := &bytes.Buffer{}
+	err := cfg.ListCSV(w)
+	assert.NoError(t, err)
+	expected := `Group,Prefix,Type,Name,Value
+api,API,direct,1_ENV,111
+api,API,direct,2_ENV,"""222"""
+api,API,direct,3_ENV,'333'
+api,API,direct,4_ENV,` + "`444`" + `
+api,API,indirect,6_ENV,6 7 8
+ui,UI,direct,5_ENV,555
+ui,UI,indirect,6_ENV,6 7 8
+ui,UI,plain,BAZ,baz
+`
+	assert.Equal(t, expected, w.String())
+}
+
+func TestConfig_ListCSV_error(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env.notfound"},
+		},
+		path: "testdata/sandbox/lem.toml",
+		size: 32,
+		w:    io.Discard,
+	}
+	err := cfg.ListCSV(io.Discard)
+	assert.Error(t, err)
+}
+
+func TestConfig_Resolved(t *testing.T) {
+	type fields struct {
+		Stage   map[string]Stage
+		Group   map[string]Group
+		path    string
+		size    int
+		envPath string
+	}
+	type expected struct {
+		e       map[string]string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_1_ENV":          "111",
+					"API_2_ENV":          "\"222\"",
+					"API_3_ENV":          "'333'",
+					"API_4_ENV":          "`444`",
+					"BAR":                "bar",
+					"BAZ":                "baz",
+					"FOO":                "foo",
+					"REPLACEABLE1_6_ENV": "6 7 8",
+					"UI_5_ENV":           "555",
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+			},
+			expected: expected{
+				e:       nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "env path",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.dummy"},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				envPath: "testdata/sandbox/master/.env.include",
+			},
+			expected: expected{
+				e: map[string]string{
+					"FOO": "foo",
+					"BAR": "bar",
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "env path not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				envPath: "testdata/sandbox/master/.env.dummy",
+			},
+			expected: expected{
+				e:       nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "env path outside of the project root",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				envPath: "../lem.go",
+			},
+			expected: expected{
+				e:       nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "env path is a directory",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				envPath: "testdata/sandbox/master",
+			},
+			expected: expected{
+				e:       nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "central env not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.dummy"},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				e:       nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage:   tt.fields.Stage,
+				Group:   tt.fields.Group,
+				path:    tt.fields.path,
+				size:    tt.fields.size,
+				w:       io.Discard,
+				envPath: tt.fields.envPath,
+			}
+			actual, err := cfg.Resolved()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.e, actual)
+		})
+	}
+}
+
+func TestConfig_GroupsFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    map[string]Group
+		key      string
+		expected []string
+	}{
+		{
+			name: "prefix",
+			group: map[string]Group{
+				"api": {Prefix: "API"},
+				"ui":  {Prefix: "UI"},
+			},
+			key:      "API_URL",
+			expected: []string{"api"},
+		},
+		{
+			name: "replaceable and plain",
+			group: map[string]Group{
+				"api": {Prefix: "API", Replaceable: []string{"SHARED"}},
+				"ui":  {Prefix: "UI", Plain: []string{"SHARED_URL"}},
+				"job": {Prefix: "JOB"},
+			},
+			key:      "SHARED_URL",
+			expected: []string{"api", "ui"},
+		},
+		{
+			name: "catch-all",
+			group: map[string]Group{
+				"api":  {Prefix: "API"},
+				"misc": {Prefix: "MISC", CatchAll: true},
+			},
+			key:      "OTHER",
+			expected: []string{"misc"},
+		},
+		{
+			name: "catch-all not used for claimed key",
+			group: map[string]Group{
+				"api":  {Prefix: "API"},
+				"misc": {Prefix: "MISC", CatchAll: true},
+			},
+			key:      "API_URL",
+			expected: []string{"api"},
+		},
+		{
+			name: "no group",
+			group: map[string]Group{
+				"api": {Prefix: "API"},
+			},
+			key:      "OTHER",
+			expected: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Group: tt.group,
+			}
+			assert.Equal(t, tt.expected, cfg.GroupsFor(tt.key))
+		})
+	}
+}
+
+func TestConfig_Orphans(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+	}
+	type expected struct {
+		keys    []string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {Prefix: "API", Dir: "testdata/sandbox/api", Replaceable: []string{"REPLACEABLE1"}},
+					"ui":  {Prefix: "UI", Dir: "testdata/sandbox/ui", Plain: []string{"BAZ"}},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				keys:    []string{"BAR", "FOO"},
+				isError: false,
+			},
+		},
+		{
+			name: "catchall",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {Prefix: "API", Dir: "testdata/sandbox/api", Replaceable: []string{"REPLACEABLE1"}, CatchAll: true},
+					"ui":  {Prefix: "UI", Dir: "testdata/sandbox/ui", Plain: []string{"BAR", "BAZ", "FOO"}},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				keys:    []string{},
+				isError: false,
+			},
+		},
+		{
+			name: "group table not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+			},
+			expected: expected{
+				keys:    nil,
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     io.Discard,
+			}
+			actual, err := cfg.Orphans()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.keys, actual)
+		})
+	}
+}
+
+func TestConfig_Run(t *testing.T) {
+	type fields struct {
+		Stage     map[string]Stage
+		Group     map[string]Group
+		path      string
+		size      int
+		w         io.Writer
+		timeout   time.Duration
+		dupPolicy string
+		only      []string
+	}
+	type expected struct {
+		path    string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "testdata/sandbox/master/.env",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage table not found",
+			fields: fields{
+				Stage: nil,
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "stage path not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/dummy/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "group table not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+				size:  32,
+				w:     os.Stdout,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "group path not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api/.env",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "central env not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "empty value",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.error"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:        "API",
+						Dir:           "testdata/sandbox/api",
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "empty value with check overridden",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {
+						Path: "testdata/sandbox/master/.env.error",
+						Override: map[string]Override{
+							"api": {Filename: ".env.override", IsCheck: ptr(false)},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "testdata/sandbox/master/.env.error",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "timeout",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				w:       io.Discard,
+				timeout: time.Nanosecond,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "duplicate key warned",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"BAZ"},
+					},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+				dupPolicy: DuplicateKeyWarn,
+			},
+			expected: expected{
+				path:    "testdata/sandbox/master/.env",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "duplicate key error",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"BAZ"},
+					},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+				dupPolicy: DuplicateKeyError,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid duplicate key policy",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path:      "testdata/sandbox/lem.toml",
+				size:      32,
+				w:         io.Discard,
+				dupPolicy: "dummy",
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "restricted groups",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "testdata/sandbox/dummy",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+				only: []string{"api", "api"},
+			},
+			expected: expected{
+				path:    "testdata/sandbox/master/.env",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "restricted to unknown group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+				only: []string{"dummy"},
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage:     tt.fields.Stage,
+				Group:     tt.fields.Group,
+				path:      tt.fields.path,
+				size:      tt.fields.size,
+				w:         tt.fields.w,
+				timeout:   tt.fields.timeout,
+				dupPolicy: tt.fields.dupPolicy,
+				only:      tt.fields.only,
+			}
+			actual, err := cfg.Run()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.path, actual)
+		})
+	}
+}
+
+func TestConfig_Run_outputRoot(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	dir, _ := filepath.Abs("testdata/sandbox")
+	out := t.TempDir()
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:        "API",
+				Dir:           "./api",
+				DirenvSupport: []string{"api", "ui"},
+			},
+			"ui": {
+				Prefix:   "UI",
+				Dir:      "./ui",
+				Filename: ".env.local",
+			},
+		},
+		path:       "testdata/sandbox/lem.toml",
+		dir:        dir,
+		root:       dir,
+		size:       32,
+		w:          io.Discard,
+		outputRoot: out,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	api, err := os.ReadFile(filepath.Join(out, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_1_ENV=111\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\n", string(api))
+	envrc, err := os.ReadFile(filepath.Join(out, "api", ".envrc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "watch_file ./.env\ndotenv_if_exists ./.env\nwatch_file ../ui/.env.local\ndotenv_if_exists ../ui/.env.local\n", string(envrc))
+	ui, err := os.ReadFile(filepath.Join(out, "ui", ".env.local"))
+	assert.NoError(t, err)
+	assert.Equal(t, "UI_5_ENV=555\n", string(ui))
+	assert.False(t, exists(filepath.Join(dir, "ui", ".env.local")))
+	assert.NoError(t, cfg.Check())
+	stale, err := cfg.Freshness()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"api": false, "ui": false}, stale)
+}
+
+func TestConfig_Run_continueOnError(t *testing.T) {
+	type expected struct {
+		errs    []string
+		written bool
+	}
+	tests := []struct {
+		name            string
+		continueOnError bool
+		expected        expected
+	}{
+		{
+			name:            "continue on error",
+			continueOnError: true,
+			expected: expected{
+				errs: []string{
+					"failed to validate group.broken: failed to stat resolved path",
+					"failed to validate group.noprefix: prefix not set",
+				},
+				written: true,
+			},
+		},
+		{
+			name:            "fail fast",
+			continueOnError: false,
+			expected: expected{
+				errs: []string{
+					"failed to validate group.broken: failed to stat resolved path",
+				},
+				written: false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			_ = os.Remove("testdata/sandbox/api/.env.override")
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"broken": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/dummy",
+					},
+					"misc": {
+						Prefix:   "MISC",
+						Dir:      "testdata/sandbox/api",
+						Filename: ".env.override",
+						Plain:    []string{"FOO"},
+					},
+					"noprefix": {
+						Dir: "testdata/sandbox/api",
+					},
+				},
+				path:            "testdata/sandbox/lem.toml",
+				size:            32,
+				w:               io.Discard,
+				continueOnError: tt.continueOnError,
+			}
+			_, err := cfg.Run()
+			assert.Error(t, err)
+			for _, msg := range tt.expected.errs {
+				assert.ErrorContains(t, err, msg)
+			}
+			assert.Equal(t, tt.expected.written, exists("testdata/sandbox/api/.env.override"))
+		})
+	}
+}
+
+func TestConfig_Run_skipEmpty(t *testing.T) {
+	type fields struct {
+		skipEmpty bool
+		isCheck   bool
+	}
+	type expected struct {
+		content string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name:   "keep empty",
+			fields: fields{skipEmpty: false, isCheck: false},
+			expected: expected{
+				content: "API_1_ENV=111\nAPI_2_ENV=\nAPI_3_ENV=\"\"\n",
+				isError: false,
+			},
+		},
+		{
+			name:   "skip empty",
+			fields: fields{skipEmpty: true, isCheck: false},
+			expected: expected{
+				content: "API_1_ENV=111\n",
+				isError: false,
+			},
+		},
+		{
+			name:   "check only",
+			fields: fields{skipEmpty: false, isCheck: true},
+			expected: expected{
+				content: "",
+				isError: true,
+			},
+		},
+		{
+			name:   "skip empty before check",
+			fields: fields{skipEmpty: true, isCheck: true},
+			expected: expected{
+				content: "API_1_ENV=111\n",
+				isError: false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			_ = os.Remove("testdata/sandbox/api/.env.override")
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env.skip"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:    "API",
+						Dir:       "testdata/sandbox/api",
+						Filename:  ".env.override",
+						IsCheck:   tt.fields.isCheck,
+						SkipEmpty: tt.fields.skipEmpty,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			}
+			_, err := cfg.Run()
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			b, err := os.ReadFile("testdata/sandbox/api/.env.override")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.content, string(b))
+		})
+	}
+}
+
+func TestConfig_Run_outputFormat(t *testing.T) {
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name         string
+		outputFormat string
+		expected     expected
+	}{
+		{
+			name:         "json",
+			outputFormat: OutputJSON,
+			expected: expected{
+				output: `{"event":"duplicate","stage":"default","key":"REPLACEABLE1_6_ENV","groups":["api","ui"]}
+{"event":"staged","stage":"default","path":"testdata/sandbox/master/.env"}
+{"event":"distributed","group":"api","target":"testdata/sandbox/api/.env"}
+{"event":"distributed","group":"ui","target":"testdata/sandbox/ui/.env"}
+{"event":"summary","groups":2,"keys":8,"empty":0}
+{"event":"orphans","count":2}
+`,
+				isError: false,
+			},
+		},
+		{
+			name:         "invalid",
+			outputFormat: "yaml",
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"BAZ"},
+					},
+				},
+				path:         "testdata/sandbox/lem.toml",
+				size:         32,
+				w:            w,
+				dupPolicy:    DuplicateKeyWarn,
+				outputFormat: tt.outputFormat,
+			}
+			_, err := cfg.Run()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+		})
+	}
+}
+
+func TestConfig_Run_validateCmd(t *testing.T) {
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name        string
+		validateCmd []string
+		expected    expected
+	}{
+		{
+			name:        "success",
+			validateCmd: []string{"sh", "-c", `echo "validated $0"`},
+			expected: expected{
+				output:  "validated testdata/sandbox/api/.env\n",
+				isError: false,
+			},
+		},
+		{
+			name:        "failure",
+			validateCmd: []string{"sh", "-c", `echo "invalid $0"; exit 1`},
+			expected: expected{
+				output:  "invalid testdata/sandbox/api/.env\n",
+				isError: true,
+			},
+		},
+		{
+			name:        "not found",
+			validateCmd: []string{"lem-validator-not-found"},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						ValidateCmd: tt.validateCmd,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    w,
+			}
+			_, err := cfg.Run()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Contains(t, w.String(), tt.expected.output)
+		})
+	}
+}
+
+func TestConfig_Run_schema(t *testing.T) {
+	type expected struct {
+		err     string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		schema   string
+		expected expected
+	}{
+		{
+			name:   "valid",
+			schema: "testdata/sandbox/schema/api.json",
+			expected: expected{
+				err:     "",
+				isError: false,
+			},
+		},
+		{
+			name:   "violations",
+			schema: "testdata/sandbox/schema/api.invalid.json",
+			expected: expected{
+				err:     "failed to validate group.api against schema: API_MISSING: required key missing\nAPI_1_ENV: value does not match pattern ^[a-z]+$: 111",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						Schema:      tt.schema,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			}
+			_, err := cfg.Run()
+			if tt.expected.isError {
+				assert.ErrorContains(t, err, tt.expected.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Run_summary(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:      "API",
+				Dir:         "testdata/sandbox/api",
+				Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+			},
+			"ui": {
+				Prefix:      "UI",
+				Dir:         "testdata/sandbox/ui",
+				Replaceable: []string{"REPLACEABLE1"},
+				Plain:       []string{"BAZ"},
+			},
+			"misc": {
+				Prefix:   "MISC",
+				Dir:      "testdata/sandbox/api",
+				Filename: ".env.override",
+				Plain:    []string{"EMPTY"},
+			},
+		},
+		FromEnv: []string{"EMPTY"},
+		path:    "testdata/sandbox/lem.toml",
+		size:    32,
+		w:       w,
+	}
+	t.Setenv("EMPTY", "")
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Equal(t, "summary: distributed 3 groups, 9 keys, 1 empty", lines[len(lines)-2])
+	assert.Equal(t, "orphans: 2 keys not delivered to any group, see lem orphans", lines[len(lines)-1])
+}
+
+func Test_isEmptyValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{name: "empty", value: "", expected: true},
+		{name: "single quotes", value: "''", expected: true},
+		{name: "double quotes", value: `""`, expected: true},
+		{name: "backquotes", value: "``", expected: true},
+		{name: "space", value: " ", expected: false},
+		{name: "value", value: "foo", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isEmptyValue(tt.value))
+		})
+	}
+}
+
+func TestConfig_Check(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+	}
+	type expected struct {
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "up to date",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"BAZ"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "drifted",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						Plain:       []string{"FOO"},
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "env file not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:   "API",
+						Dir:      "testdata/sandbox/api",
+						Filename: ".env.dummy",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/dummy",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     io.Discard,
+			}
+			err := cfg.Check()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Run_localOverlay(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_KEY=managed\nUI_KEY=managed\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "api", ".env.local"), []byte("API_KEY=local\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:        "API",
+				Dir:           "api",
+				DirenvSupport: []string{"api", "ui"},
+			},
+			"ui": {
+				Prefix: "UI",
+				Dir:    "ui",
+			},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	envrc, err := os.ReadFile(filepath.Join(dir, "api", ".envrc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "watch_file ./.env\ndotenv_if_exists ./.env\ndotenv_if_exists ./.env.local\nwatch_file ../ui/.env\ndotenv_if_exists ../ui/.env\n", string(envrc))
+	local, err := os.ReadFile(filepath.Join(dir, "api", ".env.local"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_KEY=local\n", string(local))
+}
+
+func TestConfig_Run_targets(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "app/config"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("APP_KEY=key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	type expected struct {
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		targets  []string
+		expected expected
+	}{
+		{
+			name:     "basic",
+			targets:  []string{"config/app.env", "app.env"},
+			expected: expected{isError: false},
+		},
+		{
+			name:     "empty",
+			targets:  []string{""},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "absolute",
+			targets:  []string{filepath.Join(dir, "app", "app.env")},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "parent not found",
+			targets:  []string{"missing/app.env"},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "outside of the project root",
+			targets:  []string{"../../app.env"},
+			expected: expected{isError: true},
+		},
+		{
+			name:     "directory",
+			targets:  []string{"config"},
+			expected: expected{isError: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState(path, "default")
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				Group: map[string]Group{
+					"app": {
+						Prefix:  "APP",
+						Dir:     "app",
+						Targets: tt.targets,
+					},
+				},
+				path: path,
+				dir:  dir,
+				root: dir,
+				size: 32,
+				w:    io.Discard,
+			}
+			_, err := cfg.Run()
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, target := range tt.targets {
+				b, err := os.ReadFile(filepath.Join(dir, "app", target))
+				assert.NoError(t, err)
+				assert.Equal(t, "APP_KEY=key\n", string(b))
+			}
+			assert.False(t, exists(filepath.Join(dir, "app", ".env")))
+			assert.NoError(t, cfg.Check())
+		})
+	}
+}
+
+func TestConfig_Run_directives(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	central := "# lem:group=api,secret\nSHARED_TOKEN=token\n# lem:group=api,group=ui\nSHARED_URL=url\nAPI_A=1\nUI_A=2\n"
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte(central), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path:       path,
+		dir:        dir,
+		root:       dir,
+		size:       32,
+		w:          io.Discard,
+		directives: true,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	api, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_A=1\nSHARED_TOKEN=token\nSHARED_URL=url\n", string(api))
+	ui, err := os.ReadFile(filepath.Join(dir, "ui", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "SHARED_URL=url\nUI_A=2\n", string(ui))
+
+	entries, err := cfg.List()
+	assert.NoError(t, err)
+	values := map[string]string{}
+	for _, entry := range entries {
+		values[entry.Group+"."+entry.Name] = entry.Value
+	}
+	assert.Equal(t, maskedValue, values["api.SHARED_TOKEN"])
+	assert.Equal(t, "url", values["ui.SHARED_URL"])
+
+	orphans, err := cfg.Orphans()
+	assert.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	central = "# lem:group=db\nSHARED_URL=url\n"
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte(central), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Run()
+	assert.ErrorContains(t, err, "group.db not set")
+}
+
+func TestConfig_Run_incremental(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	central := filepath.Join(dir, "master", ".env")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) string {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	write(central, "API_A=1\nUI_A=1\nUI_B=2\n")
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path:        path,
+		dir:         dir,
+		root:        dir,
+		size:        32,
+		w:           w,
+		incremental: true,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, w.String(), "unchanged:")
+
+	// The untouched group is not rewritten
+	write(filepath.Join(dir, "ui", ".env"), "SENTINEL=1\n")
+	write(central, "API_A=2\nUI_A=1\nUI_B=2\n")
+	w.Reset()
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.Contains(t, w.String(), "distributed: group.api")
+	assert.Contains(t, w.String(), "unchanged: group.ui\n")
+	assert.Equal(t, "API_A=2\n", read(filepath.Join(dir, "api", ".env")))
+	assert.Equal(t, "SENTINEL=1\n", read(filepath.Join(dir, "ui", ".env")))
+
+	// A deleted key rewrites the group
+	write(central, "API_A=2\nUI_A=1\n")
+	w.Reset()
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.Contains(t, w.String(), "unchanged: group.api\n")
+	assert.Contains(t, w.String(), "distributed: group.ui")
+	assert.Equal(t, "UI_A=1\n", read(filepath.Join(dir, "ui", ".env")))
+
+	// Without incremental, every group is rewritten
+	cfg.incremental = false
+	w.Reset()
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, w.String(), "unchanged:")
+}
+
+func TestConfig_Run_dirStage(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"env.d", "api", "empty.d"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"env.d/20-override.env": "API_B=override\n",
+		"env.d/10-base.env":     "API_A=1\nAPI_B=2\n",
+		"env.d/README.md":       "API_C=ignored\n",
+		"env.d/.env":            "API_D=hidden\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	newConfig := func(s Stage) *Config {
+		prepareState(path, "default")
+		return &Config{
+			Stage: map[string]Stage{
+				"default": s,
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+			},
+			path: path,
+			dir:  dir,
+			root: dir,
+			size: 32,
+			w:    io.Discard,
+		}
+	}
+
+	cfg := newConfig(Stage{Path: "env.d", Dir: true})
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_A=1\nAPI_B=override\n", string(b))
+	stale, err := cfg.Freshness()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"api": false}, stale)
+
+	_, err = newConfig(Stage{Path: "env.d"}).Run()
+	assert.ErrorContains(t, err, "is a directory")
+	_, err = newConfig(Stage{Path: "env.d/10-base.env", Dir: true}).Run()
+	assert.ErrorContains(t, err, "is not a directory")
+	_, err = newConfig(Stage{Path: "empty.d", Dir: true}).Run()
+	assert.ErrorContains(t, err, "no *.env files")
+
+	w := &bytes.Buffer{}
+	cfg = newConfig(Stage{Path: "env.d", Dir: true})
+	cfg.Group["api"] = Group{Prefix: "API", Dir: "env.d"}
+	cfg.w = w
+	assert.NoError(t, cfg.Validate())
+	assert.Contains(t, w.String(), "warning: group.api: dir contains the central env of default")
+}
+
+func TestConfig_RunWithReport(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nAPI_B=2\nUI_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ui", ".env"), []byte("UI_A=0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	expected := &RunReport{
+		Stage: "default",
+		Path:  filepath.Join(dir, "master", ".env"),
+		Groups: []GroupReport{
+			{Group: "api", Target: filepath.Join(dir, "api", ".env"), KeyCount: 2, Created: true},
+			{Group: "ui", Target: filepath.Join(dir, "ui", ".env"), KeyCount: 1, Created: false},
+		},
+	}
+	actual, err := cfg.RunWithReport()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	expected.Groups[0].Created = false
+	actual, err = cfg.RunWithReport()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestConfig_Run_optional(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nWEB_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	newConfig := func(optional bool, w io.Writer) *Config {
+		prepareState(path, "default")
+		return &Config{
+			Stage: map[string]Stage{
+				"default": {Path: "master/.env"},
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+				"web": {Prefix: "WEB", Dir: "web", Optional: optional},
+			},
+			path:   path,
+			dir:    dir,
+			root:   dir,
+			size:   32,
+			w:      w,
+			strict: true,
+		}
+	}
+
+	w := &bytes.Buffer{}
+	assert.NoError(t, newConfig(true, w).Validate())
+	assert.Equal(t, "skipped: group.web -> optional dir does not exist\nall checks passed!\n", w.String())
+
+	w.Reset()
+	_, err := newConfig(true, w).Run()
+	assert.NoError(t, err)
+	assert.Contains(t, w.String(), "distributed: group.api -> "+filepath.Join(dir, "api", ".env")+"\n")
+	assert.Contains(t, w.String(), "skipped: group.web -> optional dir does not exist\n")
+	assert.FileExists(t, filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, newConfig(true, io.Discard).Check())
+
+	_, err = newConfig(false, io.Discard).Run()
+	assert.ErrorContains(t, err, "failed to validate group.web")
+	assert.ErrorContains(t, newConfig(false, io.Discard).Validate(), "failed to validate group.web")
+}
+
+func TestConfig_Run_url(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/env":
+			_, _ = io.WriteString(w, "API_A=1\nAPI_B=${LEM_STAGE}\n")
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/include":
+			_, _ = io.WriteString(w, "#include ./other.env\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	t.Cleanup(func() { http.DefaultClient = client })
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "api"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	newConfig := func(stage Stage) *Config {
+		return &Config{
+			Stage: map[string]Stage{
+				"default": stage,
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+			},
+			path:     path,
+			dir:      dir,
+			root:     dir,
+			size:     32,
+			w:        io.Discard,
+			includes: true,
+		}
+	}
+	prepareState(path, "default")
+
+	t.Setenv("LEM_HTTP_AUTHORIZATION", "Bearer token")
+	cfg := newConfig(Stage{Path: srv.URL + "/env"})
+	stagePath, err := cfg.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/env", stagePath)
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "A=1\n")
+	assert.Contains(t, string(b), "B=default\n")
+
+	_, err = cfg.Watch()
+	assert.ErrorContains(t, err, "a URL stage cannot be watched for changes")
+
+	cfg.maxFileSize = 4
+	_, err = cfg.Run()
+	assert.ErrorContains(t, err, "file too large")
+
+	_, err = newConfig(Stage{Path: srv.URL + "/missing"}).Run()
+	assert.ErrorContains(t, err, "404 Not Found")
+
+	_, err = newConfig(Stage{Path: srv.URL + "/include"}).Run()
+	assert.ErrorContains(t, err, "not supported in the central env fetched from a URL")
+
+	_, err = newConfig(Stage{Path: srv.URL + "/env", Dir: true}).Run()
+	assert.ErrorContains(t, err, "a URL cannot be a directory")
+
+	_, err = newConfig(Stage{Path: "https://"}).Run()
+	assert.ErrorContains(t, err, "host not set")
+
+	cfg = newConfig(Stage{Path: srv.URL + "/slow"})
+	cfg.httpTimeout = 10 * time.Millisecond
+	_, err = cfg.Run()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	t.Setenv("LEM_HTTP_AUTHORIZATION", "")
+	_, err = newConfig(Stage{Path: srv.URL + "/env"}).Run()
+	assert.ErrorContains(t, err, "401 Unauthorized")
+}
+
+func TestConfig_Run_urlRedirectToPlainHTTP(t *testing.T) {
+	var leaked atomic.Bool
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			leaked.Store(true)
+		}
+		_, _ = io.WriteString(w, "API_A=1\n")
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/env":
+			_, _ = io.WriteString(w, "API_A=1\n")
+		default:
+			http.Redirect(w, r, plain.URL+"/env", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	client := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	t.Cleanup(func() { http.DefaultClient = client })
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "api"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	newConfig := func(url string) *Config {
+		return &Config{
+			Stage: map[string]Stage{
+				"default": {Path: url},
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+			},
+			path: path,
+			dir:  dir,
+			root: dir,
+			size: 32,
+			w:    io.Discard,
+		}
+	}
+
+	t.Setenv("LEM_HTTP_AUTHORIZATION", "Bearer token")
+	_, err := newConfig(srv.URL + "/redirect").Run()
+	assert.ErrorContains(t, err, "redirect to plain http refused")
+	assert.False(t, leaked.Load())
+
+	_, err = newConfig(srv.URL + "/env").Run()
+	assert.NoError(t, err)
+
+	t.Setenv("LEM_HTTP_AUTHORIZATION", "")
+	_, err = newConfig(srv.URL + "/redirect").Run()
+	assert.NoError(t, err)
+	assert.False(t, leaked.Load())
+}
+
+func TestConfig_Run_urlPlainHTTP(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "API_A=%d\n", requests.Load())
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "api"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	t.Setenv("LEM_HTTP_AUTHORIZATION", "Bearer token")
+	w := &bytes.Buffer{}
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: srv.URL + "/env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+		},
+		path:      path,
+		dir:       dir,
+		root:      dir,
+		size:      32,
+		w:         w,
+		storeHash: true,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Contains(t, w.String(), "LEM_HTTP_AUTHORIZATION is not sent over plain http")
+	assert.Equal(t, 1, cfg.warnings)
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_A=1\n", string(b))
+	hashes, err := cfg.loadHashes()
+	assert.NoError(t, err)
+	assert.Equal(t, hashOf([]byte("API_A=1\n")), hashes[centralHashKey])
+
+	w.Reset()
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Contains(t, w.String(), "central env at a URL is not fetched")
+}
+
+func TestConfig_Run_checksums(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nAPI_B=2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", Targets: []string{".env", "app.env"}},
+		},
+		path:      path,
+		dir:       dir,
+		root:      dir,
+		size:      32,
+		w:         io.Discard,
+		checksums: true,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	for _, name := range []string{".env", "app.env"} {
+		b, err := os.ReadFile(filepath.Join(dir, "api", name))
+		assert.NoError(t, err)
+		sum, err := os.ReadFile(filepath.Join(dir, "api", name+".sha256"))
+		assert.NoError(t, err)
+		digest := sha256.Sum256(b)
+		assert.Equal(t, hex.EncodeToString(digest[:])+"  "+name+"\n", string(sum))
+	}
+
+	cfg.checksums = false
+	if err := os.Remove(filepath.Join(dir, "api", ".env.sha256")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "api", ".env.sha256"))
+}
+
+func Test_interpolateStage(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "value",
+			env:      map[string]string{"API_ENV_NAME": "${LEM_STAGE}"},
+			expected: map[string]string{"API_ENV_NAME": "dev"},
+		},
+		{
+			name:     "embedded",
+			env:      map[string]string{"API_URL": "https://${LEM_STAGE}.example.com/${LEM_STAGE}"},
+			expected: map[string]string{"API_URL": "https://dev.example.com/dev"},
+		},
+		{
+			name:     "other references",
+			env:      map[string]string{"API_A": "$LEM_STAGE", "API_B": "${HOME}", "API_C": "plain"},
+			expected: map[string]string{"API_A": "$LEM_STAGE", "API_B": "${HOME}", "API_C": "plain"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interpolateStage(tt.env, "dev")
+			assert.Equal(t, tt.expected, tt.env)
+		})
+	}
+}
+
+func TestConfig_Run_interpolateStage(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_ENV_NAME=${LEM_STAGE}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "prd")
+	t.Setenv("LEM_STAGE", "ignored")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"prd": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_ENV_NAME=prd\n", string(b))
+}
+
+func TestConfig_Check_envrc(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nUI_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", DirenvSupport: []string{"api", "ui"}},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Check())
+
+	// A hand-edited .envrc is reported
+	envrc := filepath.Join(dir, "api", ".envrc")
+	if err := os.WriteFile(envrc, []byte("dotenv_if_exists ../old/.env\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, cfg.Check(), "failed to check: drifted: group.api/.envrc")
+
+	// A missing .envrc is reported, and Run regenerates it
+	if err := os.Remove(envrc); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, cfg.Check(), "failed to check: drifted: group.api/.envrc")
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Check())
+
+	// A changed configuration makes the .envrc stale
+	group := cfg.Group["api"]
+	group.EnvrcExtra = []string{"export FOO=bar"}
+	cfg.Group["api"] = group
+	assert.EqualError(t, cfg.Check(), "failed to check: drifted: group.api/.envrc")
+}
+
+func TestConfig_Run_stagePlaceholder(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "deploy/dev/api", "deploy/prd/api"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for stage, content := range map[string]string{"dev": "API_A=dev\n", "prd": "API_A=prd\n"} {
+		if err := os.WriteFile(filepath.Join(dir, "master", "."+stage+".env"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	newConfig := func(stage, outputRoot string) *Config {
+		prepareState(path, stage)
+		return &Config{
+			Stage: map[string]Stage{
+				"dev": {Path: "master/.dev.env"},
+				"prd": {Path: "master/.prd.env"},
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "deploy/{{stage}}/api"},
+			},
+			path:       path,
+			dir:        dir,
+			root:       dir,
+			outputRoot: outputRoot,
+			size:       32,
+			w:          io.Discard,
+		}
+	}
+
+	assert.NoError(t, newConfig("dev", "").Validate())
+	for _, stage := range []string{"dev", "prd"} {
+		_, err := newConfig(stage, "").Run()
+		assert.NoError(t, err)
+		b, err := os.ReadFile(filepath.Join(dir, "deploy", stage, "api", ".env"))
+		assert.NoError(t, err)
+		assert.Equal(t, "API_A="+stage+"\n", string(b))
+	}
+
+	out := filepath.Join(dir, "out", "{{stage}}")
+	_, err := newConfig("prd", out).Run()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "out", "prd", "deploy", "prd", "api", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_A=prd\n", string(b))
+
+	if err := os.RemoveAll(filepath.Join(dir, "deploy", "prd")); err != nil {
+		t.Fatal(err)
+	}
+	err = newConfig("dev", "").Validate()
+	assert.ErrorContains(t, err, "failed to validate stage: prd: failed to validate group.api")
+	_, err = newConfig("prd", "").Run()
+	assert.ErrorContains(t, err, "failed to validate group.api")
+}
+
+func TestConfig_Run_onlyChanged(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	central := filepath.Join(dir, "master", ".env")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(central, "API_A=1\nUI_A=1\n")
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	w := &bytes.Buffer{}
+	newConfig := func() *Config {
+		return &Config{
+			Stage: map[string]Stage{
+				"default": {Path: "master/.env"},
+			},
+			Group: map[string]Group{
+				"api": {Prefix: "API", Dir: "api"},
+				"ui":  {Prefix: "UI", Dir: "ui"},
+			},
+			path:        path,
+			dir:         dir,
+			root:        dir,
+			size:        32,
+			w:           w,
+			onlyChanged: true,
+		}
+	}
+	_, err := newConfig().Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, w.String(), "unchanged:")
+
+	// Running again without changes has no effect
+	w.Reset()
+	_, err = newConfig().Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, w.String(), "distributed:")
+	assert.Contains(t, w.String(), "unchanged: group.api\nunchanged: group.ui\n")
+
+	// A changed key or a tampered env file makes the group written
+	write(central, "API_A=2\nUI_A=1\n")
+	write(filepath.Join(dir, "ui", ".env"), "UI_A=tampered\n")
+	w.Reset()
+	_, err = newConfig().Run()
+	assert.NoError(t, err)
+	assert.Contains(t, w.String(), "distributed: group.api")
+	assert.Contains(t, w.String(), "distributed: group.ui")
+	b, err := os.ReadFile(filepath.Join(dir, "ui", ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "UI_A=1\n", string(b))
+
+	w.Reset()
+	_, err = newConfig().Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, w.String(), "distributed:")
+}
+
+func TestConfig_Audit(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nUI_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api", Targets: []string{".env", "config/.env"}},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	if err := os.Mkdir(filepath.Join(dir, "api", "config"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := cfg.Audit()
+	assert.NoError(t, err)
+	assert.Empty(t, actual)
+
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	modes := map[string]os.FileMode{
+		filepath.Join(dir, "api", ".env"):           0o600,
+		filepath.Join(dir, "api", "config", ".env"): 0o640,
+		filepath.Join(dir, "ui", ".env"):            0o644,
+	}
+	for name, mode := range modes {
+		if err := os.Chmod(name, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actual, err = cfg.Audit()
+	assert.NoError(t, err)
+	assert.Equal(t, []FileAudit{
+		{Group: "api", Path: filepath.Join(dir, "api", ".env"), Mode: 0o600},
+		{Group: "api", Path: filepath.Join(dir, "api", "config", ".env"), Mode: 0o640},
+		{Group: "ui", Path: filepath.Join(dir, "ui", ".env"), Mode: 0o644},
+	}, actual)
+}
+
+func TestConfig_PruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api", "ui"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\nUI_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		"api/.env.20240101T000000.000000000Z.bak",
+		"api/.env.20240201T000000.000000000Z.bak",
+		"api/.env.20240301T000000.000000000Z.bak",
+		"api/.env.local.bak",
+		"api/.env.20240101T000000.bak",
+		"ui/.env.20240101T000000.000000000Z.bak",
+		"ui/.env.bak",
+	}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+			"ui":  {Prefix: "UI", Dir: "ui"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+
+	_, err := cfg.PruneBackups(-1)
+	assert.ErrorContains(t, err, "invalid keep: -1")
+
+	cfg.dryRun = true
+	actual, err := cfg.PruneBackups(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "api", ".env.20240101T000000.000000000Z.bak"),
+		filepath.Join(dir, "api", ".env.20240201T000000.000000000Z.bak"),
+	}, actual)
+	for _, name := range files {
+		assert.FileExists(t, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+
+	cfg.dryRun = false
+	actual, err = cfg.PruneBackups(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "api", ".env.20240101T000000.000000000Z.bak"),
+		filepath.Join(dir, "api", ".env.20240201T000000.000000000Z.bak"),
+	}, actual)
+	for _, name := range []string{"api/.env.20240301T000000.000000000Z.bak", "ui/.env.20240101T000000.000000000Z.bak"} {
+		assert.FileExists(t, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+
+	actual, err = cfg.PruneBackups(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "api", ".env.20240301T000000.000000000Z.bak"),
+		filepath.Join(dir, "ui", ".env.20240101T000000.000000000Z.bak"),
+	}, actual)
+	for _, name := range []string{"api/.env.local.bak", "api/.env.20240101T000000.bak", "ui/.env.bak"} {
+		assert.FileExists(t, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+
+	actual, err = cfg.PruneBackups(0)
+	assert.NoError(t, err)
+	assert.Empty(t, actual)
+}
+
+func TestConfig_Run_backup(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	central := filepath.Join(dir, "master", ".env")
+	if err := os.WriteFile(central, []byte("API_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+		},
+		path:   path,
+		dir:    dir,
+		root:   dir,
+		size:   32,
+		w:      io.Discard,
+		backup: true,
+	}
+	target := filepath.Join(dir, "api", ".env")
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	backups, err := findBackups(target)
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+
+	if err := os.WriteFile(central, []byte("API_A=2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	backups, err = findBackups(target)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	b, err := os.ReadFile(backups[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "API_A=1\n", string(b))
+	info, err := os.Stat(backups[0])
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	actual, err := cfg.PruneBackups(0)
+	assert.NoError(t, err)
+	assert.Equal(t, backups, actual)
+}
+
+func Test_isBackupOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		base     string
+		expected bool
+	}{
+		{name: "timestamp", file: ".env.20240101T000000.000000000Z.bak", base: ".env", expected: true},
+		{name: "plain", file: ".env.bak", base: ".env", expected: false},
+		{name: "other layout", file: ".env.20240101T000000Z.bak", base: ".env", expected: false},
+		{name: "separators", file: ".env.2024-01-01_00-00.bak", base: ".env", expected: false},
+		{name: "other file", file: ".env.local.bak", base: ".env", expected: false},
+		{name: "empty stamp", file: ".env..bak", base: ".env", expected: false},
+		{name: "no extension", file: ".env.20240101", base: ".env", expected: false},
+		{name: "env file", file: ".env", base: ".env", expected: false},
+		{name: "other base", file: "app.env.bak", base: ".env", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isBackupOf(tt.file, tt.base))
+		})
+	}
+}
+
+func TestConfig_Reconcile(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "app", "web"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"master/.env": "APP_A=1\nAPP_B=2\nAPP_C=3\nWEB_A=1\n",
+		"app/.env":    "APP_A=1\nAPP_B=changed\nEXTRA=x\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"app": {Prefix: "APP", Dir: "app"},
+			"web": {Prefix: "WEB", Dir: "web"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	actual, err := cfg.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Reconciliation{
+		"app": {Missing: []string{"APP_C"}, Stale: []string{"APP_B"}},
+		"web": {Missing: []string{"WEB_A"}, Stale: nil},
+	}, actual)
+
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	actual, err = cfg.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Reconciliation{
+		"app": {Missing: nil, Stale: nil},
+		"web": {Missing: nil, Stale: nil},
+	}, actual)
+}
+
+func TestConfig_Reconcile_outputSeparator(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "app"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("APP_A=1\nAPP_B=2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"app": {Prefix: "APP", Dir: "app"},
+		},
+		path:   path,
+		dir:    dir,
+		root:   dir,
+		size:   32,
+		w:      io.Discard,
+		outSep: ": ",
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "app", ".env"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), ": 1\n")
+	actual, err := cfg.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Reconciliation{
+		"app": {Missing: nil, Stale: nil},
+	}, actual)
+}
+
+func TestConfig_Reconcile_directives(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "app", "web"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"master/.env": "APP_A=1\n# lem:group=app\nSHARED=s\n# lem:group=web\nOTHER=o\nWEB_A=1\n",
+		"app/.env":    "APP_A=1\n",
+		"web/.env":    "WEB_A=1\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"app": {Prefix: "APP", Dir: "app"},
+			"web": {Prefix: "WEB", Dir: "web"},
+		},
+		path:       path,
+		dir:        dir,
+		root:       dir,
+		size:       32,
+		w:          io.Discard,
+		directives: true,
+	}
+	// The groups are visited in map order, so reconcile repeatedly to cover both orders
+	for range 10 {
+		actual, err := cfg.Reconcile()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]Reconciliation{
+			"app": {Missing: []string{"SHARED"}, Stale: nil},
+			"web": {Missing: []string{"OTHER"}, Stale: nil},
+		}, actual)
+	}
+}
+
+func TestConfig_Promote(t *testing.T) {
+	type args struct {
+		from    string
+		to      string
+		envPath string
+	}
+	type expected struct {
+		content string
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{from: "development", to: "production"},
+			expected: expected{
+				content: "API_ENV=\"api_env\"\n",
+				output:  "promoting: development -> production\ndistributed: group.api -> testdata/sandbox/api/.env.override\n",
+				isError: false,
+			},
+		},
+		{
+			name: "from not found",
+			args: args{from: "dummy", to: "production"},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "to not found",
+			args: args{from: "development", to: "dummy"},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "env path",
+			args: args{from: "development", to: "production", envPath: "testdata/sandbox/master/.env"},
+			expected: expected{
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			_ = os.Remove("testdata/sandbox/api/.env.override")
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default":     {Path: "testdata/sandbox/master/.env"},
+					"development": {Path: "testdata/sandbox/master/.env.development"},
+					"production": {
+						Path: "testdata/sandbox/master/.env",
+						Override: map[string]Override{
+							"api": {Filename: ".env.override"},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+				},
+				path:    "testdata/sandbox/lem.toml",
+				size:    32,
+				w:       w,
+				envPath: tt.args.envPath,
+			}
+			err := cfg.Promote(tt.args.from, tt.args.to)
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.output, w.String())
+			b, err := os.ReadFile("testdata/sandbox/api/.env.override")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.content, string(b))
+			stage, err := cfg.loadStage()
+			assert.NoError(t, err)
+			assert.Equal(t, "default", stage)
+		})
+	}
+}
+
+func TestConfig_Promote_stageVariable(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_STAGE=${LEM_STAGE}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default":     {Path: "master/.env"},
+			"development": {Path: "master/.env"},
+			"production": {
+				Path: "master/.env",
+				Override: map[string]Override{
+					"api": {Filename: ".env.production"},
+				},
+			},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+		},
+		path: path,
+		dir:  dir,
+		root: dir,
+		size: 32,
+		w:    io.Discard,
+	}
+	assert.NoError(t, cfg.Promote("development", "production"))
+	b, err := os.ReadFile(filepath.Join(dir, "api", ".env.production"))
+	assert.NoError(t, err)
+	assert.Equal(t, "API_STAGE=production\n", string(b))
+}
+
+func TestConfig_Run_timing(t *testing.T) {
+	type expected struct {
+		patterns []string
+	}
+	tests := []struct {
+		name         string
+		outputFormat string
+		expected     expected
+	}{
+		{
+			name:         "text",
+			outputFormat: OutputText,
+			expected: expected{
+				patterns: []string{
+					`(?m)^timing: read -> \S+$`,
+					`(?m)^timing: group\.api -> \S+$`,
+					`(?m)^timing: group\.ui -> \S+$`,
+					`(?m)^timing: write -> \S+$`,
+					`(?m)^timing: total -> \S+\n\z`,
+				},
+			},
+		},
+		{
+			name:         "json",
+			outputFormat: OutputJSON,
+			expected: expected{
+				patterns: []string{
+					`(?m)^\{"event":"timing","phase":"read","duration":"\S+"\}$`,
+					`(?m)^\{"event":"timing","phase":"group\.api","duration":"\S+"\}$`,
+					`(?m)^\{"event":"timing","phase":"write","duration":"\S+"\}$`,
+					`(?m)^\{"event":"timing","phase":"total","duration":"\S+"\}\n\z`,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepareState("testdata/sandbox/lem.toml", "default")
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+					},
+					"ui": {
+						Prefix:      "UI",
+						Dir:         "testdata/sandbox/ui",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"BAZ"},
+					},
+				},
+				path:         "testdata/sandbox/lem.toml",
+				size:         32,
+				w:            w,
+				outputFormat: tt.outputFormat,
+				timing:       true,
+			}
+			_, err := cfg.Run()
+			assert.NoError(t, err)
+			for _, pattern := range tt.expected.patterns {
+				assert.Regexp(t, pattern, w.String())
+			}
+		})
+	}
+}
+
+func TestConfig_loadStage_stageFile(t *testing.T) {
+	type expected struct {
+		stage string
+	}
+	tests := []struct {
+		name      string
+		stageFile bool
+		content   *string
+		env       string
+		expected  expected
+	}{
+		{
+			name:      "pinned",
+			stageFile: true,
+			content:   ptr("prod\n"),
+			expected:  expected{stage: "prod"},
+		},
+		{
+			name:      "empty file",
+			stageFile: true,
+			content:   ptr(" \n"),
+			expected:  expected{stage: "default"},
+		},
+		{
+			name:      "no file",
+			stageFile: true,
+			content:   nil,
+			expected:  expected{stage: "default"},
+		},
+		{
+			name:      "disabled",
+			stageFile: false,
+			content:   ptr("prod\n"),
+			expected:  expected{stage: "default"},
+		},
+		{
+			name:      "pinned with stage variable",
+			stageFile: true,
+			content:   ptr("prod\n"),
+			env:       "dev",
+			expected:  expected{stage: "prod"},
+		},
+		{
+			name:      "stage variable without file",
+			stageFile: true,
+			content:   nil,
+			env:       "dev",
+			expected:  expected{stage: "default"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LEM_STAGE", tt.env)
+			root := t.TempDir()
+			if tt.content != nil {
+				if err := os.WriteFile(filepath.Join(root, ".lem-stage"), []byte(*tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			prepareState("testdata/sandbox/lem.toml", "default")
+			cfg := &Config{
+				path:      "testdata/sandbox/lem.toml",
+				root:      root,
+				stageFile: tt.stageFile,
+			}
+			stage, err := cfg.loadStage()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.stage, stage)
+		})
+	}
+}
+
+func TestConfig_Run_storeHash(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:      "API",
+				Dir:         "testdata/sandbox/api",
+				Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+			},
+			"ui": {
+				Prefix:      "UI",
+				Dir:         "testdata/sandbox/ui",
+				Replaceable: []string{"REPLACEABLE1"},
+				Plain:       []string{"BAZ"},
+			},
+		},
+		path:      "testdata/sandbox/lem.toml",
+		size:      32,
+		w:         io.Discard,
+		storeHash: true,
+	}
+	_, err := cfg.Run()
+	assert.NoError(t, err)
+	central, err := os.ReadFile("testdata/sandbox/master/.env")
+	assert.NoError(t, err)
+	api, err := os.ReadFile("testdata/sandbox/api/.env")
+	assert.NoError(t, err)
+	ui, err := os.ReadFile("testdata/sandbox/ui/.env")
+	assert.NoError(t, err)
+	b, err := cfg.StateDump()
+	assert.NoError(t, err)
+	state := map[string]map[string]string{}
+	assert.NoError(t, json.Unmarshal(b, &state))
+	assert.Equal(t, map[string]string{
+		"stage":          "default",
+		"hash.central":   hashOf(central),
+		"hash.group.api": hashOf(api),
+		"hash.group.ui":  hashOf(ui),
+	}, state["testdata/sandbox/lem.toml"])
+
+	// The stored hashes take precedence over the modification times
+	now := time.Now()
+	_ = os.Chtimes("testdata/sandbox/master/.env", now, now)
+	_ = os.Chtimes("testdata/sandbox/ui/.env", now.Add(-time.Hour), now.Add(-time.Hour))
+	stale, err := cfg.Freshness()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"api": false, "ui": false}, stale)
+
+	assert.NoError(t, cfg.storeHashes(map[string]string{
+		"hash.central":   "dummy",
+		"hash.group.api": hashOf(api),
+		"hash.group.ui":  hashOf(ui),
+	}))
+	stale, err = cfg.Freshness()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"api": true, "ui": true}, stale)
+
+	assert.NoError(t, cfg.storeHashes(map[string]string{
+		"hash.central":   hashOf(central),
+		"hash.group.api": "dummy",
+	}))
+	stale, err = cfg.Freshness()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"api": true, "ui": true}, stale)
+}
+
+func TestConfig_Freshness(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+	}
+	type expected struct {
+		stale   map[string]bool
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "testdata/sandbox/ui",
+					},
+					"missing": {
+						Prefix:   "MISSING",
+						Dir:      "testdata/sandbox/ui",
+						Filename: ".env.dummy",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				stale: map[string]bool{
+					"api":     false,
+					"ui":      true,
+					"missing": true,
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+				now := time.Now()
+				_ = os.Chtimes("testdata/sandbox/master/.env", now, now)
+				_ = os.Chtimes("testdata/sandbox/api/.env", now.Add(time.Hour), now.Add(time.Hour))
+				_ = os.Chtimes("testdata/sandbox/ui/.env", now.Add(-time.Hour), now.Add(-time.Hour))
+			},
+		},
+		{
+			name: "group table not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: nil,
+				path:  "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				stale:   nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/dummy",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				stale:   nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				path: "testdata/sandbox/lem.toml",
+			},
+			expected: expected{
+				stale:   nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				w:     io.Discard,
+			}
+			actual, err := cfg.Freshness()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.stale, actual)
+		})
+	}
+}
+
+func TestConfig_Print(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+	}
+	type args struct {
+		id string
+	}
+	type expected struct {
+		output  string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		args     args
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"FOO"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "testdata/sandbox/ui",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			args: args{
+				id: "api",
+			},
+			expected: expected{
+				output:  "API_1_ENV=111\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\nAPI_6_ENV=6 7 8\nFOO=foo\n",
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "group not found",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			args: args{
+				id: "dummy",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api/.env",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			args: args{
+				id: "api",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			args: args{
+				id: "api",
+			},
+			expected: expected{
+				output:  "",
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			w := &bytes.Buffer{}
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     w,
+			}
+			err := cfg.Print(tt.args.id)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, w.String())
+		})
+	}
+}
+
+func TestConfig_RenderAll(t *testing.T) {
+	type fields struct {
+		Stage       map[string]Stage
+		Group       map[string]Group
+		path        string
+		size        int
+		only        []string
+		sourceOrder bool
+	}
+	type expected struct {
+		output  map[string][]byte
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+		setup    func()
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"FOO"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "testdata/sandbox/ui",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				output: map[string][]byte{
+					"api": []byte("API_1_ENV=111\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\nAPI_6_ENV=6 7 8\nFOO=foo\n"),
+					"ui":  []byte("UI_5_ENV=555\n"),
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "source order",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1"},
+						Plain:       []string{"FOO", "BAR"},
+						Defaults:    map[string]string{"API_0_ENV": "000"},
+					},
+				},
+				path:        "testdata/sandbox/lem.toml",
+				size:        32,
+				sourceOrder: true,
+			},
+			expected: expected{
+				output: map[string][]byte{
+					"api": []byte("API_1_ENV=111\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\nAPI_6_ENV=6 7 8\nFOO=foo\nBAR=bar\nAPI_0_ENV=000\n"),
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "restricted groups",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir:    "testdata/sandbox/ui",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				only: []string{"ui"},
+			},
+			expected: expected{
+				output: map[string][]byte{
+					"ui": []byte("UI_5_ENV=555\n"),
+				},
+				isError: false,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "invalid group",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api/.env",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				output:  nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+		{
+			name: "missing stage in config",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				output:  nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "dummy")
+			},
+		},
+		{
+			name: "invalid json option",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "testdata/sandbox/master/.env"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir:    "testdata/sandbox/api",
+						JSON:   "minify",
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+			},
+			expected: expected{
+				output:  nil,
+				isError: true,
+			},
+			setup: func() {
+				prepareState("testdata/sandbox/lem.toml", "default")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			cfg := &Config{
+				Stage:       tt.fields.Stage,
+				Group:       tt.fields.Group,
+				path:        tt.fields.path,
+				size:        tt.fields.size,
+				w:           io.Discard,
+				only:        tt.fields.only,
+				sourceOrder: tt.fields.sourceOrder,
+			}
+			actual, err := cfg.RenderAll()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.output, actual)
+		})
+	}
+}
+
+func TestConfig_RunCombined(t *testing.T) {
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {
+				Prefix:      "API",
+				Dir:         "testdata/sandbox/api",
+				Replaceable: []string{"REPLACEABLE1"},
+				Plain:       []string{"FOO"},
+			},
+			"ui": {
+				Prefix: "UI",
+				Dir:    "testdata/sandbox/ui",
+			},
+		},
+		path: "testdata/sandbox/lem.toml",
+		size: 32,
+		w:    io.Discard,
+	}
+	w := &bytes.Buffer{}
+	assert.NoError(t, cfg.RunCombined(w))
+	assert.Equal(t, "# group.api\nAPI_1_ENV=111\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\nAPI_6_ENV=6 7 8\nFOO=foo\n\n# group.ui\nUI_5_ENV=555\n", w.String())
+
+	cfg.only = []string{"dummy"}
+	w.Reset()
+	assert.Error(t, cfg.RunCombined(w))
+	assert.Empty(t, w.String())
+}
+
+func TestConfig_Watch(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		size  int
+		w     io.Writer
+	}
+	type expected struct {
+		path    string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "stop at error",
+			fields: fields{
+				Stage: nil,
+				Group: map[string]Group{
+					"api": {
+						Prefix:      "API",
+						Dir:         "testdata/sandbox/api",
+						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:     true,
+					},
+				},
+				path: "testdata/sandbox/lem.toml",
+				size: 32,
+				w:    io.Discard,
+			},
+			expected: expected{
+				path:    "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				size:  tt.fields.size,
+				w:     tt.fields.w,
+			}
+			actual, err := cfg.Watch()
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected.path, actual)
+		})
+	}
+}
+
+func TestConfig_resolveExtends(t *testing.T) {
+	type fields struct {
+		Group map[string]Group
+	}
+	type expected struct {
+		groups  map[string]Group
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		expected expected
+	}{
+		{
+			name: "multi-level",
+			fields: fields{
+				Group: map[string]Group{
+					"base": {Prefix: "BASE", Dir: "./base", Plain: []string{"FOO"}, IsCheck: true},
+					"api":  {Extends: "base", Prefix: "API", Dir: "./api", Plain: []string{"BAR"}},
+					"job":  {Extends: "api", Dir: "./job", Filename: ".env.job"},
+				},
+			},
+			expected: expected{
+				groups: map[string]Group{
+					"base": {Prefix: "BASE", Dir: "./base", Plain: []string{"FOO"}, IsCheck: true},
+					"api":  {Extends: "base", Prefix: "API", Dir: "./api", Plain: []string{"FOO", "BAR"}, IsCheck: true},
+					"job":  {Extends: "api", Prefix: "API", Dir: "./job", Filename: ".env.job", Plain: []string{"FOO", "BAR"}, IsCheck: true},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "defaults",
+			fields: fields{
+				Group: map[string]Group{
+					"base": {Prefix: "BASE", Dir: "./base", Defaults: map[string]string{"API_A": "1", "API_B": "2"}},
+					"api":  {Extends: "base", Prefix: "API", Defaults: map[string]string{"API_B": "3"}},
+				},
+			},
+			expected: expected{
+				groups: map[string]Group{
+					"base": {Prefix: "BASE", Dir: "./base", Defaults: map[string]string{"API_A": "1", "API_B": "2"}},
+					"api":  {Extends: "base", Prefix: "API", Defaults: map[string]string{"API_A": "1", "API_B": "3"}},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "output files not inherited",
+			fields: fields{
+				Group: map[string]Group{
+					"api":  {Prefix: "API", Dir: "./api", Filename: ".env.api", Targets: []string{".env", "app.env"}},
+					"apiw": {Extends: "api", Prefix: "APIW"},
+				},
+			},
+			expected: expected{
+				groups: map[string]Group{
+					"api":  {Prefix: "API", Dir: "./api", Filename: ".env.api", Targets: []string{".env", "app.env"}},
+					"apiw": {Extends: "api", Prefix: "APIW"},
+				},
+				isError: false,
+			},
+		},
+		{
+			name: "unknown parent",
+			fields: fields{
+				Group: map[string]Group{
+					"api": {Extends: "dummy", Prefix: "API", Dir: "./api"},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "self reference",
+			fields: fields{
+				Group: map[string]Group{
+					"api": {Extends: "api", Prefix: "API", Dir: "./api"},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+		{
+			name: "cycle",
+			fields: fields{
+				Group: map[string]Group{
+					"a": {Extends: "b"},
+					"b": {Extends: "c"},
+					"c": {Extends: "a"},
+				},
+			},
+			expected: expected{
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Group: tt.fields.Group,
+			}
+			err := cfg.resolveExtends(toml.MetaData{})
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.groups, cfg.Group)
+		})
+	}
+}
+
+func TestConfig_duplicateKeys(t *testing.T) {
+	type args struct {
+		e map[string]string
+	}
+	type expected struct {
+		dups map[string][]string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				e: map[string]string{
+					"API_UI_TOKEN": "1",
+					"API_KEY":      "2",
+					"SHARED_KEY":   "3",
+					"FOO":          "4",
+					"UI_KEY":       "5",
+				},
+			},
+			expected: expected{
+				dups: map[string][]string{
+					"API_UI_TOKEN": {"api", "ui"},
+					"SHARED_KEY":   {"api", "job", "ui"},
+				},
+			},
+		},
+		{
+			name: "no duplicates",
+			args: args{
+				e: map[string]string{
+					"API_KEY": "1",
+					"UI_KEY":  "2",
+				},
+			},
+			expected: expected{
+				dups: map[string][]string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Group: map[string]Group{
+					"api": {Prefix: "API", Replaceable: []string{"SHARED"}},
+					"ui":  {Prefix: "UI", Replaceable: []string{"API_UI", "SHARED"}},
+					"job": {Prefix: "JOB", Plain: []string{"SHARED_KEY"}},
+				},
+			}
+			actual := cfg.duplicateKeys(tt.args.e)
+			assert.Equal(t, tt.expected.dups, actual)
+		})
+	}
+}
+
+func TestConfig_groupOf(t *testing.T) {
+	type args struct {
+		stage string
+		id    string
+	}
+	type expected struct {
+		group Group
+		ok    bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "no override",
+			args: args{
+				stage: "default",
+				id:    "api",
+			},
+			expected: expected{
+				group: Group{Prefix: "API", Dir: "./api", IsCheck: true},
+				ok:    true,
+			},
+		},
+		{
+			name: "override",
+			args: args{
+				stage: "prod",
+				id:    "api",
+			},
+			expected: expected{
+				group: Group{Prefix: "API", Dir: "./deploy/api", Filename: ".env.production", IsCheck: false},
+				ok:    true,
+			},
+		},
+		{
+			name: "partial override",
+			args: args{
+				stage: "stg",
+				id:    "api",
+			},
+			expected: expected{
+				group: Group{Prefix: "API", Dir: "./deploy/api", IsCheck: true},
+				ok:    true,
+			},
+		},
+		{
+			name: "unknown stage",
+			args: args{
+				stage: "dummy",
+				id:    "api",
+			},
+			expected: expected{
+				group: Group{Prefix: "API", Dir: "./api", IsCheck: true},
+				ok:    true,
+			},
+		},
+		{
+			name: "unknown group",
+			args: args{
+				stage: "prod",
+				id:    "dummy",
+			},
+			expected: expected{
+				group: Group{},
+				ok:    false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+					"stg": {
+						Path: "master/.env.staging",
+						Override: map[string]Override{
+							"api": {Dir: "./deploy/api"},
+						},
+					},
+					"prod": {
+						Path: "master/.env.production",
+						Override: map[string]Override{
+							"api": {Dir: "./deploy/api", Filename: ".env.production", IsCheck: ptr(false)},
+						},
+					},
+				},
+				Group: map[string]Group{
+					"api": {Prefix: "API", Dir: "./api", IsCheck: true},
+				},
+			}
+			group, ok := cfg.groupOf(tt.args.stage, tt.args.id)
+			assert.Equal(t, tt.expected.group, group)
+			assert.Equal(t, tt.expected.ok, ok)
+		})
+	}
+}
+
+func Test_createEnvrc(t *testing.T) {
+	type fields struct {
+		Stage map[string]Stage
+		Group map[string]Group
+		path  string
+		dir   string
+		root  string
+		size  int
+		w     io.Writer
+	}
+	type args struct {
+		group Group
+		dir   string
+	}
+	type expected struct {
+		content string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/ui")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+				root: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api")
+						return path
+					}(),
+					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+					IsCheck:       true,
+					DirenvSupport: []string{"api", "ui"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "watch_file ./.env\ndotenv_if_exists ./.env\nwatch_file ../ui/.env\ndotenv_if_exists ../ui/.env\n",
+				isError: false,
+			},
+		},
+		{
+			name: "extra lines",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api")
+							return path
+						}(),
+					},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+				root: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api")
+						return path
+					}(),
+					DirenvSupport: []string{"api"},
+					EnvrcExtra:    []string{"layout go", "PATH_add ./bin"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "watch_file ./.env\ndotenv_if_exists ./.env\nlayout go\nPATH_add ./bin\n",
+				isError: false,
+			},
+		},
+		{
+			name: "duplicate ids",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/ui")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+				root: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api")
+						return path
+					}(),
+					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+					IsCheck:       true,
+					DirenvSupport: []string{"api", "api"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "watch_file ./.env\ndotenv_if_exists ./.env\n",
+				isError: false,
+			},
+		},
+		{
+			name: "custom filename",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/ui")
+							return path
+						}(),
+						Filename:      ".env.local",
+						Replaceable:   []string{"REPLACEABLE1"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+				root: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api")
+						return path
+					}(),
+					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+					IsCheck:       true,
+					DirenvSupport: []string{"api", "ui"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "watch_file ./.env\ndotenv_if_exists ./.env\nwatch_file ../ui/.env.local\ndotenv_if_exists ../ui/.env.local\n",
+				isError: false,
+			},
+		},
+		{
+			name: "resolve error",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/ui")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				dir:  "testdata/sandbox",
+				root: "testdata/sandbox",
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api")
+						return path
+					}(),
+					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+					IsCheck:       true,
+					DirenvSupport: []string{"api", "ui"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "",
+				isError: true,
+			},
+		},
+		{
+			name: "directory but file",
+			fields: fields{
+				Stage: map[string]Stage{
+					"default": {Path: "dummy"},
+				},
+				Group: map[string]Group{
+					"api": {
+						Prefix: "API",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/api/.env")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+						IsCheck:       true,
+						DirenvSupport: []string{"api", "ui"},
+					},
+					"ui": {
+						Prefix: "UI",
+						Dir: func() string {
+							path, _ := filepath.Abs("testdata/sandbox/ui")
+							return path
+						}(),
+						Replaceable:   []string{"REPLACEABLE1"},
+						IsCheck:       false,
+						DirenvSupport: []string{"ui"},
+					},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox")
+					return path
+				}(),
+			},
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Dir: func() string {
+						path, _ := filepath.Abs("testdata/sandbox/api/.env")
+						return path
+					}(),
+					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
+					IsCheck:       true,
+					DirenvSupport: []string{"api", "ui"},
+				},
+				dir: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+			},
+			expected: expected{
+				content: "",
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Stage: tt.fields.Stage,
+				Group: tt.fields.Group,
+				path:  tt.fields.path,
+				dir:   tt.fields.dir,
+				root:  tt.fields.root,
+				size:  tt.fields.size,
+				w:     tt.fields.w,
+			}
+			path, err := cfg.createEnvrc("", tt.args.group, tt.args.dir)
+			if tt.expected.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			content, err := os.ReadFile(filepath.Clean(path))
+			if err != nil {
+				t.Fatalf("failed to read written file: %v", err)
+			}
+			assert.Equal(t, string(content), tt.expected.content)
+		})
+	}
+}
+
+func Test_resolvePath_symlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, d := range []string{"vendor/api", "app"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "vendor", "api"), filepath.Join(root, "app", "api")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "app", "ext")); err != nil {
+		t.Fatal(err)
+	}
+	type expected struct {
+		isDir   bool
+		outside bool
+		isError bool
+	}
+	tests := []struct {
+		name           string
+		path           string
+		followSymlinks bool
+		expected       expected
+	}{
+		{
+			name:           "symlink inside root",
+			path:           "app/api",
+			followSymlinks: false,
+			expected:       expected{isDir: true, isError: false},
+		},
+		{
+			name:           "symlink inside root followed",
+			path:           "app/api",
+			followSymlinks: true,
+			expected:       expected{isDir: true, isError: false},
+		},
+		{
+			name:           "symlink to outside",
+			path:           "app/ext",
+			followSymlinks: false,
+			expected:       expected{isDir: true, isError: false},
+		},
+		{
+			name:           "symlink to outside followed",
+			path:           "app/ext",
+			followSymlinks: true,
+			expected:       expected{isDir: false, outside: true, isError: true},
 		},
 		{
-			name: "stage table not found",
-			fields: fields{
-				Stage: nil,
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1"},
-						IsCheck:     false,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name:           "not found followed",
+			path:           "app/dummy",
+			followSymlinks: true,
+			expected:       expected{isDir: false, isError: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				dir:            root,
+				root:           root,
+				followSymlinks: tt.followSymlinks,
+			}
+			path, isDir, err := cfg.resolvePath(tt.path, false)
+			if tt.expected.isError {
+				var outsideErr *OutsideRootError
+				assert.Error(t, err)
+				assert.Equal(t, tt.expected.outside, errors.As(err, &outsideErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, tt.path), path)
+			assert.Equal(t, tt.expected.isDir, isDir)
+		})
+	}
+}
+
+func Test_resolvePath(t *testing.T) {
+	type args struct {
+		path          string
+		allowExternal bool
+	}
+	type expected struct {
+		path    string
+		isDir   bool
+		outside string
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "file",
+			args: args{
+				path:          "master/.env",
+				allowExternal: false,
+			},
+			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/master/.env")
+					return path
+				}(),
+				isDir:   false,
+				isError: false,
+			},
+		},
+		{
+			name: "directory",
+			args: args{
+				path:          "./api",
+				allowExternal: false,
+			},
+			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+				isDir:   true,
+				isError: false,
+			},
+		},
+		{
+			name: "outside of the project root",
+			args: args{
+				path:          "../../lem.go",
+				allowExternal: false,
 			},
 			expected: expected{
+				path:  "",
+				isDir: false,
+				outside: func() string {
+					path, _ := filepath.Abs("lem.go")
+					return path
+				}(),
 				isError: true,
 			},
 		},
 		{
-			name: "invalid stage path",
-			fields: fields{
-				Stage: map[string]string{
-					"dummy": "../.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1"},
-						IsCheck:     false,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "outside of the project root allowed",
+			args: args{
+				path:          "../../lem.go",
+				allowExternal: true,
+			},
+			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("lem.go")
+					return path
+				}(),
+				isDir:   false,
+				isError: false,
+			},
+		},
+		{
+			name: "name starting with dots",
+			args: args{
+				path:          "..shared",
+				allowExternal: false,
+			},
+			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/..shared")
+					return path
+				}(),
+				isDir:   true,
+				isError: false,
+			},
+		},
+		{
+			name: "redundant elements",
+			args: args{
+				path:          "./api/../master//.env",
+				allowExternal: false,
 			},
 			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/master/.env")
+					return path
+				}(),
+				isDir:   false,
+				isError: false,
+			},
+		},
+		{
+			name: "back into the project root",
+			args: args{
+				path:          "../sandbox/api/",
+				allowExternal: false,
+			},
+			expected: expected{
+				path: func() string {
+					path, _ := filepath.Abs("testdata/sandbox/api")
+					return path
+				}(),
+				isDir:   true,
+				isError: false,
+			},
+		},
+		{
+			name: "outside of the project root with platform separators",
+			args: args{
+				path:          filepath.Join("..", "..", "lem.go"),
+				allowExternal: false,
+			},
+			expected: expected{
+				path:    "",
+				isDir:   false,
 				isError: true,
 			},
 		},
 		{
-			name: "stage path not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "./.dummy",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1"},
-						IsCheck:     false,
-					},
+			name: "not found",
+			args: args{
+				path:          "master/.env.dummy",
+				allowExternal: true,
+			},
+			expected: expected{
+				path:    "",
+				isDir:   false,
+				isError: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := filepath.Abs("testdata/sandbox")
+			cfg := &Config{
+				dir:  dir,
+				root: dir,
+			}
+			path, isDir, err := cfg.resolvePath(tt.args.path, tt.args.allowExternal)
+			if tt.expected.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tt.expected.outside != "" {
+				var outsideErr *OutsideRootError
+				if assert.ErrorAs(t, err, &outsideErr) {
+					assert.Equal(t, tt.expected.outside, outsideErr.Path)
+					assert.Equal(t, dir, outsideErr.Root)
+				}
+			}
+			assert.Equal(t, tt.expected.path, path)
+			assert.Equal(t, tt.expected.isDir, isDir)
+		})
+	}
+}
+
+func Test_isOutside(t *testing.T) {
+	tests := []struct {
+		name     string
+		rel      string
+		expected bool
+	}{
+		{name: "current", rel: ".", expected: false},
+		{name: "child", rel: filepath.Join("api", "sub"), expected: false},
+		{name: "parent", rel: "..", expected: true},
+		{name: "sibling", rel: filepath.Join("..", "other"), expected: true},
+		{name: "name starting with dots", rel: "..shared", expected: false},
+		{name: "child starting with dots", rel: filepath.Join("..shared", "api"), expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isOutside(tt.rel))
+		})
+	}
+}
+
+func Test_projectRoot(t *testing.T) {
+	type args struct {
+		dir     string
+		markers []string
+	}
+	type expected struct {
+		dir string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "basic",
+			args: args{
+				dir:     "testdata/sandbox",
+				markers: []string{dummyGitDir},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+		{
+			name: "child",
+			args: args{
+				dir:     "testdata/sandbox/api",
+				markers: []string{dummyGitDir},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+		{
+			name: "nested",
+			args: args{
+				dir:     "testdata/sandbox/api/subdir",
+				markers: []string{dummyGitDir},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+		{
+			name: "marker is a file",
+			args: args{
+				dir:     "testdata/sandbox/api",
+				markers: []string{"lem.toml"},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+		{
+			name: "any of the markers",
+			args: args{
+				dir:     "testdata/sandbox/api",
+				markers: []string{".notfound", "lem.toml"},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+		{
+			name: "marker not found",
+			args: args{
+				dir:     "testdata/sandbox",
+				markers: []string{".notfound"},
+			},
+			expected: expected{
+				dir: "testdata/sandbox",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := projectRoot(tt.args.dir, tt.args.markers)
+			assert.Equal(t, tt.expected.dir, actual)
+		})
+	}
+}
+
+func Test_projectRoot_worktree(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, ".git"), []byte("gitdir: /path/to/repo/.git/worktrees/wt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(root, "api")
+	if err := os.Mkdir(sub, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, root, projectRoot(sub, []string{defaultGitDir}))
+}
+
+func TestConfig_readEnv(t *testing.T) {
+	type args struct {
+		path        string
+		size        int
+		rawValues   bool
+		normalize   bool
+		includes    bool
+		directives  bool
+		kvSep       string
+		format      string
+		maxFileSize int64
+		strict      bool
+	}
+	type expected struct {
+		e       map[string]string
+		n       int
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
+		{
+			name: "patterns",
+			args: args{
+				path: "testdata/sandbox/master/.env",
+				size: 32,
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_1_ENV":          "111",
+					"API_2_ENV":          "\"222\"",
+					"API_3_ENV":          "'333'",
+					"API_4_ENV":          "`444`",
+					"BAR":                "bar",
+					"BAZ":                "baz",
+					"FOO":                "foo",
+					"REPLACEABLE1_6_ENV": "6 7 8",
+					"UI_5_ENV":           "555",
 				},
-				path: "testdata/sandbox/lem.toml",
+				n:       9,
+				isError: false,
+			},
+		},
+		{
+			name: "empty file",
+			args: args{
+				path: "testdata/sandbox/master/.env.empty",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
+				e:       map[string]string{},
+				n:       0,
+				isError: false,
 			},
 		},
 		{
-			name: "stage is a directory",
-			fields: fields{
-				Stage: map[string]string{
-					"dummy": "testdata/sandbox",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1"},
-						IsCheck:     false,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "trim values",
+			args: args{
+				path:      "testdata/sandbox/master/.env.spaces",
+				size:      32,
+				rawValues: false,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"SPACES":        "",
+					"QUOTED":        "\"  leading\"",
+					"PADDED_QUOTED": "\"  leading\"",
+					"PADDED":        "value",
+				},
+				n:       4,
+				isError: false,
 			},
 		},
 		{
-			name: "group table not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     os.Stdout,
+			name: "raw values",
+			args: args{
+				path:      "testdata/sandbox/master/.env.spaces",
+				size:      32,
+				rawValues: true,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"SPACES":        "   ",
+					"QUOTED":        "\"  leading\"",
+					"PADDED_QUOTED": "  \"  leading\"  ",
+					"PADDED":        " value ",
+				},
+				n:       4,
+				isError: false,
 			},
 		},
 		{
-			name: "empty group prefix",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "normalize values",
+			args: args{
+				path:      "testdata/sandbox/master/.env.normalize",
+				size:      32,
+				normalize: true,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"OUTER":  "v",
+					"INNER":  " v ",
+					"SINGLE": "v",
+					"MIXED":  "\"v'",
+					"LONE":   "\"",
+					"PLAIN":  "v",
+				},
+				n:       6,
+				isError: false,
 			},
 		},
 		{
-			name: "empty group dir",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "normalize raw values",
+			args: args{
+				path:      "testdata/sandbox/master/.env.normalize",
+				size:      32,
+				rawValues: true,
+				normalize: true,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"OUTER":  "v",
+					"INNER":  " v ",
+					"SINGLE": "v",
+					"MIXED":  "\"v'",
+					"LONE":   "\"",
+					"PLAIN":  "v",
+				},
+				n:       6,
+				isError: false,
 			},
 		},
 		{
-			name: "invalid group path",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "../api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "not normalized",
+			args: args{
+				path: "testdata/sandbox/master/.env.normalize",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"OUTER":  "\"v\"",
+					"INNER":  "\" v \"",
+					"SINGLE": "'v'",
+					"MIXED":  "\"v'",
+					"LONE":   "\"",
+					"PLAIN":  "v",
+				},
+				n:       6,
+				isError: false,
 			},
 		},
 		{
-			name: "group path not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api/.env",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "includes",
+			args: args{
+				path:     "testdata/sandbox/master/.env.include",
+				size:     32,
+				includes: true,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"FOO":    "included",
+					"SECRET": "secret",
+					"BAR":    "bar",
+				},
+				n:       4,
+				isError: false,
 			},
 		},
 		{
-			name: "group path is not a directory",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/dummy",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "includes disabled",
+			args: args{
+				path: "testdata/sandbox/master/.env.include",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"FOO": "foo",
+					"BAR": "bar",
+				},
+				n:       2,
+				isError: false,
 			},
 		},
 		{
-			name: "group replaceable array contains empty string",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api/",
-						Replaceable: []string{"FOO", ""},
-						IsCheck:     true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "include cycle",
+			args: args{
+				path:     "testdata/sandbox/master/.env.include.cycle",
+				size:     32,
+				includes: true,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
 		},
 		{
-			name: "group plain array contains empty string",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:  "API",
-						Dir:     "testdata/sandbox/api/",
-						Plain:   []string{"FOO", "BAR", ""},
-						IsCheck: true,
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "include outside of the project root",
+			args: args{
+				path:     "testdata/sandbox/master/.env.include.outside",
+				size:     32,
+				includes: true,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
 		},
 		{
-			name: "group direnv array contains empty string",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:        "API",
-						Dir:           "testdata/sandbox/api/",
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", ""},
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "colon separator",
+			args: args{
+				path:  "testdata/sandbox/master/.env.colon",
+				size:  32,
+				kvSep: ":",
 			},
 			expected: expected{
-				isError: true,
+				e: map[string]string{
+					"API_1_ENV": "111",
+					"API_URL":   "http://localhost:8080",
+					"UI_5_ENV":  "555",
+				},
+				n:       3,
+				isError: false,
 			},
 		},
 		{
-			name: "group direnv array contains invalid id",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:        "API",
-						Dir:           "testdata/sandbox/api/",
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", "invalid"},
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "colon file with default separator",
+			args: args{
+				path: "testdata/sandbox/master/.env.colon",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
+				e:       map[string]string{},
+				n:       0,
+				isError: false,
 			},
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
-			}
-			err := cfg.Validate()
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-		})
-	}
-}
-
-func TestConfig_Current(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
-	}
-	type expected struct {
-		isError bool
-	}
-	tests := []struct {
-		name     string
-		fields   fields
-		expected expected
-		setup    func()
-	}{
 		{
-			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "multiline",
+			args: args{
+				path: "testdata/sandbox/master/.env.multiline",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
+				e: map[string]string{
+					"API_CERT":   "-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIUXk4=\n-----END CERTIFICATE-----",
+					"API_INLINE": "single line",
+					"API_NOTE":   "first\nsecond",
+					"API_AFTER":  "after",
+				},
+				n:       4,
 				isError: false,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
 		},
 		{
-			name: "stage table not found",
-			fields: fields{
-				Stage: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     io.Discard,
+			name: "unterminated multiline",
+			args: args{
+				path: "testdata/sandbox/master/.env.unterminated",
+				size: 32,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
 		},
 		{
-			name: "missing stage in config",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "strict",
+			args: args{
+				path:   "testdata/sandbox/master/.env.strict",
+				size:   32,
+				format: FormatStrict,
 			},
 			expected: expected{
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "dummy")
+				e: map[string]string{
+					"API_PLAIN":  "plain",
+					"API_DOUBLE": "line1\nline2 \"quoted\"",
+					"API_SINGLE": "  literal \\n  ",
+					"API_SPACES": "  padded  ",
+					"API_MULTI":  "first\nsecond",
+				},
+				n:       5,
+				isError: false,
 			},
 		},
 		{
-			name: "missing env file",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+			name: "strict invalid escape",
+			args: args{
+				path:   "testdata/sandbox/master/.env.badquote",
+				size:   32,
+				format: FormatStrict,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "noexists")
-			},
 		},
 		{
-			name: "missing config path in state",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "raw keeps quotes",
+			args: args{
+				path:   "testdata/sandbox/master/.env.badquote",
+				size:   32,
+				format: FormatRaw,
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_BAD": "\"invalid \\q escape\"",
 				},
-				path: "testdata/sandbox/lem.toml",
+				n:       1,
+				isError: false,
+			},
+		},
+		{
+			name: "json with hash",
+			args: args{
+				path: "testdata/sandbox/master/.env.json",
 				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/invalid", "default")
+				e: map[string]string{
+					"API_THEME": `{"color": "#fff", "tags": ["a", "b"]}`,
+					"API_LIST":  "[1, 2, 3]",
+					"API_URL":   "https://example.com/#anchor",
+					"API_OBJ":   "{\n  \"nested\": {\"hash\": \"#1\"}\n}",
+				},
+				n:       4,
+				isError: false,
 			},
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.setup()
-			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
-			}
-			err := cfg.Current()
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-		})
-	}
-}
-
-func TestConfig_Switch(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
-	}
-	type args struct {
-		stage string
-	}
-	type expected struct {
-		isError bool
-	}
-	tests := []struct {
-		name     string
-		fields   fields
-		args     args
-		expected expected
-		setup    func()
-	}{
 		{
-			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "within max file size",
+			args: args{
+				path:        "testdata/sandbox/master/.env.development",
+				size:        32,
+				maxFileSize: 64,
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_ENV": "\"api_env\"",
+					"UI_ENV":  "\"ui_env\"",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+				n:       2,
+				isError: false,
 			},
+		},
+		{
+			name: "directives",
 			args: args{
-				stage: "default",
+				path:       "testdata/sandbox/master/.env.directive",
+				size:       32,
+				directives: true,
 			},
 			expected: expected{
+				e: map[string]string{
+					"SHARED_TOKEN": "token",
+					"SHARED_URL":   "https://example.com",
+					"PLAIN":        "v",
+				},
+				n:       3,
 				isError: false,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
 		},
 		{
-			name: "stage table not found",
-			fields: fields{
-				Stage: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     io.Discard,
-			},
+			name: "invalid directive",
 			args: args{
-				stage: "default",
+				path:       "testdata/sandbox/master/.env.directive.invalid",
+				size:       32,
+				directives: true,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
 		},
 		{
-			name: "missing stage in config",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "invalid directive disabled",
+			args: args{
+				path: "testdata/sandbox/master/.env.directive.invalid",
 				size: 32,
-				w:    io.Discard,
 			},
+			expected: expected{
+				e: map[string]string{
+					"SHARED_TOKEN": "token",
+				},
+				n:       1,
+				isError: false,
+			},
+		},
+		{
+			name: "exceeds max file size",
 			args: args{
-				stage: "dummy",
+				path:        "testdata/sandbox/master/.env",
+				size:        32,
+				maxFileSize: 16,
 			},
 			expected: expected{
+				e:       nil,
+				n:       0,
 				isError: true,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
 		},
 		{
-			name: "missing config path in state",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				path: "testdata/sandbox/lem.toml",
+			name: "empty keys",
+			args: args{
+				path: "testdata/sandbox/master/.env.emptykey",
 				size: 32,
-				w:    io.Discard,
 			},
+			expected: expected{
+				e: map[string]string{
+					"BAR": "bar",
+					"FOO": "foo",
+				},
+				n:       2,
+				isError: false,
+			},
+		},
+		{
+			name: "empty keys in strict mode",
 			args: args{
-				stage: "default",
+				path:   "testdata/sandbox/master/.env.emptykey",
+				size:   32,
+				strict: true,
 			},
 			expected: expected{
-				isError: false, // Written as a new config path
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/invalid", "default")
+				e:       nil,
+				n:       0,
+				isError: true,
 			},
 		},
 	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.setup()
+			root, _ := filepath.Abs("testdata/sandbox")
 			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
+				root:        root,
+				size:        tt.args.size,
+				rawValues:   tt.args.rawValues,
+				normalize:   tt.args.normalize,
+				includes:    tt.args.includes,
+				directives:  tt.args.directives,
+				kvSep:       tt.args.kvSep,
+				format:      tt.args.format,
+				maxFileSize: tt.args.maxFileSize,
+				strict:      tt.args.strict,
+				w:           io.Discard,
 			}
-			err := cfg.Switch(tt.args.stage)
+			m, n, err := cfg.readEnv(context.Background(), tt.args.path)
 			if tt.expected.isError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
 			}
+			assert.Equal(t, tt.expected.e, m)
+			assert.Equal(t, tt.expected.n, n)
 		})
 	}
 }
 
-func TestConfig_List(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
+func TestConfig_readEnv_emptyKey(t *testing.T) {
+	for _, line := range []string{"=value", "   =x"} {
+		t.Run(line, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte("FOO=foo\n"+line+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			cfg := &Config{size: 32, w: buf}
+			m, n, err := cfg.readEnv(context.Background(), path)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{"FOO": "foo"}, m)
+			assert.Equal(t, 1, n)
+			assert.Equal(t, 1, cfg.warnings)
+			assert.Contains(t, buf.String(), "has an empty key and is skipped")
+
+			cfg = &Config{size: 32, w: io.Discard, strict: true}
+			_, _, err = cfg.readEnv(context.Background(), path)
+			assert.ErrorContains(t, err, "empty key in line")
+
+			buf.Reset()
+			cfg = &Config{size: 32, w: buf, outputFormat: OutputJSON}
+			_, _, err = cfg.readEnv(context.Background(), path)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, cfg.warnings)
+			var event map[string]string
+			assert.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+			assert.Equal(t, map[string]string{"event": "emptyKey", "path": path, "line": strings.TrimSpace(line)}, event)
+		})
 	}
-	type expected struct {
-		entries []Entry
-		isError bool
+}
+
+func TestConfig_readEnv_directives(t *testing.T) {
+	cfg := &Config{
+		size:       32,
+		directives: true,
 	}
+	_, _, err := cfg.readEnv(context.Background(), "testdata/sandbox/master/.env.directive")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]keyMeta{
+		"SHARED_TOKEN": {groups: []string{"api"}, secret: true},
+		"SHARED_URL":   {groups: []string{"ui", "api"}},
+	}, cfg.meta)
+	assert.Equal(t, []string{"SHARED_TOKEN", "SHARED_URL"}, cfg.directedKeys("api"))
+	assert.Equal(t, []string{"SHARED_URL"}, cfg.directedKeys("ui"))
+	assert.Nil(t, cfg.directedKeys("db"))
+	assert.Equal(t, maskedValue, cfg.maskValue("SHARED_TOKEN", "token"))
+	assert.Equal(t, "https://example.com", cfg.maskValue("SHARED_URL", "https://example.com"))
+}
+
+func Test_parseMeta(t *testing.T) {
 	tests := []struct {
 		name     string
-		fields   fields
-		expected expected
-		setup    func()
+		attrs    string
+		expected keyMeta
+		isError  bool
+	}{
+		{name: "group", attrs: "group=api", expected: keyMeta{groups: []string{"api"}}},
+		{name: "groups", attrs: "group=api,group=ui,group=api", expected: keyMeta{groups: []string{"api", "ui"}}},
+		{name: "secret", attrs: " secret ", expected: keyMeta{secret: true}},
+		{name: "group and secret", attrs: "group = api , secret", expected: keyMeta{groups: []string{"api"}, secret: true}},
+		{name: "empty group", attrs: "group=", isError: true},
+		{name: "unknown", attrs: "public", isError: true},
+		{name: "empty", attrs: "", isError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := parseMeta(tt.attrs)
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestConfig_overlayFromEnv(t *testing.T) {
+	type args struct {
+		fromEnv []string
+		env     map[string]string
+		base    map[string]string
+	}
+	type expected struct {
+		e       map[string]string
+		n       int
+		isError bool
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
 	}{
 		{
-			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
-				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:        "API",
-						Dir:           "./api",
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						Plain:         []string{"FOO", "BAR"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", "ui"},
-					},
-					"ui": {
-						Prefix:        "UI",
-						Dir:           "./ui",
-						Replaceable:   []string{"REPLACEABLE1"},
-						Plain:         []string{"BAZ"},
-						IsCheck:       false,
-						DirenvSupport: []string{"ui"},
-					},
-				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
-			},
-			expected: expected{
-				entries: []Entry{
-					{Group: "api", Prefix: "API", Type: "direct", Name: "1_ENV", Value: "111"},
-					{Group: "api", Prefix: "API", Type: "direct", Name: "2_ENV", Value: "\"222\""},
-					{Group: "api", Prefix: "API", Type: "direct", Name: "3_ENV", Value: "'333'"},
-					{Group: "api", Prefix: "API", Type: "direct", Name: "4_ENV", Value: "`444`"},
-					{Group: "api", Prefix: "API", Type: "indirect", Name: "6_ENV", Value: "6 7 8"},
-					{Group: "api", Prefix: "API", Type: "plain", Name: "BAR", Value: "bar"},
-					{Group: "api", Prefix: "API", Type: "plain", Name: "FOO", Value: "foo"},
-					{Group: "ui", Prefix: "UI", Type: "direct", Name: "5_ENV", Value: "555"},
-					{Group: "ui", Prefix: "UI", Type: "indirect", Name: "6_ENV", Value: "6 7 8"},
-					{Group: "ui", Prefix: "UI", Type: "plain", Name: "BAZ", Value: "baz"},
-				},
-				isError: false,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
-		},
-		{
-			name: "stage table not found",
-			fields: fields{
-				Stage: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     io.Discard,
-			},
-			expected: expected{
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
-			},
-		},
-		{
-			name: "missing stage in config",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "basic",
+			args: args{
+				fromEnv: []string{"LEM_TEST_API_SECRET", "LEM_TEST_API_TOKEN"},
+				env: map[string]string{
+					"LEM_TEST_API_SECRET": "secret",
+					"LEM_TEST_API_TOKEN":  "",
+				},
+				base: map[string]string{
+					"LEM_TEST_API_SECRET": "placeholder",
+					"API_KEY":             "1",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "dummy")
+				e: map[string]string{
+					"LEM_TEST_API_SECRET": "secret",
+					"LEM_TEST_API_TOKEN":  "",
+					"API_KEY":             "1",
+				},
+				n:       3,
+				isError: false,
 			},
 		},
 		{
-			name: "group table not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "no keys",
+			args: args{
+				fromEnv: nil,
+				base: map[string]string{
+					"API_KEY": "1",
 				},
-				Group: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     os.Stdout,
 			},
 			expected: expected{
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"API_KEY": "1",
+				},
+				n:       1,
+				isError: false,
 			},
 		},
 		{
-			name: "missing config path in state",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "not set in the environment",
+			args: args{
+				fromEnv: []string{"LEM_TEST_API_SECRET", "LEM_TEST_API_MISSING"},
+				env: map[string]string{
+					"LEM_TEST_API_SECRET": "secret",
+				},
+				base: map[string]string{
+					"API_KEY": "1",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
+				n:       0,
 				isError: true,
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/invalid", "default")
-			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.setup()
+			for k, v := range tt.args.env {
+				t.Setenv(k, v)
+			}
 			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
+				FromEnv: tt.args.fromEnv,
 			}
-			actual, err := cfg.List()
+			n, err := cfg.overlayFromEnv(tt.args.base, len(tt.args.base))
 			if tt.expected.isError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
+				assert.Equal(t, tt.expected.e, tt.args.base)
 			}
-			assert.Equal(t, actual, tt.expected.entries)
+			assert.Equal(t, tt.expected.n, n)
 		})
 	}
 }
 
-func TestConfig_Run(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
+func TestConfig_overlayOverrides(t *testing.T) {
+	type args struct {
+		envOverrides bool
+		env          map[string]string
+		base         map[string]string
 	}
 	type expected struct {
-		path    string
-		isError bool
+		e map[string]string
+		n int
 	}
 	tests := []struct {
 		name     string
-		fields   fields
+		args     args
 		expected expected
-		setup    func()
 	}{
 		{
-			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "override and add",
+			args: args{
+				envOverrides: true,
+				env: map[string]string{
+					"LEM_OVERRIDE_API_KEY": "overridden",
+					"LEM_OVERRIDE_API_NEW": "added",
+					"LEM_OVERRIDE_":        "ignored",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:        "API",
-						Dir:           "testdata/sandbox/api",
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api"},
-					},
+				base: map[string]string{
+					"API_KEY": "1",
+					"API_URL": "url",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				path:    "testdata/sandbox/master/.env",
-				isError: false,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"API_KEY": "overridden",
+					"API_URL": "url",
+					"API_NEW": "added",
+				},
+				n: 3,
 			},
 		},
 		{
-			name: "stage table not found",
-			fields: fields{
-				Stage: nil,
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
+			name: "disabled",
+			args: args{
+				envOverrides: false,
+				env: map[string]string{
+					"LEM_OVERRIDE_API_KEY": "overridden",
+				},
+				base: map[string]string{
+					"API_KEY": "1",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"API_KEY": "1",
+				},
+				n: 1,
 			},
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.args.env {
+				t.Setenv(k, v)
+			}
+			cfg := &Config{
+				envOverrides: tt.args.envOverrides,
+			}
+			n := cfg.overlayOverrides(tt.args.base, len(tt.args.base))
+			assert.Equal(t, tt.expected.e, tt.args.base)
+			assert.Equal(t, tt.expected.n, n)
+		})
+	}
+}
+
+func TestConfig_Run_envOverrides(t *testing.T) {
+	t.Setenv("LEM_OVERRIDE_API_1_ENV", "overridden")
+	t.Setenv("LEM_OVERRIDE_FOO", "overridden")
+	prepareState("testdata/sandbox/lem.toml", "default")
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "testdata/sandbox/master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "testdata/sandbox/api", Replaceable: []string{"REPLACEABLE1"}, Plain: []string{"FOO"}},
+		},
+		path:         "testdata/sandbox/lem.toml",
+		size:         32,
+		w:            io.Discard,
+		envOverrides: true,
+	}
+	w := &bytes.Buffer{}
+	cfg.w = w
+	assert.NoError(t, cfg.Print("api"))
+	assert.Equal(t, "API_1_ENV=overridden\nAPI_2_ENV=\"222\"\nAPI_3_ENV='333'\nAPI_4_ENV=`444`\nAPI_6_ENV=6 7 8\nFOO=overridden\n", w.String())
+	entries, err := cfg.List()
+	assert.NoError(t, err)
+	assert.Contains(t, entries, Entry{Group: "api", Prefix: "API", Type: "plain", Name: "FOO", Value: "overridden", Kind: KindString})
+	b, err := os.ReadFile("testdata/sandbox/master/.env")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "overridden")
+}
+
+func TestConfig_makeEnv(t *testing.T) {
+	type args struct {
+		group     Group
+		base      map[string]string
+		separator string
+		groups    map[string]Group
+		format    string
+	}
+	type expected struct {
+		e map[string]string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected expected
+	}{
 		{
-			name: "stage path not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/dummy/.env",
+			name: "basic",
+			args: args{
+				group: Group{
+					Prefix:      "API",
+					Replaceable: []string{"SHARED"},
+					Plain:       []string{"FOO"},
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
+				base: map[string]string{
+					"API_KEY":      "1",
+					"APIKEY":       "2",
+					"SHARED_TOKEN": "3",
+					"FOO":          "4",
+					"UI_KEY":       "5",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"API_KEY":   "1",
+					"API_TOKEN": "3",
+					"FOO":       "4",
+				},
 			},
 		},
 		{
-			name: "group table not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "dot separator",
+			args: args{
+				group: Group{
+					Prefix:      "api",
+					Replaceable: []string{"shared"},
 				},
-				Group: nil,
-				path:  "testdata/sandbox/lem.toml",
-				size:  32,
-				w:     os.Stdout,
+				base: map[string]string{
+					"api.key":      "1",
+					"api_key":      "2",
+					"shared.token": "3",
+				},
+				separator: ".",
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"api.key":   "1",
+					"api.token": "3",
+				},
 			},
 		},
 		{
-			name: "group path not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env",
+			name: "double underscore separator",
+			args: args{
+				group: Group{
+					Prefix: "API",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api/.env",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
+				base: map[string]string{
+					"API__KEY": "1",
+					"API_KEY":  "2",
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
+				separator: "__",
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
-			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+				e: map[string]string{
+					"API__KEY": "1",
+				},
 			},
 		},
 		{
-			name: "central env not found",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env.dummy",
+			name: "catch-all",
+			args: args{
+				group: Group{
+					Prefix:   "MISC",
+					CatchAll: true,
 				},
-				Group: map[string]Group{
+				base: map[string]string{
+					"API_KEY":      "1",
+					"SHARED_TOKEN": "2",
+					"FOO":          "3",
+					"MISC_KEY":     "4",
+					"OTHER":        "5",
+					"UI_KEY":       "6",
+				},
+				groups: map[string]Group{
 					"api": {
 						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
+						Replaceable: []string{"SHARED"},
+						Plain:       []string{"FOO"},
+					},
+					"misc": {
+						Prefix:   "MISC",
+						CatchAll: true,
 					},
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
+				e: map[string]string{
+					"MISC_KEY": "4",
+					"OTHER":    "5",
+					"UI_KEY":   "6",
+				},
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+		},
+		{
+			name: "defaults",
+			args: args{
+				group: Group{
+					Prefix: "API",
+					Plain:  []string{"FOO"},
+					Defaults: map[string]string{
+						"API_KEY":     "default",
+						"API_TIMEOUT": "30",
+						"FOO":         "default",
+						"BAR":         "bar",
+					},
+				},
+				base: map[string]string{
+					"API_KEY": "1",
+					"FOO":     "",
+				},
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_KEY":     "1",
+					"API_TIMEOUT": "30",
+					"FOO":         "",
+					"BAR":         "bar",
+				},
 			},
 		},
 		{
-			name: "empty value",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "testdata/sandbox/master/.env.error",
+			name: "compact json",
+			args: args{
+				group: Group{
+					Prefix: "API",
+					JSON:   "compact",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix:        "API",
-						Dir:           "testdata/sandbox/api",
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api"},
-					},
+				base: map[string]string{
+					"API_THEME": `{"color": "#fff", "tags": ["a", "b"]}`,
+					"API_TEXT":  "a b",
+					"API_BAD":   `{"a": }`,
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
 			},
 			expected: expected{
-				path:    "",
-				isError: true,
+				e: map[string]string{
+					"API_THEME": `{"color":"#fff","tags":["a","b"]}`,
+					"API_TEXT":  "a b",
+					"API_BAD":   `{"a": }`,
+				},
 			},
-			setup: func() {
-				prepareState("testdata/sandbox/lem.toml", "default")
+		},
+		{
+			name: "pretty json",
+			args: args{
+				group: Group{
+					Prefix: "API",
+					JSON:   "pretty",
+				},
+				base: map[string]string{
+					"API_THEME": `{"color":"#fff"}`,
+				},
+				format: FormatStrict,
+			},
+			expected: expected{
+				e: map[string]string{
+					"API_THEME": "{\n  \"color\": \"#fff\"\n}",
+				},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.setup()
 			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
-			}
-			actual, err := cfg.Run()
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
+				Group:     tt.args.groups,
+				Separator: tt.args.separator,
+				size:      32,
+				format:    tt.args.format,
 			}
-			assert.Equal(t, tt.expected.path, actual)
+			actual := cfg.makeEnv(tt.args.group, tt.args.base)
+			assert.Equal(t, tt.expected.e, actual)
 		})
 	}
 }
 
-func TestConfig_Watch(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		size  int
-		w     io.Writer
-	}
-	type expected struct {
-		path    string
-		isError bool
-	}
-	tests := []struct {
-		name     string
-		fields   fields
-		expected expected
-	}{
-		{
-			name: "stop at error",
-			fields: fields{
-				Stage: nil,
+func TestConfig_Run_prettyJSONRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatRaw, FormatStrict} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, d := range []string{"master", "api"} {
+				if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte(`API_THEME={"color": "#fff", "tags": ["a"]}`+"\nAPI_NAME=x\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "lem.toml")
+			prepareState(path, "default")
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
 				Group: map[string]Group{
-					"api": {
-						Prefix:      "API",
-						Dir:         "testdata/sandbox/api",
-						Replaceable: []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:     true,
-					},
+					"api": {Prefix: "API", Dir: "api", JSON: "pretty"},
 				},
-				path: "testdata/sandbox/lem.toml",
-				size: 32,
-				w:    io.Discard,
-			},
-			expected: expected{
-				path:    "",
-				isError: true,
-			},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
+				path:   path,
+				dir:    dir,
+				root:   dir,
+				size:   32,
+				w:      io.Discard,
+				format: format,
 			}
-			actual, err := cfg.Watch()
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
+			_, err := cfg.Run()
+			if format != FormatStrict {
+				assert.ErrorContains(t, err, "failed to validate group.api: json pretty requires the strict format")
+				assert.NoFileExists(t, filepath.Join(dir, "api", ".env"))
+				return
 			}
-			assert.Equal(t, tt.expected.path, actual)
+			assert.NoError(t, err)
+			actual, _, err := cfg.readEnv(context.Background(), filepath.Join(dir, "api", ".env"))
+			assert.NoError(t, err)
+			group, _ := cfg.groupOf("default", "api")
+			_, _, e, _, err := cfg.readCentralEnv(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, actual, 2)
+			assert.Equal(t, cfg.makeEnv(group, e), actual)
 		})
 	}
 }
 
-func Test_createEnvrc(t *testing.T) {
-	type fields struct {
-		Stage map[string]string
-		Group map[string]Group
-		path  string
-		dir   string
-		root  string
-		size  int
-		w     io.Writer
-	}
+func TestConfig_writeEnv(t *testing.T) {
 	type args struct {
-		group Group
-		dir   string
+		env        map[string]string
+		format     string
+		lineEnding string
+		outSep     string
 	}
 	type expected struct {
 		content string
@@ -1398,187 +10455,187 @@ func Test_createEnvrc(t *testing.T) {
 	}
 	tests := []struct {
 		name     string
-		fields   fields
 		args     args
 		expected expected
 	}{
 		{
 			name: "basic",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "dummy",
+			args: args{
+				env: map[string]string{
+					"ZKEY": "zvalue",
+					"AKEY": "avalue",
+					"CKEY": "cvalue",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix: "API",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/api")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", "ui"},
-					},
-					"ui": {
-						Prefix: "UI",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/ui")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1"},
-						IsCheck:       false,
-						DirenvSupport: []string{"ui"},
-					},
+			},
+			expected: expected{
+				content: "AKEY=avalue\nCKEY=cvalue\nZKEY=zvalue\n",
+				isError: false,
+			},
+		},
+		{
+			name: "empty map",
+			args: args{
+				env: map[string]string{},
+			},
+			expected: expected{
+				content: "",
+				isError: false,
+			},
+		},
+		{
+			name: "single",
+			args: args{
+				env: map[string]string{
+					"KEY1": "value1",
 				},
-				dir: func() string {
-					path, _ := filepath.Abs("testdata/sandbox")
-					return path
-				}(),
-				root: func() string {
-					path, _ := filepath.Abs("testdata/sandbox")
-					return path
-				}(),
 			},
+			expected: expected{
+				content: "KEY1=value1\n",
+				isError: false,
+			},
+		},
+		{
+			name: "contains spaces",
 			args: args{
-				group: Group{
-					Prefix: "API",
-					Dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/api")
-						return path
-					}(),
-					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-					IsCheck:       true,
-					DirenvSupport: []string{"api", "ui"},
+				env: map[string]string{
+					"SPACES": "value with spaces",
+					"TABS":   "value\twith\ttabs",
 				},
-				dir: func() string {
-					path, _ := filepath.Abs("testdata/sandbox/api")
-					return path
-				}(),
 			},
 			expected: expected{
-				content: "watch_file ./.env\ndotenv_if_exists ./.env\nwatch_file ../ui/.env\ndotenv_if_exists ../ui/.env\n",
+				content: "SPACES=value with spaces\nTABS=value\twith\ttabs\n",
 				isError: false,
 			},
 		},
 		{
-			name: "resolve error",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "dummy",
+			name: "empty value",
+			args: args{
+				env: map[string]string{
+					"EMPTY": "",
+					"FULL":  "content",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix: "API",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/api")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", "ui"},
-					},
-					"ui": {
-						Prefix: "UI",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/ui")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1"},
-						IsCheck:       false,
-						DirenvSupport: []string{"ui"},
-					},
+			},
+			expected: expected{
+				content: "EMPTY=\nFULL=content\n",
+				isError: false,
+			},
+		},
+		{
+			name: "special chars",
+			args: args{
+				env: map[string]string{
+					"URL":     "https://example.com?a=b&c=d",
+					"CONTROL": "line1\nline2",
+					"HASH":    "value#with#hash",
 				},
-				dir:  "testdata/sandbox",
-				root: "testdata/sandbox",
 			},
+			expected: expected{
+				content: "CONTROL=line1\nline2\nHASH=value#with#hash\nURL=https://example.com?a=b&c=d\n",
+				isError: false,
+			},
+		},
+		{
+			name: "strict",
 			args: args{
-				group: Group{
-					Prefix: "API",
-					Dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/api")
-						return path
-					}(),
-					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-					IsCheck:       true,
-					DirenvSupport: []string{"api", "ui"},
+				env: map[string]string{
+					"URL":     "https://example.com?a=b&c=d",
+					"CONTROL": "line1\nline2",
+					"QUOTE":   `say "hi"`,
+					"SINGLE":  "'333'",
+					"PADDED":  "  padded ",
+					"EMPTY":   "",
+				},
+				format: FormatStrict,
+			},
+			expected: expected{
+				content: "CONTROL=\"line1\\nline2\"\nEMPTY=\nPADDED=\"  padded \"\nQUOTE=\"say \\\"hi\\\"\"\nSINGLE=\"'333'\"\nURL=https://example.com?a=b&c=d\n",
+				isError: false,
+			},
+		},
+		{
+			name: "lf",
+			args: args{
+				env: map[string]string{
+					"AKEY":  "avalue",
+					"MULTI": "line1\nline2",
+				},
+				lineEnding: LineEndingLF,
+			},
+			expected: expected{
+				content: "AKEY=avalue\nMULTI=line1\nline2\n",
+				isError: false,
+			},
+		},
+		{
+			name: "crlf",
+			args: args{
+				env: map[string]string{
+					"AKEY":  "avalue",
+					"MULTI": "line1\nline2",
 				},
-				dir: func() string {
-					path, _ := filepath.Abs("testdata/sandbox/api")
-					return path
-				}(),
+				lineEnding: LineEndingCRLF,
 			},
 			expected: expected{
-				content: "",
-				isError: true,
+				content: "AKEY=avalue\r\nMULTI=line1\r\nline2\r\n",
+				isError: false,
 			},
 		},
 		{
-			name: "directory but file",
-			fields: fields{
-				Stage: map[string]string{
-					"default": "dummy",
+			name: "colon space",
+			args: args{
+				env: map[string]string{
+					"AKEY": "avalue",
+					"BKEY": "",
 				},
-				Group: map[string]Group{
-					"api": {
-						Prefix: "API",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/api/.env")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-						IsCheck:       true,
-						DirenvSupport: []string{"api", "ui"},
-					},
-					"ui": {
-						Prefix: "UI",
-						Dir: func() string {
-							path, _ := filepath.Abs("testdata/sandbox/ui")
-							return path
-						}(),
-						Replaceable:   []string{"REPLACEABLE1"},
-						IsCheck:       false,
-						DirenvSupport: []string{"ui"},
-					},
+				outSep: ": ",
+			},
+			expected: expected{
+				content: "AKEY: avalue\nBKEY: \n",
+				isError: false,
+			},
+		},
+		{
+			name: "colon space strict",
+			args: args{
+				env: map[string]string{
+					"AKEY":  "a value",
+					"MULTI": "line1\nline2",
 				},
-				dir: func() string {
-					path, _ := filepath.Abs("testdata/sandbox")
-					return path
-				}(),
+				format: FormatStrict,
+				outSep: ": ",
+			},
+			expected: expected{
+				content: "AKEY: a value\nMULTI: \"line1\\nline2\"\n",
+				isError: false,
 			},
+		},
+		{
+			name: "crlf strict",
 			args: args{
-				group: Group{
-					Prefix: "API",
-					Dir: func() string {
-						path, _ := filepath.Abs("testdata/sandbox/api/.env")
-						return path
-					}(),
-					Replaceable:   []string{"REPLACEABLE1", "REPLACEABLE2"},
-					IsCheck:       true,
-					DirenvSupport: []string{"api", "ui"},
+				env: map[string]string{
+					"AKEY":  "avalue",
+					"MULTI": "line1\nline2",
 				},
-				dir: func() string {
-					path, _ := filepath.Abs("testdata/sandbox/api")
-					return path
-				}(),
+				format:     FormatStrict,
+				lineEnding: LineEndingCRLF,
 			},
 			expected: expected{
-				content: "",
-				isError: true,
+				content: "AKEY=avalue\r\nMULTI=\"line1\\nline2\"\r\n",
+				isError: false,
 			},
 		},
 	}
-	for _, tt := range tests {
+	for i, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, fmt.Sprintf("%d.env", i))
 			cfg := &Config{
-				Stage: tt.fields.Stage,
-				Group: tt.fields.Group,
-				path:  tt.fields.path,
-				dir:   tt.fields.dir,
-				root:  tt.fields.root,
-				size:  tt.fields.size,
-				w:     tt.fields.w,
+				root:       dir,
+				format:     tt.args.format,
+				lineEnding: tt.args.lineEnding,
+				outSep:     tt.args.outSep,
 			}
-			path, err := cfg.createEnvrc(tt.args.group, tt.args.dir)
+			err := cfg.writeEnv(path, tt.args.env)
 			if tt.expected.isError {
 				assert.Error(t, err)
 				return
@@ -1588,145 +10645,245 @@ func Test_createEnvrc(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to read written file: %v", err)
 			}
-			assert.Equal(t, string(content), tt.expected.content)
+			assert.Equal(t, []byte(tt.expected.content), content)
 		})
 	}
 }
 
-func Test_projectRoot(t *testing.T) {
-	type args struct {
-		dir string
+func TestConfig_writeEnv_roundTrip(t *testing.T) {
+	env := map[string]string{
+		"CONTROL":  "line1\nline2\r\n",
+		"QUOTE":    `"222"`,
+		"SINGLE":   "'333'",
+		"BACKTICK": "`444`",
+		"PADDED":   "\t padded ",
+		"ESCAPE":   `C:\path\to`,
+		"MULTI":    `"""`,
+		"PLAIN":    "value with spaces",
+		"EMPTY":    "",
 	}
-	type expected struct {
-		dir string
+	dir := t.TempDir()
+	cfg := &Config{
+		root:   dir,
+		size:   32,
+		format: FormatStrict,
 	}
+	path := filepath.Join(dir, ".env")
+	assert.NoError(t, cfg.writeEnv(path, env))
+	actual, n, err := cfg.readEnv(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, env, actual)
+	assert.Equal(t, len(env), n)
+}
+
+func TestConfig_writeEnv_outsideRoot(t *testing.T) {
+	root := t.TempDir()
+	external := t.TempDir()
 	tests := []struct {
-		name     string
-		args     args
-		gitDir   string
-		expected expected
+		name          string
+		path          string
+		outputRoot    string
+		allowExternal bool
+		isError       bool
 	}{
 		{
-			name: "basic",
-			args: args{
-				dir: "testdata/sandbox",
-			},
-			expected: expected{
-				dir: "testdata/sandbox",
-			},
+			name: "inside root",
+			path: filepath.Join(root, "api", ".env"),
 		},
 		{
-			name: "child",
-			args: args{
-				dir: "testdata/sandbox/api",
-			},
-			expected: expected{
-				dir: "testdata/sandbox",
-			},
+			name:    "outside root",
+			path:    filepath.Join(external, ".env"),
+			isError: true,
 		},
 		{
-			name: "nested",
-			args: args{
-				dir: "testdata/sandbox/api/subdir",
-			},
-			expected: expected{
-				dir: "testdata/sandbox",
-			},
+			name:    "dot dot",
+			path:    filepath.Join(root, "..", filepath.Base(external), ".env"),
+			isError: true,
 		},
 		{
-			name: ".git not found",
-			args: args{
-				dir: "testdata/sandbox",
-			},
-			gitDir: ".notfound",
-			expected: expected{
-				dir: "testdata/sandbox",
-			},
+			name:          "outside root allowed",
+			path:          filepath.Join(external, ".env"),
+			allowExternal: true,
+		},
+		{
+			name:       "under output root",
+			path:       filepath.Join(external, "api", ".env"),
+			outputRoot: external,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if tt.gitDir != "" {
-				gitDir = tt.gitDir
+			cfg := &Config{
+				root:          root,
+				outputRoot:    tt.outputRoot,
+				allowExternal: tt.allowExternal,
 			}
-			actual := projectRoot(tt.args.dir)
-			assert.Equal(t, tt.expected.dir, actual)
-			gitDir = dummyGitDir
+			err := cfg.writeEnv(tt.path, map[string]string{"KEY": "value"})
+			if tt.isError {
+				var outsideErr *OutsideRootError
+				assert.ErrorAs(t, err, &outsideErr)
+				assert.False(t, exists(tt.path))
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, exists(tt.path))
 		})
 	}
 }
 
-func Test_readEnv(t *testing.T) {
-	type args struct {
-		path string
-		size int
+func TestConfig_Run_relativeOutputRoot(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"master", "api"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
 	}
-	type expected struct {
-		e       map[string]string
-		n       int
-		isError bool
+	if err := os.WriteFile(filepath.Join(dir, "master", ".env"), []byte("API_A=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lem.toml")
+	prepareState(path, "default")
+	// The state file stays where it is while running from another directory
+	statePath, err := filepath.Abs(filepath.Join("testdata", "sandbox", "state"))
+	if err != nil {
+		t.Fatal(err)
 	}
+	statePathFunc = func() (string, error) { return statePath, nil }
+	t.Cleanup(func() { statePathFunc = dummyStatePath })
+	cwd := t.TempDir()
+	t.Chdir(cwd)
+	cfg := &Config{
+		Stage: map[string]Stage{
+			"default": {Path: "master/.env"},
+		},
+		Group: map[string]Group{
+			"api": {Prefix: "API", Dir: "api"},
+		},
+		path:       path,
+		dir:        dir,
+		root:       dir,
+		size:       32,
+		w:          io.Discard,
+		outputRoot: "out/{{stage}}",
+	}
+	_, err = cfg.Run()
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "out", "default", "api", ".env"))
+	assert.NoDirExists(t, filepath.Join(cwd, "out"))
+}
+
+func TestConfig_checkWritable_outputRoot(t *testing.T) {
+	root := t.TempDir()
+	external := t.TempDir()
 	tests := []struct {
-		name     string
-		args     args
-		expected expected
+		name       string
+		path       string
+		outputRoot string
+		isError    bool
 	}{
 		{
-			name: "patterns",
-			args: args{
-				path: "testdata/sandbox/master/.env",
-				size: 32,
-			},
-			expected: expected{
-				e: map[string]string{
-					"API_1_ENV":          "111",
-					"API_2_ENV":          "\"222\"",
-					"API_3_ENV":          "'333'",
-					"API_4_ENV":          "`444`",
-					"BAR":                "bar",
-					"BAZ":                "baz",
-					"FOO":                "foo",
-					"REPLACEABLE1_6_ENV": "6 7 8",
-					"UI_5_ENV":           "555",
-				},
-				n:       9,
-				isError: false,
-			},
+			name:       "under stage output root",
+			path:       filepath.Join(external, "default", "api", ".env"),
+			outputRoot: filepath.Join(external, "{{stage}}"),
 		},
 		{
-			name: "empty file",
-			args: args{
-				path: "testdata/sandbox/master/.env.empty",
-				size: 32,
-			},
-			expected: expected{
-				e:       map[string]string{},
-				n:       0,
-				isError: false,
-			},
+			name:       "under unknown stage",
+			path:       filepath.Join(external, "other", "api", ".env"),
+			outputRoot: filepath.Join(external, "{{stage}}"),
+			isError:    true,
+		},
+		{
+			name:       "dot dot segments",
+			path:       external + "/default/../../escape/.env",
+			outputRoot: filepath.Join(external, "{{stage}}"),
+			isError:    true,
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m, n, err := readEnv(tt.args.path, tt.args.size)
-			if tt.expected.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
+			cfg := &Config{
+				Stage: map[string]Stage{
+					"default": {Path: "master/.env"},
+				},
+				root:       root,
+				dir:        root,
+				outputRoot: tt.outputRoot,
 			}
-			assert.Equal(t, tt.expected.e, m)
-			assert.Equal(t, tt.expected.n, n)
+			err := cfg.checkWritable(tt.path)
+			if tt.isError {
+				var outsideErr *OutsideRootError
+				assert.ErrorAs(t, err, &outsideErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestConfig_writeEnv_roundTripOutputSeparator(t *testing.T) {
+	env := map[string]string{
+		"URL":    "https://example.com:8080",
+		"QUOTE":  `"222"`,
+		"PLAIN":  "value with spaces",
+		"EMPTY":  "",
+		"EQUALS": "a=b",
+	}
+	dir := t.TempDir()
+	cfg := &Config{
+		root:   dir,
+		size:   32,
+		format: FormatStrict,
+		outSep: ": ",
+		kvSep:  ":",
+	}
+	path := filepath.Join(dir, ".env")
+	assert.NoError(t, cfg.writeEnv(path, env))
+	actual, n, err := cfg.readEnv(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, env, actual)
+	assert.Equal(t, len(env), n)
+}
+
+func Test_inferKind(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "int", value: "8080", expected: KindInt},
+		{name: "negative int", value: "-1", expected: KindInt},
+		{name: "zero", value: "0", expected: KindInt},
+		{name: "leading zeros", value: "007", expected: KindString},
+		{name: "plus sign", value: "+1", expected: KindString},
+		{name: "float", value: "1.5", expected: KindString},
+		{name: "overflow", value: "99999999999999999999", expected: KindString},
+		{name: "true", value: "true", expected: KindBool},
+		{name: "false", value: "false", expected: KindBool},
+		{name: "capitalized bool", value: "True", expected: KindString},
+		{name: "yes", value: "yes", expected: KindString},
+		{name: "json object", value: `{"a":1}`, expected: KindJSON},
+		{name: "json array", value: `[1,2]`, expected: KindJSON},
+		{name: "invalid json", value: `{a:1}`, expected: KindString},
+		{name: "json scalar", value: `"a"`, expected: KindString},
+		{name: "empty", value: "", expected: KindString},
+		{name: "string", value: "foo", expected: KindString},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, inferKind(tt.value))
 		})
 	}
 }
 
-func Test_writeEnv(t *testing.T) {
+func Test_retry(t *testing.T) {
 	type args struct {
-		env map[string]string
+		ctx      func() context.Context
+		attempts int
+		failures int
+		err      error
 	}
 	type expected struct {
-		content string
+		calls   int
 		isError bool
 	}
 	tests := []struct {
@@ -1735,96 +10892,107 @@ func Test_writeEnv(t *testing.T) {
 		expected expected
 	}{
 		{
-			name: "basic",
+			name: "success",
 			args: args{
-				env: map[string]string{
-					"ZKEY": "zvalue",
-					"AKEY": "avalue",
-					"CKEY": "cvalue",
-				},
+				attempts: 3,
+				failures: 0,
+				err:      nil,
 			},
 			expected: expected{
-				content: "AKEY=avalue\nCKEY=cvalue\nZKEY=zvalue\n",
+				calls:   1,
 				isError: false,
 			},
 		},
 		{
-			name: "empty map",
+			name: "success after transient errors",
 			args: args{
-				env: map[string]string{},
+				attempts: 3,
+				failures: 2,
+				err:      &os.PathError{Op: "open", Path: "dummy", Err: syscall.EAGAIN},
 			},
 			expected: expected{
-				content: "",
+				calls:   3,
 				isError: false,
 			},
 		},
 		{
-			name: "single",
+			name: "retries exhausted",
 			args: args{
-				env: map[string]string{
-					"KEY1": "value1",
-				},
+				attempts: 3,
+				failures: 5,
+				err:      &os.PathError{Op: "open", Path: "dummy", Err: syscall.ETXTBSY},
 			},
 			expected: expected{
-				content: "KEY1=value1\n",
-				isError: false,
+				calls:   3,
+				isError: true,
 			},
 		},
 		{
-			name: "contains spaces",
+			name: "permanent error",
 			args: args{
-				env: map[string]string{
-					"SPACES": "value with spaces",
-					"TABS":   "value\twith\ttabs",
-				},
+				attempts: 3,
+				failures: 5,
+				err:      &os.PathError{Op: "open", Path: "dummy", Err: syscall.EACCES},
 			},
 			expected: expected{
-				content: "SPACES=value with spaces\nTABS=value\twith\ttabs\n",
-				isError: false,
+				calls:   1,
+				isError: true,
 			},
 		},
 		{
-			name: "empty value",
+			name: "context canceled",
 			args: args{
-				env: map[string]string{
-					"EMPTY": "",
-					"FULL":  "content",
+				ctx: func() context.Context {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					return ctx
 				},
+				attempts: 3,
+				failures: 0,
+				err:      context.Canceled,
 			},
 			expected: expected{
-				content: "EMPTY=\nFULL=content\n",
-				isError: false,
+				calls:   0,
+				isError: true,
 			},
 		},
 		{
-			name: "special chars",
+			name: "zero attempts",
 			args: args{
-				env: map[string]string{
-					"URL":     "https://example.com?a=b&c=d",
-					"CONTROL": "line1\nline2",
-					"HASH":    "value#with#hash",
-				},
+				attempts: 0,
+				failures: 0,
+				err:      nil,
 			},
 			expected: expected{
-				content: "CONTROL=line1\nline2\nHASH=value#with#hash\nURL=https://example.com?a=b&c=d\n",
+				calls:   1,
 				isError: false,
 			},
 		},
 	}
-	for i, tt := range tests {
+	retryInterval = time.Millisecond
+	defer func() {
+		retryInterval = 100 * time.Millisecond
+	}()
+	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			path := filepath.Join(t.TempDir(), fmt.Sprintf("%d.env", i))
-			err := writeEnv(path, tt.args.env)
-			if tt.expected.isError {
-				assert.Error(t, err)
-				return
+			ctx := context.Background()
+			if tt.args.ctx != nil {
+				ctx = tt.args.ctx()
 			}
-			assert.NoError(t, err)
-			content, err := os.ReadFile(filepath.Clean(path))
-			if err != nil {
-				t.Fatalf("failed to read written file: %v", err)
+			calls := 0
+			err := retry(ctx, tt.args.attempts, func() error {
+				calls++
+				if calls <= tt.args.failures {
+					return tt.args.err
+				}
+				return nil
+			})
+			if tt.expected.isError {
+				assert.ErrorIs(t, err, tt.args.err)
+			} else {
+				assert.NoError(t, err)
 			}
-			assert.Equal(t, tt.expected.content, string(content))
+			assert.Equal(t, tt.expected.calls, calls)
 		})
 	}
 }